@@ -7,25 +7,144 @@ import (
 	"io"
 	"log"
 	"path/filepath"
+	"time"
 )
 
-func build(pwd string, logger *log.Logger, writer io.Writer) error {
+// Options controls how a Kude package is built.
+type Options struct {
+	// Parameters provides values for the pipeline's parameters.
+	Parameters map[string]interface{}
+
+	// UpdateLock rewrites the package's lock file with whatever is resolved during the build, instead of verifying
+	// remote resources & function images against it.
+	UpdateLock bool
+
+	// Vendor copies remote resources & function images used during the build into the package's vendor directory.
+	Vendor bool
+
+	// Offline reads remote resources & function images exclusively from the package's vendor directory.
+	Offline bool
+
+	// CacheDir is the directory remote resources are cached in; defaults to kude.DefaultCacheDir.
+	CacheDir string
+
+	// CacheTTL is the amount of time cached remote resources are reused; defaults to kude.DefaultCacheTTL.
+	CacheTTL time.Duration
+
+	// Refresh downloads all remote resources again, regardless of their age in the cache.
+	Refresh bool
+
+	// Auth provides credentials for downloading remote resources.
+	Auth *kude.AuthConfig
+
+	// Validate validates the resulting resources against the OpenAPI schemas of KubernetesVersion (or Schemas), as well
+	// as those of custom resource definitions among them.
+	Validate bool
+
+	// KubernetesVersion is the Kubernetes version the package targets. When set, resources using API versions that are
+	// deprecated or removed in that version are reported. Unless Schemas is set, it also selects the schemas to validate
+	// resources against, defaulting to kude.DefaultKubernetesVersion; validating against a version whose schemas are not
+	// bundled with Kude (see kude.SupportedKubernetesVersions) fails the build.
+	KubernetesVersion string
+
+	// Schemas lists OpenAPI schema files (or directories of them) to validate resources against, instead of the schemas
+	// bundled with Kude (see kude.NewValidatorWithSchemas).
+	Schemas []string
+
+	// IgnoreMissingSchemas skips validation of resources whose schema is unknown, instead of failing.
+	IgnoreMissingSchemas bool
+
+	// Input, if set, provides the resources to run the pipeline's steps over, instead of the pipeline's resources.
+	Input io.Reader
+}
+
+// Build builds the Kude package in the given directory, writing the resulting resources to the given writer. Remote
+// resources & function images are verified against the package's lock file, if it exists.
+func Build(pwd string, opts Options, logger *log.Logger, writer io.Writer) error {
 	pwd, err := filepath.Abs(pwd)
 	if err != nil {
 		return fmt.Errorf("failed converting path '%s' to an absolute path: %w", pwd, err)
+	} else if opts.Vendor && opts.Offline {
+		return fmt.Errorf("cannot vendor dependencies while offline")
 	}
 
 	ctx := context.Background()
 
-	pipeline, err := kude.NewPipeline(pwd)
+	pipeline, err := kude.NewPipelineWithParameters(pwd, opts.Parameters)
 	if err != nil {
 		return fmt.Errorf("failed to create pipeline: %w", err)
 	}
 
-	execution, err := kude.NewExecution(pipeline, logger)
+	lock, err := kude.LoadLock(pwd, opts.UpdateLock)
+	if err != nil {
+		return fmt.Errorf("failed to load lock file: %w", err)
+	}
+
+	var vendor *kude.Vendor
+	if opts.Vendor || opts.Offline {
+		if vendor, err = kude.OpenVendor(pwd, opts.Offline); err != nil {
+			return fmt.Errorf("failed to open vendor directory: %w", err)
+		}
+		defer vendor.Discard()
+	}
+
+	cacheDir := opts.CacheDir
+	if cacheDir == "" {
+		if cacheDir, err = kude.DefaultCacheDir(); err != nil {
+			return err
+		}
+	}
+	cacheTTL := opts.CacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = kude.DefaultCacheTTL
+	}
+	cache := kude.NewCache(cacheDir, cacheTTL, opts.Refresh)
+
+	var validator *kude.Validator
+	if opts.Validate {
+		if validator, err = NewValidator(opts); err != nil {
+			return err
+		}
+	}
+
+	execution, err := kude.NewExecution(pipeline, logger, kude.WithLock(lock), kude.WithVendor(vendor), kude.WithCache(cache), kude.WithAuth(opts.Auth), kude.WithValidator(validator), kude.WithKubernetesVersion(opts.KubernetesVersion), kude.WithInput(opts.Input))
 	if err != nil {
 		return fmt.Errorf("failed to create pipeline execution: %w", err)
 	}
 
-	return execution.ExecuteToWriter(ctx, writer)
+	if err := execution.ExecuteToWriter(ctx, writer); err != nil {
+		return err
+	}
+	if opts.UpdateLock {
+		if err := lock.Save(pwd); err != nil {
+			return fmt.Errorf("failed to save lock file: %w", err)
+		}
+	}
+	if opts.Vendor {
+		if err := vendor.Save(); err != nil {
+			return fmt.Errorf("failed to save vendor directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// NewValidator creates a validator for the schemas selected by the given options (see Options.Schemas and
+// Options.KubernetesVersion).
+func NewValidator(opts Options) (*kude.Validator, error) {
+	if len(opts.Schemas) > 0 {
+		validator, err := kude.NewValidatorWithSchemas(opts.Schemas, opts.IgnoreMissingSchemas)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create validator: %w", err)
+		}
+		return validator, nil
+	}
+	kubernetesVersion := opts.KubernetesVersion
+	if kubernetesVersion == "" {
+		kubernetesVersion = kude.DefaultKubernetesVersion
+	}
+	validator, err := kude.NewValidator(kubernetesVersion, opts.IgnoreMissingSchemas)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create validator: %w", err)
+	}
+	return validator, nil
 }
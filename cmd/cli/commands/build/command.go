@@ -4,9 +4,10 @@ import (
 	_ "embed"
 	"fmt"
 	"github.com/arikkfir/kude/cmd/cli/commands/root"
+	kude "github.com/arikkfir/kude/pkg"
 	"github.com/spf13/cobra"
 	"log"
-	"os"
+	"strings"
 )
 
 //go:embed description.txt
@@ -17,20 +18,75 @@ var buildCmd = &cobra.Command{
 	SilenceUsage:      true,
 	DisableAutoGenTag: true,
 	Short:             "Build the Kude package in the current directory",
-	Example:           `kude build`,
+	Example:           `kude build --param environment=staging`,
 	Long:              longDescription,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		pwd := cmd.Flags().Lookup("path").Value.String()
-		return build(pwd, log.Default(), cmd.OutOrStdout())
+		pwd, opts, err := ReadPackageFlags(cmd, "path")
+		if err != nil {
+			return err
+		}
+		updateLock, err := cmd.Flags().GetBool("update-lock")
+		if err != nil {
+			return fmt.Errorf("failed reading update-lock flag: %w", err)
+		}
+		offline, err := cmd.Flags().GetBool("offline")
+		if err != nil {
+			return fmt.Errorf("failed reading offline flag: %w", err)
+		}
+		cacheTTL, err := cmd.Flags().GetDuration("cache-ttl")
+		if err != nil {
+			return fmt.Errorf("failed reading cache-ttl flag: %w", err)
+		}
+		refresh, err := cmd.Flags().GetBool("refresh")
+		if err != nil {
+			return fmt.Errorf("failed reading refresh flag: %w", err)
+		}
+		validate, err := cmd.Flags().GetBool("validate")
+		if err != nil {
+			return fmt.Errorf("failed reading validate flag: %w", err)
+		}
+		ignoreMissingSchemas, err := cmd.Flags().GetBool("ignore-missing-schemas")
+		if err != nil {
+			return fmt.Errorf("failed reading ignore-missing-schemas flag: %w", err)
+		}
+		schemas, err := cmd.Flags().GetStringArray("schemas")
+		if err != nil {
+			return fmt.Errorf("failed reading schemas flag: %w", err)
+		}
+		kubernetesVersion := cmd.Flags().Lookup("kube-version").Value.String()
+		if validate && kubernetesVersion != "" && len(schemas) == 0 {
+			if err := kude.CheckValidationVersion(kubernetesVersion); err != nil {
+				return fmt.Errorf("invalid kube-version flag: %w", err)
+			}
+		}
+		opts.UpdateLock = updateLock
+		opts.Offline = offline
+		opts.CacheDir = cmd.Flags().Lookup("cache-dir").Value.String()
+		opts.CacheTTL = cacheTTL
+		opts.Refresh = refresh
+
+		opts.Validate = validate
+		opts.KubernetesVersion = kubernetesVersion
+		opts.Schemas = schemas
+		opts.IgnoreMissingSchemas = ignoreMissingSchemas
+		return Build(pwd, opts, log.Default(), cmd.OutOrStdout())
 	},
 }
 
 func init() {
-	pwd, err := os.Getwd()
-	if err != nil {
-		panic(fmt.Errorf("failed to get current working directory: %w", err))
-	}
-	buildCmd.Flags().StringP("path", "p", pwd, "pipeline path (defaults to current directory)")
+	AddPackageFlags(buildCmd, "path", "p")
+	buildCmd.Flags().Bool("update-lock", false, "update the kude.lock file instead of failing when resources or images drift from it")
+
+	buildCmd.Flags().Bool("offline", false, "read remote resources and function images only from the vendor directory (see 'kude vendor')")
+
+	buildCmd.Flags().String("cache-dir", "", "directory to cache remote resources in (defaults to the user's cache directory)")
+	buildCmd.Flags().Duration("cache-ttl", kude.DefaultCacheTTL, "amount of time cached remote resources are reused before being downloaded again")
+	buildCmd.Flags().Bool("refresh", false, "download all remote resources again, regardless of the cache")
+
+	buildCmd.Flags().Bool("validate", false, "validate resulting resources against Kubernetes OpenAPI schemas (see 'kude validate')")
+	buildCmd.Flags().String("kube-version", "", "target Kubernetes version: report deprecated & removed API versions, and validate against its schemas (defaults to "+kude.DefaultKubernetesVersion+" for --validate; validation supports "+strings.Join(kude.SupportedKubernetesVersions(), ", ")+")")
+	buildCmd.Flags().StringArray("schemas", nil, "OpenAPI schema file, or directory of schema files, to validate against instead of the bundled schemas (can be repeated)")
+	buildCmd.Flags().Bool("ignore-missing-schemas", false, "skip validation of resources whose schema is unknown, instead of failing")
 
 	root.Cmd.AddCommand(buildCmd)
 }
@@ -0,0 +1,77 @@
+package build
+
+import (
+	"fmt"
+	"github.com/arikkfir/kude/cmd/cli/commands/root"
+	kude "github.com/arikkfir/kude/pkg"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"os"
+	"strings"
+)
+
+// AddPackageFlags adds the flags shared by all commands building a package to the given command: the package path
+// (named by the given flag name & shorthand), and the package parameters.
+func AddPackageFlags(cmd *cobra.Command, pathFlag, pathShorthand string) {
+	pwd, err := os.Getwd()
+	if err != nil {
+		panic(fmt.Errorf("failed to get current working directory: %w", err))
+	}
+	cmd.Flags().StringP(pathFlag, pathShorthand, pwd, "pipeline path (defaults to current directory)")
+	cmd.Flags().StringArray("param", nil, "pipeline parameter value, as 'key=value' (can be repeated)")
+	cmd.Flags().String("params-file", "", "YAML file with pipeline parameter values (overridden by --param)")
+}
+
+// ReadPackageFlags reads the flags added by AddPackageFlags, returning the package path, along with build options
+// providing the package parameters & the credentials from the Kude configuration.
+func ReadPackageFlags(cmd *cobra.Command, pathFlag string) (string, Options, error) {
+	pwd := cmd.Flags().Lookup(pathFlag).Value.String()
+	paramsFile := cmd.Flags().Lookup("params-file").Value.String()
+	params, err := cmd.Flags().GetStringArray("param")
+	if err != nil {
+		return "", Options{}, fmt.Errorf("failed reading parameters: %w", err)
+	}
+	parameters, err := loadParameters(paramsFile, params)
+	if err != nil {
+		return "", Options{}, err
+	}
+	auth, err := loadAuthConfig()
+	if err != nil {
+		return "", Options{}, err
+	}
+	return pwd, Options{Parameters: parameters, Auth: auth}, nil
+}
+
+// loadParameters merges parameter values from the given parameters file (a YAML mapping of parameter names to values)
+// with the given "key=value" pairs, the latter taking precedence.
+func loadParameters(paramsFile string, params []string) (map[string]interface{}, error) {
+	parameters := make(map[string]interface{})
+	if paramsFile != "" {
+		b, err := os.ReadFile(paramsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading parameters file '%s': %w", paramsFile, err)
+		} else if err := yaml.Unmarshal(b, &parameters); err != nil {
+			return nil, fmt.Errorf("failed decoding parameters file '%s': %w", paramsFile, err)
+		}
+	}
+	for _, param := range params {
+		key, value, found := strings.Cut(param, "=")
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid parameter '%s' (expected 'key=value')", param)
+		}
+		parameters[key] = value
+	}
+	return parameters, nil
+}
+
+// loadAuthConfig reads the "auth" section of the Kude configuration, if any.
+func loadAuthConfig() (*kude.AuthConfig, error) {
+	if root.Config == nil || !root.Config.IsSet("auth") {
+		return nil, nil
+	}
+	auth := &kude.AuthConfig{}
+	if err := root.Config.UnmarshalKey("auth", auth); err != nil {
+		return nil, fmt.Errorf("failed reading auth configuration: %w", err)
+	}
+	return auth, nil
+}
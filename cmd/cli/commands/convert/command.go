@@ -0,0 +1,87 @@
+package convert
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"github.com/arikkfir/kude/cmd/cli/commands/root"
+	kude "github.com/arikkfir/kude/pkg"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+//go:embed description.txt
+var longDescription string
+
+//go:embed kustomize_description.txt
+var kustomizeLongDescription string
+
+var convertCmd = &cobra.Command{
+	Use:               "convert",
+	DisableAutoGenTag: true,
+	Short:             "Convert packages of other tools into Kude packages",
+	Long:              longDescription,
+}
+
+var convertKustomizeCmd = &cobra.Command{
+	Use:               "kustomize <dir>",
+	SilenceUsage:      true,
+	DisableAutoGenTag: true,
+	Short:             "Convert a kustomization into a Kude pipeline",
+	Example:           `kude convert kustomize ./overlays/production`,
+	Long:              kustomizeLongDescription,
+	Args:              cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir := args[0]
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			return fmt.Errorf("failed reading force flag: %w", err)
+		}
+		stdout, err := cmd.Flags().GetBool("stdout")
+		if err != nil {
+			return fmt.Errorf("failed reading stdout flag: %w", err)
+		}
+
+		kudeYAMLFile := filepath.Join(dir, "kude.yaml")
+		if !force && !stdout {
+			if _, err := os.Stat(kudeYAMLFile); err == nil {
+				return fmt.Errorf("'%s' already exists (use --force to overwrite it)", kudeYAMLFile)
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to stat '%s': %w", kudeYAMLFile, err)
+			}
+		}
+
+		manifest, notes, err := kude.ConvertKustomization(dir)
+		if err != nil {
+			return err
+		}
+
+		// Notes go to stderr, so the manifest can be redirected when printed to stdout
+		logger := log.New(cmd.ErrOrStderr(), "", 0)
+		for _, note := range notes {
+			logger.Printf("Warning: %s", note)
+		}
+		if stdout {
+			_, err := cmd.OutOrStdout().Write(manifest)
+			return err
+		} else if err := os.WriteFile(kudeYAMLFile, manifest, 0644); err != nil {
+			return fmt.Errorf("failed writing '%s': %w", kudeYAMLFile, err)
+		}
+		if len(notes) > 0 {
+			logger.Printf("Wrote '%s'; review the warnings above, as some parts of the kustomization were not converted", kudeYAMLFile)
+		} else {
+			logger.Printf("Wrote '%s'", kudeYAMLFile)
+		}
+		return nil
+	},
+}
+
+func init() {
+	convertKustomizeCmd.Flags().BoolP("force", "f", false, "overwrite an existing kude.yaml file")
+	convertKustomizeCmd.Flags().Bool("stdout", false, "print the pipeline to stdout instead of writing a kude.yaml file")
+
+	convertCmd.AddCommand(convertKustomizeCmd)
+	root.Cmd.AddCommand(convertCmd)
+}
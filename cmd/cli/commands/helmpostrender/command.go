@@ -0,0 +1,48 @@
+package helmpostrender
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/arikkfir/kude/cmd/cli/commands/build"
+	"github.com/arikkfir/kude/cmd/cli/commands/root"
+	"github.com/spf13/cobra"
+	"log"
+)
+
+//go:embed description.txt
+var longDescription string
+
+var helmPostRenderCmd = &cobra.Command{
+	Use:               "helm-post-render",
+	SilenceUsage:      true,
+	DisableAutoGenTag: true,
+	Short:             "Run the steps of a Kude pipeline over Helm's rendered manifests, as a Helm post-renderer",
+	Example:           `helm install my-release my-chart --post-renderer kude --post-renderer-args helm-post-render --post-renderer-args --pipeline=./kude`,
+	Long:              longDescription,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pwd, opts, err := build.ReadPackageFlags(cmd, "pipeline")
+		if err != nil {
+			return err
+		}
+		offline, err := cmd.Flags().GetBool("offline")
+		if err != nil {
+			return fmt.Errorf("failed reading offline flag: %w", err)
+		}
+		opts.Offline = offline
+		opts.CacheDir = cmd.Flags().Lookup("cache-dir").Value.String()
+		opts.KubernetesVersion = cmd.Flags().Lookup("kube-version").Value.String()
+		opts.Input = cmd.InOrStdin()
+
+		// Helm reads the post-rendered manifests from stdout, so logs must only ever go to stderr
+		return build.Build(pwd, opts, log.New(cmd.ErrOrStderr(), "", 0), cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	build.AddPackageFlags(helmPostRenderCmd, "pipeline", "")
+	helmPostRenderCmd.Flags().Bool("offline", false, "read function images only from the vendor directory (see 'kude vendor')")
+	helmPostRenderCmd.Flags().String("cache-dir", "", "directory to cache remote resources in (defaults to the user's cache directory)")
+	helmPostRenderCmd.Flags().String("kube-version", "", "target Kubernetes version: report deprecated & removed API versions")
+
+	root.Cmd.AddCommand(helmPostRenderCmd)
+}
@@ -0,0 +1,36 @@
+package lock
+
+import (
+	_ "embed"
+	"github.com/arikkfir/kude/cmd/cli/commands/build"
+	"github.com/arikkfir/kude/cmd/cli/commands/root"
+	"github.com/spf13/cobra"
+	"io"
+	"log"
+)
+
+//go:embed description.txt
+var longDescription string
+
+var lockCmd = &cobra.Command{
+	Use:               "lock",
+	SilenceUsage:      true,
+	DisableAutoGenTag: true,
+	Short:             "Lock remote resources and function images of the Kude package in the current directory",
+	Example:           `kude lock --param environment=staging`,
+	Long:              longDescription,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pwd, opts, err := build.ReadPackageFlags(cmd, "path")
+		if err != nil {
+			return err
+		}
+		opts.UpdateLock, opts.Refresh = true, true
+		return build.Build(pwd, opts, log.Default(), io.Discard)
+	},
+}
+
+func init() {
+	build.AddPackageFlags(lockCmd, "path", "p")
+
+	root.Cmd.AddCommand(lockCmd)
+}
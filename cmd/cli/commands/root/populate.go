@@ -10,6 +10,10 @@ import (
 	"strings"
 )
 
+// Config holds the Kude configuration (read from ~/.kude/kude.yaml and "KUDE_" environment variables), once the
+// command being executed has been initialized.
+var Config *viper.Viper
+
 func populateCommandFlags(cmd *cobra.Command, _ []string) error {
 	home, err := os.UserHomeDir()
 	if err != nil {
@@ -28,6 +32,7 @@ func populateCommandFlags(cmd *cobra.Command, _ []string) error {
 			return err
 		}
 	}
+	Config = v
 
 	// Set values of command flags which were provided only by config file or an environment variable
 	cmd.Flags().VisitAll(func(f *pflag.Flag) {
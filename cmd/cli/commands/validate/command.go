@@ -0,0 +1,78 @@
+package validate
+
+import (
+	_ "embed"
+	"fmt"
+	"github.com/arikkfir/kude/cmd/cli/commands/build"
+	"github.com/arikkfir/kude/cmd/cli/commands/root"
+	kude "github.com/arikkfir/kude/pkg"
+	"github.com/spf13/cobra"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+//go:embed description.txt
+var longDescription string
+
+var validateCmd = &cobra.Command{
+	Use:               "validate",
+	SilenceUsage:      true,
+	DisableAutoGenTag: true,
+	Short:             "Validate the resources of the Kude package in the current directory",
+	Example:           `kude validate --kube-version 1.21`,
+	Long:              longDescription,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pwd, opts, err := build.ReadPackageFlags(cmd, "path")
+		if err != nil {
+			return err
+		}
+		ignoreMissingSchemas, err := cmd.Flags().GetBool("ignore-missing-schemas")
+		if err != nil {
+			return fmt.Errorf("failed reading ignore-missing-schemas flag: %w", err)
+		}
+		schemas, err := cmd.Flags().GetStringArray("schemas")
+		if err != nil {
+			return fmt.Errorf("failed reading schemas flag: %w", err)
+		}
+		kubernetesVersion := cmd.Flags().Lookup("kube-version").Value.String()
+		if len(schemas) == 0 {
+			if err := kude.CheckValidationVersion(kubernetesVersion); err != nil {
+				return fmt.Errorf("invalid kube-version flag: %w", err)
+			}
+		}
+		opts.Validate = true
+		opts.KubernetesVersion = kubernetesVersion
+		opts.Schemas = schemas
+		opts.IgnoreMissingSchemas = ignoreMissingSchemas
+
+		// Rendered resources are validated as-is, without building the package
+		if input := cmd.Flags().Lookup("input").Value.String(); input != "" {
+			validator, err := build.NewValidator(opts)
+			if err != nil {
+				return err
+			}
+			if input == "-" {
+				return validator.ValidateReader(cmd.InOrStdin(), "<stdin>")
+			}
+			f, err := os.Open(input)
+			if err != nil {
+				return fmt.Errorf("failed opening input '%s': %w", input, err)
+			}
+			defer f.Close()
+			return validator.ValidateReader(f, input)
+		}
+		return build.Build(pwd, opts, log.Default(), io.Discard)
+	},
+}
+
+func init() {
+	build.AddPackageFlags(validateCmd, "path", "p")
+	validateCmd.Flags().String("kube-version", kude.DefaultKubernetesVersion, "target Kubernetes version: report deprecated & removed API versions, and validate against its schemas (supported: "+strings.Join(kude.SupportedKubernetesVersions(), ", ")+")")
+	validateCmd.Flags().StringArray("schemas", nil, "OpenAPI schema file, or directory of schema files, to validate against instead of the bundled schemas (can be repeated)")
+	validateCmd.Flags().StringP("input", "f", "", "file of rendered resources to validate instead of building the package (e.g. the output of 'kude build'), or '-' for standard input")
+	validateCmd.Flags().Bool("ignore-missing-schemas", false, "skip validation of resources whose schema is unknown, instead of failing")
+
+	root.Cmd.AddCommand(validateCmd)
+}
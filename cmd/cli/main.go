@@ -2,7 +2,12 @@ package main
 
 import (
 	_ "github.com/arikkfir/kude/cmd/cli/commands/build"
+	_ "github.com/arikkfir/kude/cmd/cli/commands/convert"
+	_ "github.com/arikkfir/kude/cmd/cli/commands/helmpostrender"
+	_ "github.com/arikkfir/kude/cmd/cli/commands/lock"
 	"github.com/arikkfir/kude/cmd/cli/commands/root"
+	_ "github.com/arikkfir/kude/cmd/cli/commands/validate"
+	_ "github.com/arikkfir/kude/cmd/cli/commands/vendor"
 	"log"
 	"os"
 )
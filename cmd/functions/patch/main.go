@@ -0,0 +1,10 @@
+package main
+
+import (
+	"github.com/arikkfir/kude/internal/functions"
+)
+
+func main() {
+	fi := functions.FunctionInvoker{Function: &functions.Patch{}}
+	fi.MustInvoke()
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/blang/semver"
+	"strings"
+)
+
+// DeprecatedAPI describes a Kubernetes API version of a resource kind that is deprecated (and possibly removed) in
+// later Kubernetes versions.
+type DeprecatedAPI struct {
+	APIVersion   string
+	Kind         string
+	DeprecatedIn string
+	RemovedIn    string
+
+	// ReplacedBy is the API version to use instead, if any.
+	ReplacedBy string
+
+	// Convertible indicates whether resources can be migrated to ReplacedBy automatically (see the "migrate-apis"
+	// function).
+	Convertible bool
+}
+
+// DeprecatedAPIs lists deprecated Kubernetes API versions, as documented in the Kubernetes deprecated API migration
+// guide (https://kubernetes.io/docs/reference/using-api/deprecation-guide/).
+var DeprecatedAPIs = []DeprecatedAPI{
+	{APIVersion: "extensions/v1beta1", Kind: "DaemonSet", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "apps/v1"},
+	{APIVersion: "extensions/v1beta1", Kind: "Deployment", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "apps/v1"},
+	{APIVersion: "extensions/v1beta1", Kind: "ReplicaSet", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "apps/v1"},
+	{APIVersion: "extensions/v1beta1", Kind: "NetworkPolicy", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "networking.k8s.io/v1", Convertible: true},
+	{APIVersion: "extensions/v1beta1", Kind: "PodSecurityPolicy", DeprecatedIn: "1.10", RemovedIn: "1.16", ReplacedBy: "policy/v1beta1", Convertible: true},
+	{APIVersion: "extensions/v1beta1", Kind: "Ingress", DeprecatedIn: "1.14", RemovedIn: "1.22", ReplacedBy: "networking.k8s.io/v1", Convertible: true},
+	{APIVersion: "apps/v1beta1", Kind: "Deployment", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "apps/v1"},
+	{APIVersion: "apps/v1beta1", Kind: "StatefulSet", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "apps/v1"},
+	{APIVersion: "apps/v1beta2", Kind: "DaemonSet", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "apps/v1"},
+	{APIVersion: "apps/v1beta2", Kind: "Deployment", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "apps/v1"},
+	{APIVersion: "apps/v1beta2", Kind: "ReplicaSet", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "apps/v1"},
+	{APIVersion: "apps/v1beta2", Kind: "StatefulSet", DeprecatedIn: "1.9", RemovedIn: "1.16", ReplacedBy: "apps/v1"},
+	{APIVersion: "admissionregistration.k8s.io/v1beta1", Kind: "MutatingWebhookConfiguration", DeprecatedIn: "1.16", RemovedIn: "1.22", ReplacedBy: "admissionregistration.k8s.io/v1"},
+	{APIVersion: "admissionregistration.k8s.io/v1beta1", Kind: "ValidatingWebhookConfiguration", DeprecatedIn: "1.16", RemovedIn: "1.22", ReplacedBy: "admissionregistration.k8s.io/v1"},
+	{APIVersion: "apiextensions.k8s.io/v1beta1", Kind: "CustomResourceDefinition", DeprecatedIn: "1.16", RemovedIn: "1.22", ReplacedBy: "apiextensions.k8s.io/v1"},
+	{APIVersion: "apiregistration.k8s.io/v1beta1", Kind: "APIService", DeprecatedIn: "1.19", RemovedIn: "1.22", ReplacedBy: "apiregistration.k8s.io/v1", Convertible: true},
+	{APIVersion: "certificates.k8s.io/v1beta1", Kind: "CertificateSigningRequest", DeprecatedIn: "1.19", RemovedIn: "1.22", ReplacedBy: "certificates.k8s.io/v1"},
+	{APIVersion: "coordination.k8s.io/v1beta1", Kind: "Lease", DeprecatedIn: "1.19", RemovedIn: "1.22", ReplacedBy: "coordination.k8s.io/v1", Convertible: true},
+	{APIVersion: "networking.k8s.io/v1beta1", Kind: "Ingress", DeprecatedIn: "1.19", RemovedIn: "1.22", ReplacedBy: "networking.k8s.io/v1", Convertible: true},
+	{APIVersion: "networking.k8s.io/v1beta1", Kind: "IngressClass", DeprecatedIn: "1.19", RemovedIn: "1.22", ReplacedBy: "networking.k8s.io/v1", Convertible: true},
+	{APIVersion: "rbac.authorization.k8s.io/v1beta1", Kind: "ClusterRole", DeprecatedIn: "1.17", RemovedIn: "1.22", ReplacedBy: "rbac.authorization.k8s.io/v1", Convertible: true},
+	{APIVersion: "rbac.authorization.k8s.io/v1beta1", Kind: "ClusterRoleBinding", DeprecatedIn: "1.17", RemovedIn: "1.22", ReplacedBy: "rbac.authorization.k8s.io/v1", Convertible: true},
+	{APIVersion: "rbac.authorization.k8s.io/v1beta1", Kind: "Role", DeprecatedIn: "1.17", RemovedIn: "1.22", ReplacedBy: "rbac.authorization.k8s.io/v1", Convertible: true},
+	{APIVersion: "rbac.authorization.k8s.io/v1beta1", Kind: "RoleBinding", DeprecatedIn: "1.17", RemovedIn: "1.22", ReplacedBy: "rbac.authorization.k8s.io/v1", Convertible: true},
+	{APIVersion: "scheduling.k8s.io/v1beta1", Kind: "PriorityClass", DeprecatedIn: "1.14", RemovedIn: "1.22", ReplacedBy: "scheduling.k8s.io/v1", Convertible: true},
+	{APIVersion: "storage.k8s.io/v1beta1", Kind: "CSIDriver", DeprecatedIn: "1.19", RemovedIn: "1.22", ReplacedBy: "storage.k8s.io/v1", Convertible: true},
+	{APIVersion: "storage.k8s.io/v1beta1", Kind: "CSINode", DeprecatedIn: "1.17", RemovedIn: "1.22", ReplacedBy: "storage.k8s.io/v1", Convertible: true},
+	{APIVersion: "storage.k8s.io/v1beta1", Kind: "StorageClass", DeprecatedIn: "1.19", RemovedIn: "1.22", ReplacedBy: "storage.k8s.io/v1", Convertible: true},
+	{APIVersion: "storage.k8s.io/v1beta1", Kind: "VolumeAttachment", DeprecatedIn: "1.19", RemovedIn: "1.22", ReplacedBy: "storage.k8s.io/v1", Convertible: true},
+	{APIVersion: "batch/v1beta1", Kind: "CronJob", DeprecatedIn: "1.21", RemovedIn: "1.25", ReplacedBy: "batch/v1", Convertible: true},
+	{APIVersion: "discovery.k8s.io/v1beta1", Kind: "EndpointSlice", DeprecatedIn: "1.21", RemovedIn: "1.25", ReplacedBy: "discovery.k8s.io/v1"},
+	{APIVersion: "events.k8s.io/v1beta1", Kind: "Event", DeprecatedIn: "1.19", RemovedIn: "1.25", ReplacedBy: "events.k8s.io/v1"},
+	{APIVersion: "autoscaling/v2beta1", Kind: "HorizontalPodAutoscaler", DeprecatedIn: "1.22", RemovedIn: "1.25", ReplacedBy: "autoscaling/v2"},
+	{APIVersion: "policy/v1beta1", Kind: "PodDisruptionBudget", DeprecatedIn: "1.21", RemovedIn: "1.25", ReplacedBy: "policy/v1", Convertible: true},
+	{APIVersion: "policy/v1beta1", Kind: "PodSecurityPolicy", DeprecatedIn: "1.21", RemovedIn: "1.25"},
+	{APIVersion: "node.k8s.io/v1beta1", Kind: "RuntimeClass", DeprecatedIn: "1.20", RemovedIn: "1.25", ReplacedBy: "node.k8s.io/v1", Convertible: true},
+	{APIVersion: "autoscaling/v2beta2", Kind: "HorizontalPodAutoscaler", DeprecatedIn: "1.23", RemovedIn: "1.26", ReplacedBy: "autoscaling/v2", Convertible: true},
+	{APIVersion: "flowcontrol.apiserver.k8s.io/v1beta1", Kind: "FlowSchema", DeprecatedIn: "1.23", RemovedIn: "1.26", ReplacedBy: "flowcontrol.apiserver.k8s.io/v1beta2", Convertible: true},
+	{APIVersion: "flowcontrol.apiserver.k8s.io/v1beta1", Kind: "PriorityLevelConfiguration", DeprecatedIn: "1.23", RemovedIn: "1.26", ReplacedBy: "flowcontrol.apiserver.k8s.io/v1beta2", Convertible: true},
+	{APIVersion: "storage.k8s.io/v1beta1", Kind: "CSIStorageCapacity", DeprecatedIn: "1.24", RemovedIn: "1.27", ReplacedBy: "storage.k8s.io/v1", Convertible: true},
+}
+
+// FindDeprecatedAPI returns the deprecation details of the given API version & kind, or nil if it's not deprecated.
+func FindDeprecatedAPI(apiVersion, kind string) *DeprecatedAPI {
+	for i := range DeprecatedAPIs {
+		if DeprecatedAPIs[i].APIVersion == apiVersion && DeprecatedAPIs[i].Kind == kind {
+			return &DeprecatedAPIs[i]
+		}
+	}
+	return nil
+}
+
+// ReplacementIn returns the API version to use instead of this one when targeting the given Kubernetes version (or
+// any version, if nil), and whether resources can be converted to it automatically. Replacements that are themselves
+// removed in the given version are followed to their own replacement; if that leads nowhere (e.g. PodSecurityPolicy,
+// which is removed in 1.25 without a replacement), an empty API version is returned.
+func (d *DeprecatedAPI) ReplacementIn(kubernetesVersion *semver.Version) (string, bool) {
+	replacedBy, convertible := d.ReplacedBy, d.Convertible
+	if kubernetesVersion == nil {
+		return replacedBy, convertible
+	}
+	for seen := map[string]bool{d.APIVersion: true}; replacedBy != "" && !seen[replacedBy]; {
+		seen[replacedBy] = true
+		next := FindDeprecatedAPI(replacedBy, d.Kind)
+		if next == nil || !next.IsRemovedIn(*kubernetesVersion) {
+			return replacedBy, convertible
+		}
+		replacedBy, convertible = next.ReplacedBy, convertible && next.Convertible
+	}
+	if replacedBy == "" {
+		return "", false
+	}
+	return replacedBy, convertible
+}
+
+// IsDeprecatedIn checks whether this API is deprecated as of the given Kubernetes version.
+func (d *DeprecatedAPI) IsDeprecatedIn(kubernetesVersion semver.Version) bool {
+	return !kubernetesVersion.LT(semver.MustParse(d.DeprecatedIn + ".0"))
+}
+
+// IsRemovedIn checks whether this API is removed as of the given Kubernetes version.
+func (d *DeprecatedAPI) IsRemovedIn(kubernetesVersion semver.Version) bool {
+	return d.RemovedIn != "" && !kubernetesVersion.LT(semver.MustParse(d.RemovedIn+".0"))
+}
+
+// ParseKubernetesVersion parses the given Kubernetes version (e.g. "1.22", "v1.22.3" or "1.22.3-gke.100"), ignoring
+// its patch version & any pre-release or build metadata.
+func ParseKubernetesVersion(version string) (semver.Version, error) {
+	v, err := semver.ParseTolerant(strings.TrimSpace(version))
+	if err != nil {
+		return semver.Version{}, fmt.Errorf("invalid Kubernetes version '%s': %w", version, err)
+	}
+	return semver.Version{Major: v.Major, Minor: v.Minor}, nil
+}
@@ -18,9 +18,9 @@ import (
 )
 
 type CreateConfigMapEntry struct {
-	Key   string `mapstructure:"key"`
-	Value string `mapstructure:"value"`
-	Path  string `mapstructure:"path"`
+	Key   string  `mapstructure:"key"`
+	Value *string `mapstructure:"value"`
+	Path  string  `mapstructure:"path"`
 }
 
 type CreateConfigMap struct {
@@ -41,15 +41,15 @@ func (f *CreateConfigMap) Invoke(_ *log.Logger, pwd, _, _ string, r io.Reader, w
 		if content.Key == "" {
 			return fmt.Errorf("key is required for all entries (missing for entry %d)", i)
 		}
-		if content.Value == "" && content.Path == "" {
+		if content.Value == nil && content.Path == "" {
 			return fmt.Errorf("value or path is required for all entries (missing for entry %d)", i)
 		}
-		if content.Value != "" && content.Path != "" {
+		if content.Value != nil && content.Path != "" {
 			return fmt.Errorf("value and path cannot be used together in a single entry (encountered for entry %d)", i)
 		}
 		var value string
-		if content.Value != "" {
-			value = content.Value
+		if content.Value != nil {
+			value = *content.Value
 		} else {
 			path := content.Path
 			if !filepath.IsAbs(content.Path) {
@@ -19,9 +19,9 @@ import (
 )
 
 type CreateSecretEntry struct {
-	Key   string `mapstructure:"key"`
-	Value string `mapstructure:"value"`
-	Path  string `mapstructure:"path"`
+	Key   string  `mapstructure:"key"`
+	Value *string `mapstructure:"value"`
+	Path  string  `mapstructure:"path"`
 }
 
 type CreateSecret struct {
@@ -43,15 +43,15 @@ func (f *CreateSecret) Invoke(_ *log.Logger, pwd, _, _ string, r io.Reader, w io
 		if content.Key == "" {
 			return fmt.Errorf("key is required for all entries (missing for entry %d)", i)
 		}
-		if content.Value == "" && content.Path == "" {
+		if content.Value == nil && content.Path == "" {
 			return fmt.Errorf("value or path is required for all entries (missing for entry %d)", i)
 		}
-		if content.Value != "" && content.Path != "" {
+		if content.Value != nil && content.Path != "" {
 			return fmt.Errorf("value and path cannot be used together in a single entry (encountered for entry %d)", i)
 		}
 		var value string
-		if content.Value != "" {
-			value = content.Value
+		if content.Value != nil {
+			value = *content.Value
 		} else {
 			path := content.Path
 			if !filepath.IsAbs(content.Path) {
@@ -4,11 +4,14 @@ import (
 	"archive/tar"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/arikkfir/gstream/pkg"
 	. "github.com/arikkfir/gstream/pkg/generate"
 	. "github.com/arikkfir/gstream/pkg/sink"
+	"github.com/arikkfir/kude/internal"
 	"io"
 	"log"
 	"net/http"
@@ -18,11 +21,31 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"time"
 )
 
+const (
+	// defaultHelmDownloadURL is the default base URL from which Helm archives (and their checksums) are downloaded.
+	defaultHelmDownloadURL = "https://get.helm.sh"
+
+	// helmLockTimeout is the maximum amount of time to wait for another process to finish installing the same Helm
+	// version into the cache directory.
+	helmLockTimeout = 5 * time.Minute
+
+	// helmStaleLockAge is the age after which a lock file is considered abandoned (e.g. by a crashed process); lock
+	// files are refreshed while held, so slow downloads do not reach it.
+	helmStaleLockAge = 10 * time.Minute
+)
+
+// helmInstallMutex guards the installation of Helm binaries within this process; other processes (e.g. function
+// containers sharing the same cache directory) are excluded using lock files.
+var helmInstallMutex sync.Mutex
+
 type Helm struct {
-	Version string   `mapstructure:"helm-version"`
-	Args    []string `mapstructure:"args"`
+	Version     string   `mapstructure:"helm-version"`
+	Checksum    string   `mapstructure:"helm-checksum"`
+	DownloadURL string   `mapstructure:"helm-download-url"`
+	Args        []string `mapstructure:"args"`
 }
 
 func (f *Helm) Invoke(logger *log.Logger, pwd, cacheDir, tempDir string, r io.Reader, w io.Writer) error {
@@ -32,28 +55,13 @@ func (f *Helm) Invoke(logger *log.Logger, pwd, cacheDir, tempDir string, r io.Re
 	} else if strings.HasPrefix(f.Version, "v") {
 		f.Version = f.Version[1:]
 	}
+	if f.DownloadURL == "" {
+		f.DownloadURL = defaultHelmDownloadURL
+	}
 
 	helmFile := filepath.Join(cacheDir, "helm-v"+f.Version+"-"+arch)
-	if _, err := os.Stat(helmFile); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			helmArchiveFile := filepath.Join(tempDir, "helm-v"+f.Version+"-"+arch+".tar.gz")
-			if _, err := os.Stat(helmArchiveFile); err != nil {
-				if errors.Is(err, os.ErrNotExist) {
-					err := f.downloadHelmArchive(logger, helmArchiveFile)
-					if err != nil {
-						return fmt.Errorf("failed to download archive: %w", err)
-					}
-				} else {
-					return fmt.Errorf("failed to stat file at '%s': %w", helmArchiveFile, err)
-				}
-			}
-
-			if err := f.extractHelm(logger, arch, helmArchiveFile, helmFile); err != nil {
-				return fmt.Errorf("failed to extract archive at '%s': %w", helmArchiveFile, err)
-			}
-		} else {
-			return fmt.Errorf("failed to stat file at '%s': %w", helmFile, err)
-		}
+	if err := f.installHelm(logger, arch, tempDir, helmFile); err != nil {
+		return fmt.Errorf("failed to install Helm v%s: %w", f.Version, err)
 	}
 
 	pr, pw, err := os.Pipe()
@@ -99,29 +107,109 @@ func (f *Helm) Invoke(logger *log.Logger, pwd, cacheDir, tempDir string, r io.Re
 	}
 }
 
+// installHelm downloads & extracts the Helm binary into the given path, unless it already exists there. The binary is
+// extracted into a temporary file which is then renamed into place, so a partially extracted binary is never used, and
+// concurrent steps (in this process or in other processes sharing the cache directory) installing the same version
+// wait for each other rather than extracting it twice.
+func (f *Helm) installHelm(logger *log.Logger, arch, tempDir, helmFile string) error {
+	helmInstallMutex.Lock()
+	defer helmInstallMutex.Unlock()
+
+	unlock, err := internal.AcquireLockFile(logger, helmFile+".lock", helmLockTimeout, helmStaleLockAge)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(helmFile); err == nil {
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to stat file at '%s': %w", helmFile, err)
+	}
+
+	helmArchiveFile := filepath.Join(tempDir, "helm-v"+f.Version+"-"+arch+".tar.gz")
+	if err := f.downloadHelmArchive(logger, helmArchiveFile); err != nil {
+		return fmt.Errorf("failed to download archive: %w", err)
+	}
+	if err := f.extractHelm(logger, arch, helmArchiveFile, helmFile); err != nil {
+		return fmt.Errorf("failed to extract archive at '%s': %w", helmArchiveFile, err)
+	}
+	return nil
+}
+
+// downloadHelmArchive downloads the Helm archive into the given path, and verifies its SHA-256 checksum against the
+// configured checksum, or (if none is configured) the checksum published alongside the archive. The archive is written
+// to a temporary file, and renamed into place only once verified.
 func (f *Helm) downloadHelmArchive(logger *log.Logger, localHelmArchive string) error {
-	url := fmt.Sprintf("https://get.helm.sh/%s", filepath.Base(localHelmArchive))
+	url := fmt.Sprintf("%s/%s", strings.TrimSuffix(f.DownloadURL, "/"), filepath.Base(localHelmArchive))
+
+	expectedChecksum := strings.ToLower(strings.TrimSpace(f.Checksum))
+	if expectedChecksum == "" {
+		logger.Printf("Downloading checksum from: %s.sha256sum", url)
+		checksum, err := downloadHelmChecksum(url + ".sha256sum")
+		if err != nil {
+			return fmt.Errorf("failed downloading checksum: %w", err)
+		}
+		expectedChecksum = checksum
+	}
 
 	logger.Printf("Downloading archive from: %s", url)
 	resp, err := http.Get(url)
 	if err != nil {
-		return fmt.Errorf("failed downloading from: %w", err)
+		return fmt.Errorf("failed downloading from '%s': %w", url, err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed downloading from '%s': %s", url, resp.Status)
+	}
 
-	out, err := os.Create(localHelmArchive)
+	out, err := os.CreateTemp(filepath.Dir(localHelmArchive), filepath.Base(localHelmArchive)+".tmp-")
 	if err != nil {
-		return fmt.Errorf("failed to create helm file at '%s': %w", localHelmArchive, err)
+		return fmt.Errorf("failed to create temporary file for '%s': %w", localHelmArchive, err)
 	}
+	defer os.Remove(out.Name())
 	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to write helm file to '%s': %w", localHelmArchive, err)
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(out, hash), resp.Body); err != nil {
+		return fmt.Errorf("failed to write helm file to '%s': %w", out.Name(), err)
+	} else if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close helm file '%s': %w", out.Name(), err)
+	}
+
+	if actualChecksum := hex.EncodeToString(hash.Sum(nil)); actualChecksum != expectedChecksum {
+		return fmt.Errorf("checksum mismatch for '%s': expected '%s', got '%s'", url, expectedChecksum, actualChecksum)
+	} else if err := os.Rename(out.Name(), localHelmArchive); err != nil {
+		return fmt.Errorf("failed to move helm file to '%s': %w", localHelmArchive, err)
 	}
 	return nil
 }
 
+// downloadHelmChecksum downloads a Helm ".sha256sum" file, and returns the checksum in it. These files contain the
+// checksum, optionally followed by the archive's file name (as "sha256sum" prints it).
+func downloadHelmChecksum(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("failed downloading from '%s': %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed downloading from '%s': %s", url, resp.Status)
+	}
+
+	bytes, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", fmt.Errorf("failed reading from '%s': %w", url, err)
+	}
+	fields := strings.Fields(string(bytes))
+	if len(fields) == 0 || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid checksum file at '%s'", url)
+	} else if _, err := hex.DecodeString(fields[0]); err != nil {
+		return "", fmt.Errorf("invalid checksum file at '%s': %w", url, err)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
 func (f *Helm) extractHelm(logger *log.Logger, arch, helmArchiveFile, helmFile string) error {
 	logger.Printf("Extracting Helm archive: %s", helmArchiveFile)
 
@@ -142,27 +230,30 @@ func (f *Helm) extractHelm(logger *log.Logger, arch, helmArchiveFile, helmFile s
 		hdr, err := tr.Next()
 		if err != nil {
 			if err == io.EOF {
-				break
+				return fmt.Errorf("could not find '%s' in archive", arch+"/helm")
 			} else {
 				return fmt.Errorf("failed to read next entry: %w", err)
 			}
 		}
 
 		if hdr.Name == arch+"/helm" {
-			w, err := os.Create(helmFile)
+			w, err := os.CreateTemp(filepath.Dir(helmFile), filepath.Base(helmFile)+".tmp-")
 			if err != nil {
-				return fmt.Errorf("failed to create '%s': %w", helmFile, err)
-			} else if err := os.Chmod(helmFile, 0755); err != nil {
-				return fmt.Errorf("failed to chmod '%s': %w", helmFile, err)
+				return fmt.Errorf("failed to create temporary file for '%s': %w", helmFile, err)
 			}
+			defer os.Remove(w.Name())
+			defer w.Close()
 
-			_, err = io.Copy(w, tr)
-			if err != nil {
-				return fmt.Errorf("failed to write to '%s': %w", helmFile, err)
+			if _, err := io.Copy(w, tr); err != nil {
+				return fmt.Errorf("failed to write to '%s': %w", w.Name(), err)
+			} else if err := w.Close(); err != nil {
+				return fmt.Errorf("failed to close '%s': %w", w.Name(), err)
+			} else if err := os.Chmod(w.Name(), 0755); err != nil {
+				return fmt.Errorf("failed to chmod '%s': %w", w.Name(), err)
+			} else if err := os.Rename(w.Name(), helmFile); err != nil {
+				return fmt.Errorf("failed to move '%s' to '%s': %w", w.Name(), helmFile, err)
 			}
-			w.Close()
-			break
+			return nil
 		}
 	}
-	return nil
 }
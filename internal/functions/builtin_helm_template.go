@@ -0,0 +1,229 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/arikkfir/gstream/pkg"
+	. "github.com/arikkfir/gstream/pkg/generate"
+	. "github.com/arikkfir/gstream/pkg/sink"
+	"helm.sh/helm/v3/pkg/action"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/cli"
+	"helm.sh/helm/v3/pkg/cli/values"
+	"helm.sh/helm/v3/pkg/getter"
+	"helm.sh/helm/v3/pkg/registry"
+	"helm.sh/helm/v3/pkg/release"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HelmTemplate renders a Helm chart in-process using the Helm SDK (equivalent to "helm template"), and appends the
+// rendered resources to the stream. Charts can be local directories or archives, charts in a chart repository, or
+// OCI references. Remote charts with a pinned version are cached in the cache directory, and are not downloaded again
+// once cached; in offline mode, only cached charts can be used.
+type HelmTemplate struct {
+	Chart       string   `mapstructure:"chart"`
+	Repo        string   `mapstructure:"repo"`
+	Version     string   `mapstructure:"version"`
+	Offline     bool     `mapstructure:"offline"`
+	ReleaseName string   `mapstructure:"releaseName"`
+	Namespace   string   `mapstructure:"namespace"`
+	Values      string   `mapstructure:"values"`
+	ValuesFiles []string `mapstructure:"valuesFiles"`
+	KubeVersion string   `mapstructure:"kubeVersion"`
+	APIVersions []string `mapstructure:"apiVersions"`
+	IncludeCRDs bool     `mapstructure:"includeCRDs"`
+	SkipHooks   bool     `mapstructure:"skipHooks"`
+	SkipTests   bool     `mapstructure:"skipTests"`
+}
+
+func (f *HelmTemplate) Invoke(logger *log.Logger, pwd, cacheDir, _ string, r io.Reader, w io.Writer) error {
+	if f.Chart == "" {
+		return fmt.Errorf("the '%s' property is required for this function", "chart")
+	}
+	if f.ReleaseName == "" {
+		f.ReleaseName = "release-name"
+	}
+	if f.Namespace == "" {
+		f.Namespace = "default"
+	}
+
+	settings := cli.New()
+	settings.RepositoryConfig = filepath.Join(cacheDir, "helm", "repositories.yaml")
+	settings.RepositoryCache = filepath.Join(cacheDir, "helm", "repository")
+	settings.RegistryConfig = filepath.Join(cacheDir, "helm", "registry.json")
+	if home, err := os.UserHomeDir(); err == nil {
+		if _, err := os.Stat(filepath.Join(home, ".docker", "config.json")); err == nil {
+			settings.RegistryConfig = filepath.Join(home, ".docker", "config.json")
+		}
+	}
+
+	chartPath, err := f.locateChart(logger, pwd, cacheDir, settings)
+	if err != nil {
+		return fmt.Errorf("failed locating chart '%s': %w", f.Chart, err)
+	}
+	c, err := loader.Load(chartPath)
+	if err != nil {
+		return fmt.Errorf("failed loading chart from '%s': %w", chartPath, err)
+	}
+
+	vals, err := f.mergeValues(pwd, settings)
+	if err != nil {
+		return fmt.Errorf("failed merging values: %w", err)
+	}
+
+	manifests, err := f.render(c, vals)
+	if err != nil {
+		return fmt.Errorf("failed rendering chart '%s': %w", f.Chart, err)
+	}
+
+	s := stream.NewStream().
+		Generate(FromReader(r)).
+		Generate(FromReader(bytes.NewReader(manifests))).
+		Sink(ToWriter(w))
+	if err := s.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
+	}
+	return nil
+}
+
+// locateChart returns the local path of the chart. Local charts are resolved relative to the pipeline directory;
+// remote charts (from a chart repository or an OCI registry) are downloaded into the cache directory, unless they are
+// already cached.
+func (f *HelmTemplate) locateChart(logger *log.Logger, pwd, cacheDir string, settings *cli.EnvSettings) (string, error) {
+	if f.Repo == "" && !registry.IsOCI(f.Chart) {
+		path := resolvePath(pwd, f.Chart)
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("failed to stat chart at '%s' (use the '%s' property for charts in chart repositories, or an 'oci://' reference for charts in OCI registries): %w", path, "repo", err)
+		}
+		return path, nil
+	}
+
+	// Only charts with a pinned version are cached, since otherwise the cached chart might not be the latest one
+	var chartCacheDir string
+	if f.Version != "" {
+		hash := sha256.Sum256([]byte(f.Repo + "\n" + f.Chart + "\n" + f.Version))
+		chartCacheDir = filepath.Join(cacheDir, "helm", "charts", hex.EncodeToString(hash[:])[:16])
+		if archives, err := filepath.Glob(filepath.Join(chartCacheDir, "*.tgz")); err != nil {
+			return "", fmt.Errorf("failed listing cached charts in '%s': %w", chartCacheDir, err)
+		} else if len(archives) > 0 {
+			logger.Printf("Using cached chart: %s", archives[0])
+			return archives[0], nil
+		}
+	}
+	if f.Offline {
+		return "", fmt.Errorf("chart is not cached, and cannot be downloaded in offline mode (remote charts are only cached if the '%s' property is set)", "version")
+	}
+
+	registryClient, err := registry.NewClient(registry.ClientOptWriter(io.Discard), registry.ClientOptCredentialsFile(settings.RegistryConfig))
+	if err != nil {
+		return "", fmt.Errorf("failed creating registry client: %w", err)
+	}
+	install := action.NewInstall(&action.Configuration{RegistryClient: registryClient})
+	install.ChartPathOptions.RepoURL = f.Repo
+	install.ChartPathOptions.Version = f.Version
+
+	if chartCacheDir == "" {
+		logger.Printf("Downloading chart '%s'", f.Chart)
+		return install.ChartPathOptions.LocateChart(f.Chart, settings)
+	}
+
+	// Download into a temporary directory next to the cache directory, and move it into place only once complete, so
+	// an interrupted download never leaves a partial chart in the cache
+	if err := os.MkdirAll(filepath.Dir(chartCacheDir), 0755); err != nil {
+		return "", fmt.Errorf("failed creating directory '%s': %w", filepath.Dir(chartCacheDir), err)
+	}
+	downloadDir, err := os.MkdirTemp(filepath.Dir(chartCacheDir), ".download-*")
+	if err != nil {
+		return "", fmt.Errorf("failed creating temporary directory: %w", err)
+	}
+	defer os.RemoveAll(downloadDir)
+
+	logger.Printf("Downloading chart '%s' (version %s)", f.Chart, f.Version)
+	downloadSettings := *settings
+	downloadSettings.RepositoryCache = downloadDir
+	archive, err := install.ChartPathOptions.LocateChart(f.Chart, &downloadSettings)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(downloadDir, chartCacheDir); err != nil {
+		return "", fmt.Errorf("failed moving chart into cache directory '%s': %w", chartCacheDir, err)
+	}
+	return filepath.Join(chartCacheDir, filepath.Base(archive)), nil
+}
+
+// mergeValues merges the values files (in order) and the inline values, which take precedence over values files.
+func (f *HelmTemplate) mergeValues(pwd string, settings *cli.EnvSettings) (map[string]interface{}, error) {
+	options := values.Options{}
+	for _, file := range f.ValuesFiles {
+		options.ValueFiles = append(options.ValueFiles, resolvePath(pwd, file))
+	}
+	vals, err := options.MergeValues(getter.All(settings))
+	if err != nil {
+		return nil, err
+	}
+	if f.Values == "" {
+		return vals, nil
+	}
+
+	// Inline values are given as a YAML string rather than a mapping, since configuration keys are case-insensitive
+	inline, err := chartutil.ReadValues([]byte(f.Values))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading inline values: %w", err)
+	}
+	return chartutil.CoalesceTables(inline, vals), nil
+}
+
+// render renders the chart like "helm template" does, returning the manifests followed by the hooks (unless skipped).
+func (f *HelmTemplate) render(c *chart.Chart, vals map[string]interface{}) ([]byte, error) {
+	install := action.NewInstall(&action.Configuration{})
+	install.DryRun = true
+	install.ClientOnly = true
+	install.Replace = true
+	install.ReleaseName = f.ReleaseName
+	install.Namespace = f.Namespace
+	install.IncludeCRDs = f.IncludeCRDs
+	install.DisableHooks = f.SkipHooks
+	install.APIVersions = f.APIVersions
+	if f.KubeVersion != "" {
+		kubeVersion, err := chartutil.ParseKubeVersion(f.KubeVersion)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Kubernetes version '%s': %w", f.KubeVersion, err)
+		}
+		install.KubeVersion = kubeVersion
+	}
+
+	rel, err := install.Run(c, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests bytes.Buffer
+	fmt.Fprintln(&manifests, strings.TrimSpace(rel.Manifest))
+	if !f.SkipHooks {
+		for _, hook := range rel.Hooks {
+			if f.SkipTests && isTestHook(hook) {
+				continue
+			}
+			fmt.Fprintf(&manifests, "---\n# Source: %s\n%s\n", hook.Path, hook.Manifest)
+		}
+	}
+	return manifests.Bytes(), nil
+}
+
+func isTestHook(hook *release.Hook) bool {
+	for _, event := range hook.Events {
+		if event == release.HookTest {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/arikkfir/gstream/pkg"
+	. "github.com/arikkfir/gstream/pkg/generate"
+	"github.com/arikkfir/kude/internal"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"strings"
+)
+
+// kustomizeInputFile is the path (relative to the pipeline directory) under which the stream's resources are provided
+// to the kustomization. It lives in the ".kude" directory, which is never copied from the pipeline directory itself.
+const kustomizeInputFile = ".kude/kustomize/input.yaml"
+
+// Kustomize runs an inline kustomization over the stream, in-process using kustomize's "krusty" API. The stream's
+// resources are added as the first resource of the kustomization, and the stream is replaced by the kustomization's
+// output. Files referenced by the kustomization (e.g. patches or generator sources) are resolved relative to the
+// pipeline directory, which is copied into an in-memory file system so that the build never modifies it.
+type Kustomize struct {
+	Kustomization string `mapstructure:"kustomization"`
+}
+
+func (f *Kustomize) Invoke(logger *log.Logger, pwd, _, _ string, r io.Reader, w io.Writer) error {
+	if strings.TrimSpace(f.Kustomization) == "" {
+		return fmt.Errorf("the '%s' property is required for this function", "kustomization")
+	}
+
+	// Kustomizations are given as a YAML string rather than a mapping, since configuration keys are case-insensitive
+	kustomization := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(f.Kustomization), kustomization); err != nil {
+		return fmt.Errorf("failed parsing kustomization: %w", err)
+	} else if kustomization.Kind != yaml.DocumentNode || kustomization.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("invalid kustomization: expected an object")
+	}
+	kustomization = kustomization.Content[0]
+
+	input, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed reading input: %w", err)
+	}
+
+	fSys, err := copyToMemory(pwd)
+	if err != nil {
+		return fmt.Errorf("failed copying '%s' into memory: %w", pwd, err)
+	}
+	if len(bytes.TrimSpace(input)) > 0 {
+		resources := internal.MappingField(kustomization, "resources")
+		if resources == nil {
+			resources = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			kustomization.Content = append(kustomization.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: "resources"}, resources)
+		} else if resources.Kind != yaml.SequenceNode {
+			return fmt.Errorf("invalid kustomization: expected '%s' to be a list", "resources")
+		}
+		inputResource := &yaml.Node{Kind: yaml.ScalarNode, Value: kustomizeInputFile}
+		resources.Content = append([]*yaml.Node{inputResource}, resources.Content...)
+		if err := fSys.WriteFile(filepath.Join(pwd, kustomizeInputFile), input); err != nil {
+			return fmt.Errorf("failed writing input resources: %w", err)
+		}
+	}
+
+	// Kustomizations in the pipeline directory itself (if any) are replaced by the inline kustomization
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if err := fSys.RemoveAll(filepath.Join(pwd, name)); err != nil {
+			return fmt.Errorf("failed removing '%s' from memory: %w", name, err)
+		}
+	}
+	kustomizationBytes, err := yaml.Marshal(kustomization)
+	if err != nil {
+		return fmt.Errorf("failed encoding kustomization: %w", err)
+	} else if err := fSys.WriteFile(filepath.Join(pwd, konfig.DefaultKustomizationFileName()), kustomizationBytes); err != nil {
+		return fmt.Errorf("failed writing kustomization: %w", err)
+	}
+
+	logger.Printf("Building kustomization")
+	resMap, err := krusty.MakeKustomizer(krusty.MakeDefaultOptions()).Run(fSys, pwd)
+	if err != nil {
+		return fmt.Errorf("failed building kustomization: %w", err)
+	}
+	output, err := resMap.AsYaml()
+	if err != nil {
+		return fmt.Errorf("failed serializing kustomization output: %w", err)
+	}
+
+	s := stream.NewStream().
+		Generate(FromReader(bytes.NewReader(output))).
+		Sink(&optionalWriterSink{w: w})
+	if err := s.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
+	}
+	return nil
+}
+
+// copyToMemory copies the files of the given directory into an in-memory file system, under the same path. The ".kude"
+// directory (which holds Kude's own temporary & cache files) is not copied.
+func copyToMemory(dir string) (filesys.FileSystem, error) {
+	fSys := filesys.MakeFsInMemory()
+	if err := fSys.MkdirAll(dir); err != nil {
+		return nil, fmt.Errorf("failed creating '%s': %w", dir, err)
+	}
+	err := filepath.WalkDir(dir, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if e.IsDir() {
+			if path != dir && e.Name() == ".kude" {
+				return fs.SkipDir
+			} else if err := fSys.MkdirAll(path); err != nil {
+				return fmt.Errorf("failed creating '%s': %w", path, err)
+			}
+			return nil
+		} else if e.Type() == fs.ModeSymlink {
+			// symlinked files are copied by their content, but symlinked directories are not traversed
+			if stat, err := os.Stat(path); err != nil || stat.IsDir() {
+				return nil
+			}
+		} else if !e.Type().IsRegular() {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed reading '%s': %w", path, err)
+		} else if err := fSys.WriteFile(path, content); err != nil {
+			return fmt.Errorf("failed writing '%s': %w", path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fSys, nil
+}
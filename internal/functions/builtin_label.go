@@ -8,23 +8,60 @@ import (
 	. "github.com/arikkfir/gstream/pkg/processing"
 	. "github.com/arikkfir/gstream/pkg/sink"
 	. "github.com/arikkfir/gstream/pkg/types"
+	"github.com/arikkfir/kude/internal"
 	"github.com/arikkfir/kyaml/pkg"
 	"github.com/arikkfir/kyaml/pkg/kstream"
+	"gopkg.in/yaml.v3"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 )
 
+// labelTemplatePaths maps kinds to the paths of the pod (or job) templates whose labels are updated when the
+// "includeTemplates" or "includeSelectors" options are enabled.
+var labelTemplatePaths = map[string][][]string{
+	"Deployment":            {{"spec", "template", "metadata", "labels"}},
+	"StatefulSet":           {{"spec", "template", "metadata", "labels"}},
+	"DaemonSet":             {{"spec", "template", "metadata", "labels"}},
+	"ReplicaSet":            {{"spec", "template", "metadata", "labels"}},
+	"ReplicationController": {{"spec", "template", "metadata", "labels"}},
+	"Job":                   {{"spec", "template", "metadata", "labels"}},
+	"CronJob": {
+		{"spec", "jobTemplate", "metadata", "labels"},
+		{"spec", "jobTemplate", "spec", "template", "metadata", "labels"},
+	},
+}
+
+// labelSelectorPaths maps kinds to the paths of the label selectors that are updated when the "includeSelectors"
+// option is enabled. Selectors marked as required are created if missing; others are only updated if they exist, since
+// adding them would change the set of selected pods (e.g. a Service without a selector, or a NetworkPolicy selecting
+// all pods).
+var labelSelectorPaths = map[string][]struct {
+	path     []string
+	required bool
+}{
+	"Deployment":            {{[]string{"spec", "selector", "matchLabels"}, true}},
+	"StatefulSet":           {{[]string{"spec", "selector", "matchLabels"}, true}},
+	"DaemonSet":             {{[]string{"spec", "selector", "matchLabels"}, true}},
+	"ReplicaSet":            {{[]string{"spec", "selector", "matchLabels"}, true}},
+	"ReplicationController": {{[]string{"spec", "selector"}, false}},
+	"Service":               {{[]string{"spec", "selector"}, false}},
+	"PodDisruptionBudget":   {{[]string{"spec", "selector", "matchLabels"}, false}},
+	"NetworkPolicy":         {{[]string{"spec", "podSelector", "matchLabels"}, false}},
+}
+
 type Label struct {
-	Name     string                  `mapstructure:"name"`
-	Value    string                  `mapstructure:"value"`
-	Path     string                  `mapstructure:"path"`
-	Includes []kyaml.TargetingFilter `mapstructure:"includes"`
-	Excludes []kyaml.TargetingFilter `mapstructure:"excludes"`
+	Name             string                  `mapstructure:"name"`
+	Value            string                  `mapstructure:"value"`
+	Path             string                  `mapstructure:"path"`
+	IncludeTemplates bool                    `mapstructure:"includeTemplates"`
+	IncludeSelectors bool                    `mapstructure:"includeSelectors"`
+	Includes         []kyaml.TargetingFilter `mapstructure:"includes"`
+	Excludes         []kyaml.TargetingFilter `mapstructure:"excludes"`
 }
 
-func (f *Label) Invoke(_ *log.Logger, pwd, _, _ string, r io.Reader, w io.Writer) error {
+func (f *Label) Invoke(logger *log.Logger, pwd, _, _ string, r io.Reader, w io.Writer) error {
 	if f.Name == "" {
 		return fmt.Errorf("the '%s' property is required for this function", "name")
 	}
@@ -50,6 +87,7 @@ func (f *Label) Invoke(_ *log.Logger, pwd, _, _ string, r io.Reader, w io.Writer
 			Tee(
 				kstream.FilterResource(f.Includes, f.Excludes),
 				NodeTransformerOf(kstream.LabelResource(f.Name, value)),
+				NodeTransformerOf(f.labelTemplatesAndSelectors(logger, value)),
 			),
 		).
 		Sink(ToWriter(w))
@@ -58,3 +96,60 @@ func (f *Label) Invoke(_ *log.Logger, pwd, _, _ string, r io.Reader, w io.Writer
 	}
 	return nil
 }
+
+// labelTemplatesAndSelectors adds the label to the pod templates of workloads if the "includeTemplates" option is
+// enabled, and to both pod templates & label selectors if the "includeSelectors" option is enabled (selectors must
+// keep matching the pod templates).
+func (f *Label) labelTemplatesAndSelectors(logger *log.Logger, value string) NodeProcessor {
+	return func(_ context.Context, node *yaml.Node) error {
+		if !f.IncludeTemplates && !f.IncludeSelectors {
+			return nil
+		}
+		kind := mappingScalar(node, "kind")
+		for _, path := range labelTemplatePaths[kind] {
+			if labels := mappingAt(node, path, true); labels != nil {
+				setMappingScalar(labels, f.Name, value)
+			}
+		}
+		if !f.IncludeSelectors {
+			return nil
+		}
+		for _, selector := range labelSelectorPaths[kind] {
+			if labels := mappingAt(node, selector.path, selector.required); labels != nil {
+				if existing := internal.MappingField(labels, f.Name); existing == nil || existing.Value != value {
+					if selector.required {
+						logger.Printf("Warning: changing the selector of %s; selectors of existing %ss are immutable, and must be deleted & recreated", describeResource(node), kind)
+					}
+					setMappingScalar(labels, f.Name, value)
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// mappingAt returns the mapping at the given path, optionally creating missing mappings along the way. Returns nil if
+// the path does not exist (and create is false), or if it does not lead to a mapping.
+func mappingAt(node *yaml.Node, path []string, create bool) *yaml.Node {
+	for _, key := range path {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return nil
+		}
+		child := internal.MappingField(node, key)
+		if child == nil || (child.Kind == yaml.ScalarNode && child.Tag == "!!null") {
+			if !create {
+				return nil
+			}
+			if child == nil {
+				child = &yaml.Node{}
+				node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child)
+			}
+			*child = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		node = child
+	}
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	return node
+}
@@ -0,0 +1,159 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/gstream/pkg"
+	. "github.com/arikkfir/gstream/pkg/generate"
+	. "github.com/arikkfir/gstream/pkg/sink"
+	. "github.com/arikkfir/gstream/pkg/types"
+	"github.com/arikkfir/kude/internal"
+	"github.com/blang/semver"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"strconv"
+)
+
+type MigrateAPIs struct {
+	KubernetesVersion string `mapstructure:"kubernetesVersion"`
+}
+
+func (f *MigrateAPIs) Invoke(logger *log.Logger, _, _, _ string, r io.Reader, w io.Writer) error {
+	var kubernetesVersion *semver.Version
+	if f.KubernetesVersion != "" {
+		if v, err := internal.ParseKubernetesVersion(f.KubernetesVersion); err != nil {
+			return err
+		} else {
+			kubernetesVersion = &v
+		}
+	}
+
+	s := stream.NewStream().
+		Generate(FromReader(r)).
+		Process(migrateAPIVersion(logger, kubernetesVersion)).
+		Sink(ToWriter(w))
+	if err := s.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
+	}
+	return nil
+}
+
+// migrateAPIVersion rewrites resources using convertible deprecated API versions to their replacement API version. If
+// a Kubernetes version is given, only API versions deprecated as of that version are migrated, and only to replacements
+// that still exist in that version.
+func migrateAPIVersion(logger *log.Logger, kubernetesVersion *semver.Version) NodeProcessor {
+	return func(_ context.Context, node *yaml.Node) error {
+		apiVersion, kind := mappingScalar(node, "apiVersion"), mappingScalar(node, "kind")
+		api := internal.FindDeprecatedAPI(apiVersion, kind)
+		if api == nil || (kubernetesVersion != nil && !api.IsDeprecatedIn(*kubernetesVersion)) {
+			return nil
+		}
+		replacedBy, convertible := api.ReplacementIn(kubernetesVersion)
+		if !convertible {
+			return nil
+		}
+
+		if kind == "Ingress" {
+			if err := migrateIngress(node); err != nil {
+				return fmt.Errorf("failed migrating %s '%s': %w", kind, mappingScalar(internal.MappingField(node, "metadata"), "name"), err)
+			}
+		}
+		setMappingScalar(node, "apiVersion", replacedBy)
+		logger.Printf("Migrated %s '%s' from '%s' to '%s'", kind, mappingScalar(internal.MappingField(node, "metadata"), "name"), apiVersion, replacedBy)
+		return nil
+	}
+}
+
+// migrateIngress converts the spec of an "extensions/v1beta1" or "networking.k8s.io/v1beta1" Ingress to the structure
+// of a "networking.k8s.io/v1" Ingress: "backend" is renamed to "defaultBackend", service backends are nested under
+// "service", and paths without a "pathType" get the "ImplementationSpecific" type (the v1beta1 default).
+func migrateIngress(ingress *yaml.Node) error {
+	spec := internal.MappingField(ingress, "spec")
+	if spec == nil {
+		return nil
+	}
+	if backend := internal.MappingField(spec, "backend"); backend != nil {
+		if err := migrateIngressBackend(backend); err != nil {
+			return fmt.Errorf("invalid default backend: %w", err)
+		}
+		renameMappingKey(spec, "backend", "defaultBackend")
+	}
+	if rules := internal.MappingField(spec, "rules"); rules != nil && rules.Kind == yaml.SequenceNode {
+		for i, rule := range rules.Content {
+			paths := internal.MappingField(internal.MappingField(rule, "http"), "paths")
+			if paths == nil || paths.Kind != yaml.SequenceNode {
+				continue
+			}
+			for j, path := range paths.Content {
+				if backend := internal.MappingField(path, "backend"); backend != nil {
+					if err := migrateIngressBackend(backend); err != nil {
+						return fmt.Errorf("invalid backend in path #%d of rule #%d: %w", j, i, err)
+					}
+				}
+				if internal.MappingField(path, "pathType") == nil {
+					setMappingScalar(path, "pathType", "ImplementationSpecific")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// migrateIngressBackend converts a v1beta1 Ingress backend ("serviceName" & "servicePort") to a v1 Ingress backend
+// ("service.name" & "service.port.number" or "service.port.name"). Resource backends are left as-is.
+func migrateIngressBackend(backend *yaml.Node) error {
+	if backend.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected an object")
+	}
+	serviceName, servicePort := internal.MappingField(backend, "serviceName"), internal.MappingField(backend, "servicePort")
+	if serviceName == nil && servicePort == nil {
+		return nil
+	}
+
+	port := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if servicePort != nil {
+		if _, err := strconv.Atoi(servicePort.Value); err == nil {
+			setMappingScalar(port, "number", servicePort.Value)
+			internal.MappingField(port, "number").Tag = "!!int"
+		} else {
+			setMappingScalar(port, "name", servicePort.Value)
+		}
+	}
+	service := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	if serviceName != nil {
+		setMappingScalar(service, "name", serviceName.Value)
+	}
+	service.Content = append(service.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "port"}, port)
+
+	internal.RemoveMappingKey(backend, "serviceName")
+	internal.RemoveMappingKey(backend, "servicePort")
+	backend.Content = append(backend.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "service"}, service)
+	return nil
+}
+
+func mappingScalar(node *yaml.Node, key string) string {
+	if value := internal.MappingField(node, key); value != nil && value.Kind == yaml.ScalarNode {
+		return value.Value
+	}
+	return ""
+}
+
+func setMappingScalar(node *yaml.Node, key, value string) {
+	if existing := internal.MappingField(node, key); existing != nil {
+		existing.Kind, existing.Tag, existing.Value, existing.Content = yaml.ScalarNode, "!!str", value, nil
+		return
+	}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+}
+
+func renameMappingKey(node *yaml.Node, key, newKey string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i].Value = newKey
+			return
+		}
+	}
+}
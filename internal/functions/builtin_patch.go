@@ -0,0 +1,185 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/gstream/pkg"
+	. "github.com/arikkfir/gstream/pkg/generate"
+	. "github.com/arikkfir/gstream/pkg/processing"
+	. "github.com/arikkfir/gstream/pkg/sink"
+	. "github.com/arikkfir/gstream/pkg/types"
+	"github.com/arikkfir/kude/internal"
+	"github.com/arikkfir/kyaml/pkg"
+	"github.com/arikkfir/kyaml/pkg/kstream"
+	jsonpatch "github.com/evanphx/json-patch"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"os"
+	kustomizeyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+	"sigs.k8s.io/kustomize/kyaml/yaml/merge2"
+	sigsyaml "sigs.k8s.io/yaml"
+	"strings"
+)
+
+const (
+	PatchTypeStrategic = "strategic"
+	PatchTypeJSON6902  = "json6902"
+	PatchTypeMerge     = "merge"
+)
+
+type Patch struct {
+	Type     string                  `mapstructure:"type"`
+	Patch    string                  `mapstructure:"patch"`
+	Path     string                  `mapstructure:"path"`
+	Includes []kyaml.TargetingFilter `mapstructure:"includes"`
+	Excludes []kyaml.TargetingFilter `mapstructure:"excludes"`
+}
+
+func (f *Patch) Invoke(_ *log.Logger, pwd, _, _ string, r io.Reader, w io.Writer) error {
+	patch := f.Patch
+	if f.Path != "" {
+		path := resolvePath(pwd, f.Path)
+		patchFileBytes, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed reading '%s': %w", path, err)
+		}
+		patch = string(patchFileBytes)
+	}
+	if strings.TrimSpace(patch) == "" {
+		return fmt.Errorf("one of the '%s' or '%s' properties is required for this function", "patch", "path")
+	}
+
+	var processor NodeProcessor
+	includes := f.Includes
+	switch f.Type {
+	case PatchTypeStrategic, "":
+		patchNode := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte(patch), patchNode); err != nil {
+			return fmt.Errorf("failed parsing strategic merge patch: %w", err)
+		} else if patchNode.Kind != yaml.DocumentNode || patchNode.Content[0].Kind != yaml.MappingNode {
+			return fmt.Errorf("invalid strategic merge patch: expected an object")
+		}
+		if len(includes) == 0 {
+			target := patchTarget(patchNode.Content[0])
+			if target == (kyaml.TargetingFilter{}) {
+				return fmt.Errorf("strategic merge patch must specify the apiVersion, kind, name or namespace of its target, or the '%s' property", "includes")
+			}
+			includes = []kyaml.TargetingFilter{target}
+		}
+		processor = strategicMergePatch(patch)
+	case PatchTypeJSON6902:
+		patchJSON, err := sigsyaml.YAMLToJSON([]byte(patch))
+		if err != nil {
+			return fmt.Errorf("failed parsing JSON patch: %w", err)
+		}
+		ops, err := jsonpatch.DecodePatch(patchJSON)
+		if err != nil {
+			return fmt.Errorf("invalid JSON patch: %w", err)
+		}
+		processor = jsonPatch(func(doc []byte) ([]byte, error) { return ops.Apply(doc) })
+	case PatchTypeMerge:
+		patchJSON, err := sigsyaml.YAMLToJSON([]byte(patch))
+		if err != nil {
+			return fmt.Errorf("failed parsing JSON merge patch: %w", err)
+		}
+		processor = jsonPatch(func(doc []byte) ([]byte, error) { return jsonpatch.MergePatch(doc, patchJSON) })
+	default:
+		return fmt.Errorf("invalid patch type: '%s' (should be one of: %s, %s, %s)", f.Type, PatchTypeStrategic, PatchTypeJSON6902, PatchTypeMerge)
+	}
+
+	s := stream.NewStream().
+		Generate(FromReader(r)).
+		Process(
+			Tee(
+				kstream.FilterResource(includes, f.Excludes),
+				NodeTransformerOf(processor),
+			),
+		).
+		Sink(ToWriter(w))
+	if err := s.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
+	}
+	return nil
+}
+
+// patchTarget returns the targeting filter of a strategic merge patch that has no "includes": like Kustomize, such a
+// patch applies to the resource it identifies by its own API version, kind, name & namespace.
+func patchTarget(patch *yaml.Node) kyaml.TargetingFilter {
+	metadata := internal.MappingField(patch, "metadata")
+	return kyaml.TargetingFilter{
+		APIVersion: mappingScalar(patch, "apiVersion"),
+		Kind:       mappingScalar(patch, "kind"),
+		Namespace:  mappingScalar(metadata, "namespace"),
+		Name:       mappingScalar(metadata, "name"),
+	}
+}
+
+// strategicMergePatch merges the given patch into each resource, the way "kubectl patch" & Kustomize do: mappings are
+// merged recursively, lists of objects are merged by their key according to the Kubernetes schema of the resource
+// (e.g. containers by name), and "$patch" directives are honored. The identity of the resource (API version, kind,
+// name & namespace) is never changed by the patch.
+func strategicMergePatch(patch string) NodeProcessor {
+	return func(_ context.Context, node *yaml.Node) error {
+		patchNode := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte(patch), patchNode); err != nil {
+			return fmt.Errorf("failed parsing strategic merge patch: %w", err)
+		}
+		target := patchNode.Content[0]
+		setMappingScalar(target, "apiVersion", mappingScalar(node, "apiVersion"))
+		setMappingScalar(target, "kind", mappingScalar(node, "kind"))
+		if patchMetadata := internal.MappingField(target, "metadata"); patchMetadata != nil {
+			internal.RemoveMappingKey(patchMetadata, "name")
+			internal.RemoveMappingKey(patchMetadata, "namespace")
+		}
+
+		resourceYAML, err := yaml.Marshal(node)
+		if err != nil {
+			return fmt.Errorf("failed encoding resource: %w", err)
+		}
+		patchYAML, err := yaml.Marshal(patchNode)
+		if err != nil {
+			return fmt.Errorf("failed encoding patch: %w", err)
+		}
+		patchedYAML, err := merge2.MergeStrings(string(patchYAML), string(resourceYAML), true, kustomizeyaml.MergeOptions{})
+		if err != nil {
+			return fmt.Errorf("failed patching %s: %w", describeResource(node), err)
+		}
+		return replaceNode(node, []byte(patchedYAML))
+	}
+}
+
+// jsonPatch applies the given JSON patch function (RFC 6902 or RFC 7386) to the JSON representation of each resource.
+func jsonPatch(apply func(doc []byte) ([]byte, error)) NodeProcessor {
+	return func(_ context.Context, node *yaml.Node) error {
+		resourceYAML, err := yaml.Marshal(node)
+		if err != nil {
+			return fmt.Errorf("failed encoding resource: %w", err)
+		}
+		resourceJSON, err := sigsyaml.YAMLToJSON(resourceYAML)
+		if err != nil {
+			return fmt.Errorf("failed converting %s to JSON: %w", describeResource(node), err)
+		}
+		patchedJSON, err := apply(resourceJSON)
+		if err != nil {
+			return fmt.Errorf("failed patching %s: %w", describeResource(node), err)
+		}
+		patchedYAML, err := sigsyaml.JSONToYAML(patchedJSON)
+		if err != nil {
+			return fmt.Errorf("failed converting patched %s to YAML: %w", describeResource(node), err)
+		}
+		return replaceNode(node, patchedYAML)
+	}
+}
+
+// replaceNode replaces the contents of the given node with the given YAML document, in-place.
+func replaceNode(node *yaml.Node, document []byte) error {
+	replacement := &yaml.Node{}
+	if err := yaml.Unmarshal(document, replacement); err != nil {
+		return fmt.Errorf("failed decoding patched resource: %w", err)
+	} else if replacement.Kind != yaml.DocumentNode || len(replacement.Content) == 0 || replacement.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("patched resource %s is no longer an object", describeResource(node))
+	}
+	*node = *replacement.Content[0]
+	return nil
+}
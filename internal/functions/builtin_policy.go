@@ -0,0 +1,544 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/arikkfir/gstream/pkg"
+	. "github.com/arikkfir/gstream/pkg/generate"
+	. "github.com/arikkfir/gstream/pkg/sink"
+	"github.com/arikkfir/kude/internal"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"github.com/open-policy-agent/opa/rego"
+	"gopkg.in/yaml.v3"
+	"io"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	PolicySeverityError   = "error"
+	PolicySeverityWarning = "warning"
+)
+
+// Policy evaluates policies against every resource, as well as against the full set of resources, failing if any
+// policy with an "error" severity is violated. Policies are either Rego modules, or ValidatingAdmissionPolicy resources
+// whose validations are CEL expressions.
+type Policy struct {
+	Rego        []string `mapstructure:"rego"`
+	RegoPackage string   `mapstructure:"regoPackage"`
+	CEL         []string `mapstructure:"cel"`
+}
+
+// policyViolation is a single violation of a policy by a resource (or by the full set of resources, if resource is nil).
+type policyViolation struct {
+	severity string
+	policy   string
+	resource *yaml.Node
+	message  string
+}
+
+func (v policyViolation) String() string {
+	if v.resource == nil {
+		return fmt.Sprintf("[%s] %s: %s", v.severity, v.policy, v.message)
+	}
+	return fmt.Sprintf("[%s] %s: %s: %s", v.severity, v.policy, describeResource(v.resource), v.message)
+}
+
+func (f *Policy) Invoke(logger *log.Logger, pwd, _, _ string, r io.Reader, w io.Writer) error {
+	if len(f.Rego) == 0 && len(f.CEL) == 0 {
+		return fmt.Errorf("at least one of the '%s' or '%s' properties is required for this function", "rego", "cel")
+	}
+
+	// Policies might apply to the full set of resources, so they are collected before being evaluated
+	var resources []*yaml.Node
+	output := bytes.Buffer{}
+	s := stream.NewStream().
+		Generate(FromReader(r)).
+		Process(func(_ context.Context, node *yaml.Node) error { resources = append(resources, node); return nil }).
+		Sink(ToWriter(&output))
+	if err := s.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
+	}
+
+	objects := make([]interface{}, len(resources))
+	for i, resource := range resources {
+		var object interface{}
+		if err := resource.Decode(&object); err != nil {
+			return fmt.Errorf("failed decoding resource %s: %w", describeResource(resource), err)
+		}
+		objects[i] = object
+	}
+
+	var violations []policyViolation
+	for _, path := range f.Rego {
+		v, err := f.evaluateRego(resolvePath(pwd, path), resources, objects)
+		if err != nil {
+			return err
+		}
+		violations = append(violations, v...)
+	}
+	for _, path := range f.CEL {
+		v, err := evaluateAdmissionPolicies(resolvePath(pwd, path), resources, objects)
+		if err != nil {
+			return err
+		}
+		violations = append(violations, v...)
+	}
+
+	var errs []string
+	for _, violation := range violations {
+		logger.Print(violation.String())
+		if violation.severity == PolicySeverityError {
+			errs = append(errs, violation.String())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d policy violation(s):\n%s", len(errs), strings.Join(errs, "\n"))
+	}
+
+	if _, err := io.Copy(w, &output); err != nil {
+		return fmt.Errorf("failed writing resources: %w", err)
+	}
+	return nil
+}
+
+// evaluateRego evaluates the Rego module at the given path. Its "deny" and "warn" rules are evaluated against each
+// resource (as "input"), and its "deny_resources" and "warn_resources" rules are evaluated against the full list of
+// resources (as "input"). Each of these rules should produce a set of messages, which are either strings or objects with
+// a "msg" property.
+func (f *Policy) evaluateRego(path string, resources []*yaml.Node, objects []interface{}) ([]policyViolation, error) {
+	module, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading '%s': %w", path, err)
+	}
+	pkg := f.RegoPackage
+	if pkg == "" {
+		pkg = "kude"
+	}
+
+	ctx := context.Background()
+	queries := make(map[string]rego.PreparedEvalQuery)
+	for _, rule := range []string{"deny", "warn", "deny_resources", "warn_resources"} {
+		query, err := rego.New(rego.Query("data."+pkg+"."+rule), rego.Module(path, string(module))).PrepareForEval(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed compiling Rego policy '%s': %w", path, err)
+		}
+		queries[rule] = query
+	}
+	evaluate := func(rule string, input interface{}) ([]string, error) {
+		rs, err := queries[rule].Eval(ctx, rego.EvalInput(input))
+		if err != nil {
+			return nil, fmt.Errorf("failed evaluating Rego policy '%s': %w", path, err)
+		}
+		var messages []string
+		for _, result := range rs {
+			for _, expression := range result.Expressions {
+				messages = append(messages, regoMessages(rule, expression.Value)...)
+			}
+		}
+		return messages, nil
+	}
+
+	var violations []policyViolation
+	for _, rule := range []struct{ name, severity string }{{"deny", PolicySeverityError}, {"warn", PolicySeverityWarning}} {
+		for i, resource := range resources {
+			messages, err := evaluate(rule.name, objects[i])
+			if err != nil {
+				return nil, err
+			}
+			for _, message := range messages {
+				violations = append(violations, policyViolation{rule.severity, filepath.Base(path), resource, message})
+			}
+		}
+		messages, err := evaluate(rule.name+"_resources", objects)
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			violations = append(violations, policyViolation{rule.severity, filepath.Base(path), nil, message})
+		}
+	}
+	return violations, nil
+}
+
+// regoMessages extracts violation messages from the value of a Rego rule.
+func regoMessages(rule string, value interface{}) []string {
+	switch v := value.(type) {
+	case []interface{}:
+		var messages []string
+		for _, item := range v {
+			messages = append(messages, regoMessages(rule, item)...)
+		}
+		return messages
+	case map[string]interface{}:
+		if msg, ok := v["msg"]; ok {
+			return []string{fmt.Sprintf("%v", msg)}
+		}
+		return []string{fmt.Sprintf("%v", v)}
+	case string:
+		return []string{v}
+	case bool:
+		if v {
+			return []string{fmt.Sprintf("rule '%s' is true", rule)}
+		}
+		return nil
+	default:
+		return []string{fmt.Sprintf("%v", v)}
+	}
+}
+
+type admissionPolicyRule struct {
+	APIGroups   []string `yaml:"apiGroups"`
+	APIVersions []string `yaml:"apiVersions"`
+	Resources   []string `yaml:"resources"`
+	Operations  []string `yaml:"operations"`
+}
+
+func (r admissionPolicyRule) matches(group, version, resource string) bool {
+	return matchesAny(r.APIGroups, group) && matchesAny(r.APIVersions, version) && matchesAny(r.Resources, resource) &&
+		(len(r.Operations) == 0 || matchesAny(r.Operations, "CREATE"))
+}
+
+type admissionPolicy struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Metadata   struct {
+		Name string `yaml:"name"`
+	} `yaml:"metadata"`
+	Spec struct {
+		// ValidatingAdmissionPolicy properties
+		FailurePolicy    string `yaml:"failurePolicy"`
+		MatchConstraints *struct {
+			ResourceRules        []admissionPolicyRule `yaml:"resourceRules"`
+			ExcludeResourceRules []admissionPolicyRule `yaml:"excludeResourceRules"`
+			ObjectSelector       *struct {
+				MatchLabels      map[string]string `yaml:"matchLabels"`
+				MatchExpressions []struct {
+					Key      string   `yaml:"key"`
+					Operator string   `yaml:"operator"`
+					Values   []string `yaml:"values"`
+				} `yaml:"matchExpressions"`
+			} `yaml:"objectSelector"`
+		} `yaml:"matchConstraints"`
+		Validations []struct {
+			Expression        string `yaml:"expression"`
+			Message           string `yaml:"message"`
+			MessageExpression string `yaml:"messageExpression"`
+		} `yaml:"validations"`
+
+		// ValidatingAdmissionPolicyBinding properties
+		PolicyName        string   `yaml:"policyName"`
+		ValidationActions []string `yaml:"validationActions"`
+	} `yaml:"spec"`
+}
+
+// matches checks whether the given resource is matched by this policy's constraints. Since resources are not sent to a
+// cluster, they are considered to be created, and namespace selectors are ignored.
+func (p *admissionPolicy) matches(resource *yaml.Node, object interface{}) (bool, error) {
+	constraints := p.Spec.MatchConstraints
+	if constraints == nil {
+		return true, nil
+	}
+
+	apiVersion, kind := mappingScalar(resource, "apiVersion"), mappingScalar(resource, "kind")
+	group, version := "", apiVersion
+	if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+		group, version = apiVersion[:i], apiVersion[i+1:]
+	}
+	plural := kindToResource(kind)
+	if len(constraints.ResourceRules) > 0 {
+		matched := false
+		for _, rule := range constraints.ResourceRules {
+			if rule.matches(group, version, plural) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	for _, rule := range constraints.ExcludeResourceRules {
+		if rule.matches(group, version, plural) {
+			return false, nil
+		}
+	}
+
+	if constraints.ObjectSelector != nil {
+		selector := &metav1.LabelSelector{MatchLabels: constraints.ObjectSelector.MatchLabels}
+		for _, expr := range constraints.ObjectSelector.MatchExpressions {
+			selector.MatchExpressions = append(selector.MatchExpressions, metav1.LabelSelectorRequirement{
+				Key:      expr.Key,
+				Operator: metav1.LabelSelectorOperator(expr.Operator),
+				Values:   expr.Values,
+			})
+		}
+		s, err := metav1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			return false, fmt.Errorf("invalid object selector: %w", err)
+		}
+		resourceLabels, ok := objectLabels(object)
+		if !ok || !s.Matches(resourceLabels) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// objectLabels returns the labels of the given decoded resource. Resources that are not shaped as Kubernetes objects
+// (e.g. with non-mapping metadata or labels) are reported as such, rather than being treated as having no labels.
+func objectLabels(object interface{}) (labels.Set, bool) {
+	resourceLabels := labels.Set{}
+	obj, ok := object.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	metadataValue, found := obj["metadata"]
+	if !found || metadataValue == nil {
+		return resourceLabels, true
+	}
+	metadata, ok := metadataValue.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	labelsValue, found := metadata["labels"]
+	if !found || labelsValue == nil {
+		return resourceLabels, true
+	}
+	l, ok := labelsValue.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	for k, v := range l {
+		resourceLabels[k] = fmt.Sprintf("%v", v)
+	}
+	return resourceLabels, true
+}
+
+// evaluateAdmissionPolicies evaluates the ValidatingAdmissionPolicy resources in the given file against each resource
+// they match. Like in Kubernetes, CEL expressions access the resource as "object"; the full list of resources is also
+// available as "resources". Violations are errors, unless a ValidatingAdmissionPolicyBinding for the policy is found
+// in the same file, and its validation actions do not include "Deny".
+func evaluateAdmissionPolicies(path string, resources []*yaml.Node, objects []interface{}) ([]policyViolation, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading '%s': %w", path, err)
+	}
+
+	var policies []*admissionPolicy
+	severities := make(map[string]string)
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	for {
+		p := &admissionPolicy{}
+		if err := decoder.Decode(p); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, fmt.Errorf("failed decoding '%s': %w", path, err)
+		}
+		switch p.Kind {
+		case "ValidatingAdmissionPolicy":
+			policies = append(policies, p)
+		case "ValidatingAdmissionPolicyBinding":
+			severities[p.Spec.PolicyName] = PolicySeverityWarning
+			if len(p.Spec.ValidationActions) == 0 || matchesAny(p.Spec.ValidationActions, "Deny") {
+				severities[p.Spec.PolicyName] = PolicySeverityError
+			}
+		case "":
+			// empty document
+		default:
+			return nil, fmt.Errorf("unsupported resource kind in '%s': %s (expected ValidatingAdmissionPolicy or ValidatingAdmissionPolicyBinding)", path, p.Kind)
+		}
+	}
+
+	env, err := cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.Variable("oldObject", cel.DynType),
+		cel.Variable("params", cel.DynType),
+		cel.Variable("request", cel.DynType),
+		cel.Variable("resources", cel.ListType(cel.DynType)),
+		ext.Strings(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating CEL environment: %w", err)
+	}
+	compile := func(policy, expression string) (cel.Program, error) {
+		ast, issues := env.Compile(expression)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("failed compiling expression of policy '%s' in '%s': %w", policy, path, issues.Err())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("failed compiling expression of policy '%s' in '%s': %w", policy, path, err)
+		}
+		return program, nil
+	}
+
+	var violations []policyViolation
+	for _, p := range policies {
+		severity, found := severities[p.Metadata.Name]
+		if !found {
+			severity = PolicySeverityError
+		}
+		for _, validation := range p.Spec.Validations {
+			program, err := compile(p.Metadata.Name, validation.Expression)
+			if err != nil {
+				return nil, err
+			}
+			var messageProgram cel.Program
+			if validation.MessageExpression != "" {
+				if messageProgram, err = compile(p.Metadata.Name, validation.MessageExpression); err != nil {
+					return nil, err
+				}
+			}
+
+			for i, resource := range resources {
+				if matches, err := p.matches(resource, objects[i]); err != nil {
+					return nil, fmt.Errorf("failed matching policy '%s' in '%s': %w", p.Metadata.Name, path, err)
+				} else if !matches {
+					continue
+				}
+
+				activation := map[string]interface{}{
+					"object":    objects[i],
+					"oldObject": nil,
+					"params":    nil,
+					"request": map[string]interface{}{
+						"operation": "CREATE",
+						"name":      mappingScalar(internal.MappingField(resource, "metadata"), "name"),
+						"namespace": mappingScalar(internal.MappingField(resource, "metadata"), "namespace"),
+					},
+					"resources": objects,
+				}
+				out, _, err := program.Eval(activation)
+				if err != nil {
+					if p.Spec.FailurePolicy != "Ignore" {
+						violations = append(violations, policyViolation{PolicySeverityError, p.Metadata.Name, resource, fmt.Sprintf("failed evaluating expression '%s': %s", validation.Expression, err)})
+					}
+					continue
+				} else if valid, ok := out.Value().(bool); !ok {
+					return nil, fmt.Errorf("expression of policy '%s' in '%s' did not evaluate to a boolean: %s", p.Metadata.Name, path, validation.Expression)
+				} else if valid {
+					continue
+				}
+
+				message := validation.Message
+				if messageProgram != nil {
+					if out, _, err := messageProgram.Eval(activation); err == nil {
+						if s, ok := out.Value().(string); ok && s != "" {
+							message = s
+						}
+					}
+				}
+				if message == "" {
+					message = fmt.Sprintf("failed expression: %s", validation.Expression)
+				}
+				violations = append(violations, policyViolation{severity, p.Metadata.Name, resource, message})
+			}
+		}
+	}
+	return violations, nil
+}
+
+// kindResources maps the kinds of built-in Kubernetes APIs to their resource names, as used in admission rules (the
+// equivalent of a RESTMapper for a cluster with no custom resources).
+var kindResources = map[string]string{
+	"APIService":                       "apiservices",
+	"Binding":                          "bindings",
+	"CertificateSigningRequest":        "certificatesigningrequests",
+	"ClusterRole":                      "clusterroles",
+	"ClusterRoleBinding":               "clusterrolebindings",
+	"ComponentStatus":                  "componentstatuses",
+	"ConfigMap":                        "configmaps",
+	"ControllerRevision":               "controllerrevisions",
+	"CronJob":                          "cronjobs",
+	"CSIDriver":                        "csidrivers",
+	"CSINode":                          "csinodes",
+	"CSIStorageCapacity":               "csistoragecapacities",
+	"CustomResourceDefinition":         "customresourcedefinitions",
+	"DaemonSet":                        "daemonsets",
+	"Deployment":                       "deployments",
+	"EndpointSlice":                    "endpointslices",
+	"Endpoints":                        "endpoints",
+	"Event":                            "events",
+	"FlowSchema":                       "flowschemas",
+	"HorizontalPodAutoscaler":          "horizontalpodautoscalers",
+	"Ingress":                          "ingresses",
+	"IngressClass":                     "ingressclasses",
+	"Job":                              "jobs",
+	"Lease":                            "leases",
+	"LimitRange":                       "limitranges",
+	"MutatingWebhookConfiguration":     "mutatingwebhookconfigurations",
+	"Namespace":                        "namespaces",
+	"NetworkPolicy":                    "networkpolicies",
+	"Node":                             "nodes",
+	"PersistentVolume":                 "persistentvolumes",
+	"PersistentVolumeClaim":            "persistentvolumeclaims",
+	"Pod":                              "pods",
+	"PodDisruptionBudget":              "poddisruptionbudgets",
+	"PodSecurityPolicy":                "podsecuritypolicies",
+	"PodTemplate":                      "podtemplates",
+	"PriorityClass":                    "priorityclasses",
+	"PriorityLevelConfiguration":       "prioritylevelconfigurations",
+	"ReplicaSet":                       "replicasets",
+	"ReplicationController":            "replicationcontrollers",
+	"ResourceQuota":                    "resourcequotas",
+	"Role":                             "roles",
+	"RoleBinding":                      "rolebindings",
+	"RuntimeClass":                     "runtimeclasses",
+	"Secret":                           "secrets",
+	"Service":                          "services",
+	"ServiceAccount":                   "serviceaccounts",
+	"StatefulSet":                      "statefulsets",
+	"StorageClass":                     "storageclasses",
+	"ValidatingAdmissionPolicy":        "validatingadmissionpolicies",
+	"ValidatingAdmissionPolicyBinding": "validatingadmissionpolicybindings",
+	"ValidatingWebhookConfiguration":   "validatingwebhookconfigurations",
+	"VolumeAttachment":                 "volumeattachments",
+}
+
+// kindToResource returns the (lowercase, plural) resource name of the given kind, as used in admission rules. Kinds of
+// built-in APIs are looked up in kindResources; other kinds (e.g. of custom resources) are pluralized the same way
+// Kubernetes guesses resource names for kinds it has no mapping for.
+func kindToResource(kind string) string {
+	if resource, found := kindResources[kind]; found {
+		return resource
+	}
+	plural, _ := meta.UnsafeGuessKindToResource(schema.GroupVersionKind{Kind: kind})
+	return plural.Resource
+}
+
+func matchesAny(values []string, value string) bool {
+	for _, v := range values {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func resolvePath(pwd, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(pwd, path)
+}
+
+// describeResource returns a short description of the given resource (its kind, namespace & name).
+func describeResource(resource *yaml.Node) string {
+	metadata := internal.MappingField(resource, "metadata")
+	name := mappingScalar(metadata, "name")
+	if namespace := mappingScalar(metadata, "namespace"); namespace != "" {
+		name = namespace + "/" + name
+	}
+	return fmt.Sprintf("%s '%s'", mappingScalar(resource, "kind"), name)
+}
@@ -0,0 +1,89 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/gstream/pkg"
+	. "github.com/arikkfir/gstream/pkg/generate"
+	"github.com/arikkfir/kyaml/pkg"
+	"github.com/vmware-labs/yaml-jsonpath/pkg/yamlpath"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+)
+
+// Remove removes resources matching its filters from the stream (or, in "keep" mode, removes all other resources). A
+// resource matches if it matches the includes & excludes filters, and if the YAML path (if given) finds at least one
+// node in it.
+type Remove struct {
+	Includes []kyaml.TargetingFilter `mapstructure:"includes"`
+	Excludes []kyaml.TargetingFilter `mapstructure:"excludes"`
+	YAMLPath string                  `mapstructure:"yamlPath"`
+	Keep     bool                    `mapstructure:"keep"`
+}
+
+func (f *Remove) Invoke(logger *log.Logger, _, _, _ string, r io.Reader, w io.Writer) error {
+	if len(f.Includes) == 0 && len(f.Excludes) == 0 && f.YAMLPath == "" {
+		return fmt.Errorf("at least one of the '%s', '%s' or '%s' properties is required for this function", "includes", "excludes", "yamlPath")
+	}
+
+	var path *yamlpath.Path
+	if f.YAMLPath != "" {
+		if p, err := yamlpath.NewPath(f.YAMLPath); err != nil {
+			return fmt.Errorf("invalid YAML path '%s': %w", f.YAMLPath, err)
+		} else {
+			path = p
+		}
+	}
+
+	removed := 0
+	s := stream.NewStream().
+		Generate(FromReader(r)).
+		Transform(func(_ context.Context, node *yaml.Node, output chan *yaml.Node) error {
+			matched := matchesTargetingFilters(node, f.Includes, f.Excludes)
+			if matched && path != nil {
+				if found, err := path.Find(node); err != nil {
+					return fmt.Errorf("YAML path '%s' failed for %s: %w", f.YAMLPath, describeResource(node), err)
+				} else {
+					matched = len(found) > 0
+				}
+			}
+			if matched == f.Keep {
+				output <- node
+			} else {
+				removed++
+			}
+			return nil
+		}).
+		Sink(&optionalWriterSink{w: w})
+	if err := s.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
+	}
+	logger.Printf("Removed %d resources", removed)
+	return nil
+}
+
+// optionalWriterSink writes nodes to a writer, like gstream's ToWriter sink, but also supports writing no nodes at all
+// (e.g. when all resources are removed).
+type optionalWriterSink struct {
+	w       io.Writer
+	encoder *yaml.Encoder
+}
+
+func (s *optionalWriterSink) Process(_ context.Context, node *yaml.Node) error {
+	if s.encoder == nil {
+		s.encoder = yaml.NewEncoder(s.w)
+		s.encoder.SetIndent(2)
+	}
+	if err := s.encoder.Encode(node); err != nil {
+		return fmt.Errorf("failed encoding node: %w", err)
+	}
+	return nil
+}
+
+func (s *optionalWriterSink) Close() error {
+	if s.encoder == nil {
+		return nil
+	}
+	return s.encoder.Close()
+}
@@ -0,0 +1,275 @@
+package functions
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/arikkfir/gstream/pkg"
+	. "github.com/arikkfir/gstream/pkg/generate"
+	. "github.com/arikkfir/gstream/pkg/sink"
+	"github.com/arikkfir/kude/internal"
+	"github.com/arikkfir/kyaml/pkg"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+const previousNameAnnotationName = "kude.kfirs.com/previous-name"
+
+type ReplacementOptions struct {
+	Delimiter string `mapstructure:"delimiter"`
+	Index     int    `mapstructure:"index"`
+	Create    bool   `mapstructure:"create"`
+}
+
+type ReplacementSource struct {
+	kyaml.TargetingFilter `mapstructure:",squash"`
+	FieldPath             string             `mapstructure:"fieldPath"`
+	Options               ReplacementOptions `mapstructure:"options"`
+}
+
+type ReplacementTarget struct {
+	Includes   []kyaml.TargetingFilter `mapstructure:"includes"`
+	Excludes   []kyaml.TargetingFilter `mapstructure:"excludes"`
+	FieldPaths []string                `mapstructure:"fieldPaths"`
+	Options    ReplacementOptions      `mapstructure:"options"`
+}
+
+type Replacement struct {
+	Source  ReplacementSource   `mapstructure:"source"`
+	Targets []ReplacementTarget `mapstructure:"targets"`
+}
+
+// Replacements copies values from fields of source resources into fields of target resources, like Kustomize's
+// replacements. Since sources & targets can be anywhere in the stream, all resources are collected before any
+// replacement is made.
+type Replacements struct {
+	Replacements []Replacement `mapstructure:"replacements"`
+}
+
+func (f *Replacements) Invoke(logger *log.Logger, _, _, _ string, r io.Reader, w io.Writer) error {
+	if len(f.Replacements) == 0 {
+		return fmt.Errorf("the '%s' property is required for this function", "replacements")
+	}
+
+	var resources []*yaml.Node
+	collector := stream.NewStream().
+		Generate(FromReader(r)).
+		Process(func(_ context.Context, node *yaml.Node) error { resources = append(resources, node); return nil }).
+		Sink(ToWriter(io.Discard))
+	if err := collector.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
+	}
+
+	for i, replacement := range f.Replacements {
+		if err := replace(logger, replacement, resources); err != nil {
+			return fmt.Errorf("replacement #%d failed: %w", i, err)
+		}
+	}
+
+	s := stream.NewStream().
+		Generate(func(_ context.Context, target chan *yaml.Node) error {
+			for _, resource := range resources {
+				target <- resource
+			}
+			return nil
+		}).
+		Sink(ToWriter(w))
+	if err := s.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
+	}
+	return nil
+}
+
+func replace(logger *log.Logger, replacement Replacement, resources []*yaml.Node) error {
+	source, err := findReplacementSource(replacement.Source, resources)
+	if err != nil {
+		return err
+	}
+
+	fieldPath := replacement.Source.FieldPath
+	if fieldPath == "" {
+		fieldPath = "metadata.name"
+	}
+	values, err := lookupFieldPath(source, fieldPath, false)
+	if err != nil {
+		return fmt.Errorf("invalid source field path '%s': %w", fieldPath, err)
+	} else if len(values) != 1 {
+		return fmt.Errorf("source field path '%s' of %s matched %d fields (expected exactly one)", fieldPath, describeResource(source), len(values))
+	}
+	value := values[0]
+	if options := replacement.Source.Options; options.Delimiter != "" {
+		if value.Kind != yaml.ScalarNode {
+			return fmt.Errorf("source field '%s' of %s is not a scalar, and cannot be split by a delimiter", fieldPath, describeResource(source))
+		}
+		parts := strings.Split(value.Value, options.Delimiter)
+		if options.Index < 0 || options.Index >= len(parts) {
+			return fmt.Errorf("source index %d is out of bounds for value '%s' of field '%s' of %s", options.Index, value.Value, fieldPath, describeResource(source))
+		}
+		value = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: parts[options.Index]}
+	}
+
+	for _, target := range replacement.Targets {
+		for _, resource := range resources {
+			if !matchesTargetingFilters(resource, target.Includes, target.Excludes) {
+				continue
+			}
+			for _, targetFieldPath := range target.FieldPaths {
+				fields, err := lookupFieldPath(resource, targetFieldPath, target.Options.Create)
+				if err != nil {
+					return fmt.Errorf("invalid target field path '%s': %w", targetFieldPath, err)
+				}
+				for _, field := range fields {
+					if err := replaceField(field, value, target.Options); err != nil {
+						return fmt.Errorf("failed replacing field '%s' of %s: %w", targetFieldPath, describeResource(resource), err)
+					}
+					logger.Printf("Replaced field '%s' of %s with field '%s' of %s", targetFieldPath, describeResource(resource), fieldPath, describeResource(source))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// findReplacementSource finds the single resource matching the given source filter. A resource whose name was changed
+// by a generator (e.g. a ConfigMap with a hashed name) also matches its original name.
+func findReplacementSource(source ReplacementSource, resources []*yaml.Node) (*yaml.Node, error) {
+	var matches []*yaml.Node
+	for _, resource := range resources {
+		rn := &kyaml.RNode{N: resource}
+		if source.TargetingFilter.Matches(rn) {
+			matches = append(matches, resource)
+		} else if source.Name != "" {
+			filter := source.TargetingFilter
+			filter.Name = ""
+			annotations := internal.MappingField(internal.MappingField(resource, "metadata"), "annotations")
+			if mappingScalar(annotations, previousNameAnnotationName) == source.Name && filter.Matches(rn) {
+				matches = append(matches, resource)
+			}
+		}
+	}
+	if len(matches) != 1 {
+		return nil, fmt.Errorf("source matched %d resources (expected exactly one)", len(matches))
+	}
+	return matches[0], nil
+}
+
+func matchesTargetingFilters(resource *yaml.Node, includes, excludes []kyaml.TargetingFilter) bool {
+	rn := &kyaml.RNode{N: resource}
+	matched := len(includes) == 0
+	for _, filter := range includes {
+		if filter.Matches(rn) {
+			matched = true
+			break
+		}
+	}
+	for _, filter := range excludes {
+		if filter.Matches(rn) {
+			return false
+		}
+	}
+	return matched
+}
+
+// replaceField replaces the given field with the given value. If a delimiter is given, only the part of the field's
+// value at the given index is replaced.
+func replaceField(field, value *yaml.Node, options ReplacementOptions) error {
+	if options.Delimiter == "" {
+		*field = *internal.CopyNode(value)
+		return nil
+	} else if field.Kind != yaml.ScalarNode || value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("only scalar values can be replaced using a delimiter")
+	}
+	parts := strings.Split(field.Value, options.Delimiter)
+	if options.Index < 0 || options.Index >= len(parts) {
+		return fmt.Errorf("index %d is out of bounds for value '%s'", options.Index, field.Value)
+	}
+	parts[options.Index] = value.Value
+	field.Kind, field.Tag, field.Style, field.Value = yaml.ScalarNode, "!!str", 0, strings.Join(parts, options.Delimiter)
+	return nil
+}
+
+// lookupFieldPath returns the fields of the given node at the given path. Path segments are separated by dots, and are
+// either mapping keys, sequence indices, "*" (all items of a sequence), or "[key=value]" (items of a sequence whose
+// "key" field equals "value"). If create is true, missing mapping keys are created.
+func lookupFieldPath(node *yaml.Node, path string, create bool) ([]*yaml.Node, error) {
+	segments, err := splitFieldPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []*yaml.Node{node}
+	for i, segment := range segments {
+		var next []*yaml.Node
+		for _, n := range nodes {
+			switch {
+			case strings.HasPrefix(segment, "["):
+				key, value, found := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(segment, "["), "]"), "=")
+				if !found {
+					return nil, fmt.Errorf("invalid segment '%s' (expected '[key=value]')", segment)
+				} else if n.Kind == yaml.SequenceNode {
+					for _, item := range n.Content {
+						if mappingScalar(item, key) == value {
+							next = append(next, item)
+						}
+					}
+				}
+			case segment == "*":
+				if n.Kind == yaml.SequenceNode {
+					next = append(next, n.Content...)
+				}
+			case n.Kind == yaml.SequenceNode:
+				if index, err := strconv.Atoi(segment); err != nil {
+					return nil, fmt.Errorf("invalid segment '%s' (expected a sequence index)", segment)
+				} else if index >= 0 && index < len(n.Content) {
+					next = append(next, n.Content[index])
+				}
+			case n.Kind == yaml.MappingNode:
+				if child := internal.MappingField(n, segment); child != nil {
+					next = append(next, child)
+				} else if create {
+					child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+					if i == len(segments)-1 {
+						child = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+					}
+					n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: segment}, child)
+					next = append(next, child)
+				}
+			}
+		}
+		nodes = next
+	}
+	return nodes, nil
+}
+
+// splitFieldPath splits the given field path by dots, except for dots inside brackets.
+func splitFieldPath(path string) ([]string, error) {
+	var segments []string
+	var segment bytes.Buffer
+	depth := 0
+	for _, c := range path {
+		switch {
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '.' && depth == 0:
+			segments = append(segments, segment.String())
+			segment.Reset()
+			continue
+		}
+		segment.WriteRune(c)
+	}
+	segments = append(segments, segment.String())
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced brackets")
+	}
+	for _, s := range segments {
+		if s == "" {
+			return nil, fmt.Errorf("empty segment")
+		}
+	}
+	return segments, nil
+}
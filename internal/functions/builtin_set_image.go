@@ -0,0 +1,171 @@
+package functions
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/gstream/pkg"
+	. "github.com/arikkfir/gstream/pkg/generate"
+	. "github.com/arikkfir/gstream/pkg/sink"
+	. "github.com/arikkfir/gstream/pkg/types"
+	"github.com/arikkfir/kude/internal"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log"
+	"strings"
+)
+
+// podSpecPaths maps kinds that contain a pod spec to the path of their pod spec.
+var podSpecPaths = map[string][]string{
+	"Pod":                   {"spec"},
+	"Deployment":            {"spec", "template", "spec"},
+	"StatefulSet":           {"spec", "template", "spec"},
+	"DaemonSet":             {"spec", "template", "spec"},
+	"ReplicaSet":            {"spec", "template", "spec"},
+	"ReplicationController": {"spec", "template", "spec"},
+	"Job":                   {"spec", "template", "spec"},
+	"CronJob":               {"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+type SetImageEntry struct {
+	Name    string `mapstructure:"name"`
+	NewName string `mapstructure:"newName"`
+	NewTag  string `mapstructure:"newTag"`
+	Digest  string `mapstructure:"digest"`
+}
+
+type SetImage struct {
+	Images         []SetImageEntry `mapstructure:"images"`
+	ResolveDigests bool            `mapstructure:"resolveDigests"`
+}
+
+func (f *SetImage) Invoke(logger *log.Logger, _, _, _ string, r io.Reader, w io.Writer) error {
+	if len(f.Images) == 0 && !f.ResolveDigests {
+		return fmt.Errorf("at least one of the '%s' or '%s' properties is required for this function", "images", "resolveDigests")
+	}
+	for i, image := range f.Images {
+		if image.Name == "" {
+			return fmt.Errorf("the '%s' property is required for image #%d", "name", i)
+		}
+	}
+
+	s := stream.NewStream().
+		Generate(FromReader(r)).
+		Process(f.setImages(logger, make(map[string]string))).
+		Sink(ToWriter(w))
+	if err := s.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
+	}
+	return nil
+}
+
+// setImages rewrites the images of all containers in resources containing a pod spec. Resolved digests are cached in
+// the given map, by image reference.
+func (f *SetImage) setImages(logger *log.Logger, digests map[string]string) NodeProcessor {
+	return func(_ context.Context, node *yaml.Node) error {
+		path, found := podSpecPaths[mappingScalar(node, "kind")]
+		if !found {
+			return nil
+		}
+		podSpec := node
+		for _, key := range path {
+			podSpec = internal.MappingField(podSpec, key)
+		}
+
+		for _, containersKey := range []string{"initContainers", "containers", "ephemeralContainers"} {
+			containers := internal.MappingField(podSpec, containersKey)
+			if containers == nil || containers.Kind != yaml.SequenceNode {
+				continue
+			}
+			for _, container := range containers.Content {
+				image := internal.MappingField(container, "image")
+				if image == nil || image.Kind != yaml.ScalarNode || image.Value == "" {
+					continue
+				}
+				newImage, err := f.rewrite(image.Value, digests)
+				if err != nil {
+					return fmt.Errorf("failed setting image of container '%s' in %s: %w", mappingScalar(container, "name"), describeResource(node), err)
+				} else if newImage != image.Value {
+					logger.Printf("Replaced image '%s' with '%s' in container '%s' of %s", image.Value, newImage, mappingScalar(container, "name"), describeResource(node))
+					image.Value, image.Style = newImage, 0
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// rewrite rewrites the given image according to the first matching image entry, and then resolves its digest if
+// requested (and if the image is not already pinned to a digest).
+func (f *SetImage) rewrite(image string, digests map[string]string) (string, error) {
+	imageName, tag, digest := splitImage(image)
+	for _, entry := range f.Images {
+		if entry.Name != imageName {
+			continue
+		}
+		if entry.NewName != "" {
+			imageName = entry.NewName
+		}
+		if entry.NewTag != "" {
+			tag, digest = entry.NewTag, ""
+		}
+		if entry.Digest != "" {
+			tag, digest = "", entry.Digest
+		}
+		break
+	}
+
+	if f.ResolveDigests && digest == "" {
+		reference := imageName
+		if tag != "" {
+			reference += ":" + tag
+		}
+		if resolved, found := digests[reference]; found {
+			digest = resolved
+		} else if resolved, err := resolveDigest(reference); err != nil {
+			return "", err
+		} else {
+			digests[reference] = resolved
+			digest = resolved
+		}
+	}
+
+	result := imageName
+	if tag != "" {
+		result += ":" + tag
+	}
+	if digest != "" {
+		result += "@" + digest
+	}
+	return result, nil
+}
+
+// resolveDigest looks up the digest of the given image reference in its registry, using the credentials of the local
+// Docker configuration, if any.
+func resolveDigest(reference string) (string, error) {
+	ref, err := name.ParseReference(reference)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference '%s': %w", reference, err)
+	}
+	descriptor, err := remote.Head(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return "", fmt.Errorf("failed resolving digest of image '%s': %w", reference, err)
+	}
+	return descriptor.Digest.String(), nil
+}
+
+// splitImage splits the given image into its name, tag & digest (e.g. "registry:5000/app:1.0@sha256:..." is split into
+// "registry:5000/app", "1.0" & "sha256:...").
+func splitImage(image string) (string, string, string) {
+	imageName, digest := image, ""
+	if i := strings.Index(imageName, "@"); i >= 0 {
+		imageName, digest = imageName[:i], imageName[i+1:]
+	}
+	tag := ""
+	if i := strings.LastIndex(imageName, ":"); i >= 0 && !strings.Contains(imageName[i+1:], "/") {
+		imageName, tag = imageName[:i], imageName[i+1:]
+	}
+	return imageName, tag, digest
+}
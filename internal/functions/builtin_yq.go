@@ -1,33 +1,236 @@
 package functions
 
 import (
+	"container/list"
 	"context"
 	"fmt"
+	"github.com/arikkfir/gstream/pkg"
+	. "github.com/arikkfir/gstream/pkg/generate"
+	. "github.com/arikkfir/gstream/pkg/sink"
+	"github.com/arikkfir/kyaml/pkg"
+	"github.com/mikefarah/yq/v4/pkg/yqlib"
+	logging "gopkg.in/op/go-logging.v1"
+	"gopkg.in/yaml.v3"
 	"io"
 	"log"
 	"os"
-	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
 )
 
-// TODO: download YQ into temp dir instead of bundling it inside the Docker image
+// yqMutex serializes yq evaluations, since the yq library relies on global state (e.g. its expression parser).
+var yqMutex sync.Mutex
 
+func init() {
+	// The yq library logs its parsing & evaluation at debug level by default
+	logging.SetLevel(logging.WARNING, "yq-lib")
+}
+
+// YQEnvVar is an environment variable made available to yq expressions (e.g. using the "env" & "strenv" operators).
+type YQEnvVar struct {
+	Name  string `mapstructure:"name"`
+	Value string `mapstructure:"value"`
+}
+
+// YQ evaluates yq expressions over resources, in-process using the yq library. By default, each resource is evaluated
+// on its own (like "yq eval"), and replaced by the results of the evaluation; if evaluateAll is set, all matching
+// resources are evaluated together (like "yq eval-all"). Multiple expressions are applied in order, each evaluated over
+// the results of the previous one. Resources not matching the includes & excludes filters are passed through as-is.
 type YQ struct {
-	Expression string `mapstructure:"expression"`
+	Expression  string                  `mapstructure:"expression"`
+	Expressions []string                `mapstructure:"expressions"`
+	Includes    []kyaml.TargetingFilter `mapstructure:"includes"`
+	Excludes    []kyaml.TargetingFilter `mapstructure:"excludes"`
+	Env         []YQEnvVar              `mapstructure:"env"`
+	EvaluateAll bool                    `mapstructure:"evaluateAll"`
 }
 
-func (f *YQ) Invoke(logger *log.Logger, pwd, _, _ string, r io.Reader, w io.Writer) error {
-	if f.Expression == "" {
-		return fmt.Errorf("expression is required")
+func (f *YQ) Invoke(_ *log.Logger, _, _, _ string, r io.Reader, w io.Writer) error {
+	var expressions []string
+	if f.Expression != "" {
+		expressions = append(expressions, f.Expression)
+	}
+	expressions = append(expressions, f.Expressions...)
+	if len(expressions) == 0 {
+		return fmt.Errorf("at least one of the '%s' or '%s' properties is required for this function", "expression", "expressions")
+	}
+	for i, env := range f.Env {
+		if env.Name == "" {
+			return fmt.Errorf("the '%s' property is required for environment variable #%d", "name", i)
+		}
+	}
+
+	yqMutex.Lock()
+	yqlib.InitExpressionParser()
+	var parsed []*yqlib.ExpressionNode
+	for i, expression := range expressions {
+		if node, err := yqlib.ExpressionParser.ParseExpression(expression); err != nil {
+			yqMutex.Unlock()
+			return fmt.Errorf("invalid expression #%d: %w", i, err)
+		} else if err := f.resolveEnv(node); err != nil {
+			yqMutex.Unlock()
+			return fmt.Errorf("invalid expression #%d: %w", i, err)
+		} else {
+			parsed = append(parsed, node)
+		}
 	}
+	yqMutex.Unlock()
+
+	var s stream.Stream
+	if f.EvaluateAll {
+		var matching, others []*yaml.Node
+		collector := stream.NewStream().
+			Generate(FromReader(r)).
+			Process(func(_ context.Context, node *yaml.Node) error {
+				if matchesTargetingFilters(node, f.Includes, f.Excludes) {
+					matching = append(matching, node)
+				} else {
+					others = append(others, node)
+				}
+				return nil
+			}).
+			Sink(ToWriter(io.Discard))
+		if err := collector.Execute(context.Background()); err != nil {
+			return fmt.Errorf("failed executing stream: %w", err)
+		}
 
-	cmd := exec.CommandContext(context.Background(), "yq", f.Expression)
-	cmd.Stdin = r
-	cmd.Stdout = w
-	cmd.Stderr = os.Stderr
-	cmd.Dir = pwd
-	logger.Printf("Starting process: %v", cmd.Args)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run process: %w", err)
+		results, err := f.evaluate(expressions, parsed, matching)
+		if err != nil {
+			return err
+		}
+		s = stream.NewStream().
+			Generate(func(_ context.Context, target chan *yaml.Node) error {
+				for _, node := range append(others, results...) {
+					target <- node
+				}
+				return nil
+			}).
+			Sink(&optionalWriterSink{w: w})
+	} else {
+		s = stream.NewStream().
+			Generate(FromReader(r)).
+			Transform(func(_ context.Context, node *yaml.Node, output chan *yaml.Node) error {
+				if !matchesTargetingFilters(node, f.Includes, f.Excludes) {
+					output <- node
+					return nil
+				}
+				results, err := f.evaluate(expressions, parsed, []*yaml.Node{node})
+				if err != nil {
+					return fmt.Errorf("failed evaluating %s: %w", describeResource(node), err)
+				}
+				for _, result := range results {
+					output <- result
+				}
+				return nil
+			}).
+			Sink(&optionalWriterSink{w: w})
+	}
+	if err := s.Execute(context.Background()); err != nil {
+		return fmt.Errorf("failed executing stream: %w", err)
 	}
 	return nil
 }
+
+// evaluate evaluates the given expressions in order over the given nodes (each evaluated over the results of the
+// previous one), returning the results of the last expression. Nodes are evaluated as separate documents, so that
+// document-aware operators (e.g. "di" or cross-document merges) behave as they do in yq itself. Since results replace
+// the evaluated resources, results that are not mappings (e.g. scalars produced by ".metadata.name") are rejected.
+func (f *YQ) evaluate(expressions []string, parsed []*yqlib.ExpressionNode, nodes []*yaml.Node) ([]*yaml.Node, error) {
+	yqMutex.Lock()
+	defer yqMutex.Unlock()
+
+	candidates := list.New()
+	for i, node := range nodes {
+		document := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{node}}
+		candidates.PushBack(&yqlib.CandidateNode{Node: document, Document: uint(i), EvaluateTogether: true})
+	}
+
+	navigator := yqlib.NewDataTreeNavigator()
+	for i, expression := range parsed {
+		result, err := navigator.GetMatchingNodes(yqlib.Context{MatchingNodes: candidates}, expression)
+		if err != nil {
+			return nil, fmt.Errorf("expression #%d failed: %w", i, err)
+		}
+		candidates = result.MatchingNodes
+	}
+
+	var results []*yaml.Node
+	for e := candidates.Front(); e != nil; e = e.Next() {
+		node := e.Value.(*yqlib.CandidateNode).Node
+		if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+			node = node.Content[0]
+		}
+		if node.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("expression '%s' produced %s instead of a resource (expressions must return the resources themselves, e.g. using assignments like '.a = \"b\"')", expressions[len(expressions)-1], describeYQResult(node))
+		}
+		results = append(results, node)
+	}
+	return results, nil
+}
+
+// describeYQResult returns a short description of the given non-mapping result, for error messages.
+func describeYQResult(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return fmt.Sprintf("a scalar ('%s')", node.Value)
+	case yaml.SequenceNode:
+		return "a sequence"
+	case yaml.AliasNode:
+		return "an alias"
+	default:
+		return "an empty document"
+	}
+}
+
+// resolveEnv replaces the "env" & "strenv" operators in the given parsed expression with the values of the variables
+// they reference, taken from the function's "env" property, or from the process environment. The yq library reads
+// these operators' variables from the process environment when evaluating them, so resolving them beforehand lets the
+// function provide its own variables without setting them on the process (where they would be visible to other steps
+// running concurrently in the same process, when builtin functions are run inline). The "envsubst" operator cannot be
+// resolved this way, and is therefore rejected when the "env" property is used. Callers must hold yqMutex.
+func (f *YQ) resolveEnv(node *yqlib.ExpressionNode) error {
+	if node == nil || node.Operation == nil {
+		return nil
+	}
+	switch operationType := node.Operation.OperationType.Type; {
+	case operationType == "ENV":
+		name := node.Operation.CandidateNode.Node.Value
+		value, found := os.LookupEnv(name)
+		for _, env := range f.Env {
+			if env.Name == name {
+				value, found = env.Value, true
+			}
+		}
+
+		var resolved *yaml.Node
+		if node.Operation.Preferences != nil && reflect.ValueOf(node.Operation.Preferences).FieldByName("StringValue").Bool() {
+			resolved = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+		} else if !found || value == "" {
+			return fmt.Errorf("value for env variable '%s' not provided in env()", name)
+		} else {
+			document := &yaml.Node{}
+			if err := yaml.Unmarshal([]byte(value), document); err != nil {
+				return fmt.Errorf("invalid value for env variable '%s': %w", name, err)
+			} else if len(document.Content) == 0 {
+				return fmt.Errorf("value for env variable '%s' not provided in env()", name)
+			}
+			resolved = document.Content[0]
+		}
+
+		// The yq library offers no way to create value operations directly, so a parsed "null" literal is used instead
+		replacement, err := yqlib.ExpressionParser.ParseExpression("null")
+		if err != nil {
+			return fmt.Errorf("failed creating value for env variable '%s': %w", name, err)
+		}
+		replacement.Operation.CandidateNode = &yqlib.CandidateNode{Node: resolved}
+		*node = *replacement
+		return nil
+	case strings.HasPrefix(operationType, "ENVSUBST") && len(f.Env) > 0:
+		return fmt.Errorf("the 'envsubst' operator cannot be used along with the '%s' property (use 'strenv' instead)", "env")
+	}
+	if err := f.resolveEnv(node.LHS); err != nil {
+		return err
+	}
+	return f.resolveEnv(node.RHS)
+}
@@ -17,6 +17,9 @@ const ConfigFile = ConfigFileDir + "/" + ConfigFileName
 const DockerCacheDir = "/workspace/.cache"
 const DockerTempDir = "/workspace/.temp"
 
+// OfflineEnvVar is the environment variable through which containerized functions are told that the build is offline.
+const OfflineEnvVar = "KUDE_OFFLINE"
+
 type Function interface {
 	Invoke(logger *log.Logger, pwd, cacheDir, tempDir string, r io.Reader, w io.Writer) error
 }
@@ -30,6 +33,10 @@ type FunctionInvoker struct {
 	CacheDir       string
 	TempDir        string
 	Viper          *viper.Viper
+
+	// Offline forces the "offline" property of the function (for functions that have one) to true, as done for every
+	// function of an offline build. Containerized functions receive it via the OfflineEnvVar environment variable.
+	Offline bool
 }
 
 func (f *FunctionInvoker) Invoke(input io.Reader, output io.Writer, opts ...viper.DecoderConfigOption) error {
@@ -81,6 +88,9 @@ func (f *FunctionInvoker) Invoke(input io.Reader, output io.Writer, opts ...vipe
 			return fmt.Errorf("failed reading configuration: %w", err)
 		}
 	}
+	if f.Offline || os.Getenv(OfflineEnvVar) == "true" {
+		v.Set("offline", true)
+	}
 	if err := v.Unmarshal(f.Function, opts...); err != nil {
 		return fmt.Errorf("unable to decode configuration: %w", err)
 	} else if err := f.Function.Invoke(logger, pwd, cacheDir, tempDir, input, output); err != nil {
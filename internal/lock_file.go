@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AcquireLockFile acquires an exclusive lock by creating the given lock file, waiting (up to the given timeout) for
+// other processes holding it to release it. Lock files older than the given stale age are considered abandoned (e.g.
+// by a crashed process), and are removed; while the lock is held, its modification time is refreshed periodically, so
+// that long operations (e.g. slow downloads) are never mistaken for abandoned ones. The returned function releases the
+// lock.
+func AcquireLockFile(logger *log.Logger, path string, timeout, staleAge time.Duration) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed creating directory '%s': %w", filepath.Dir(path), err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			file.Close()
+			return refreshLockFile(path, staleAge/4), nil
+		} else if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("failed creating lock file '%s': %w", path, err)
+		}
+
+		if stat, err := os.Stat(path); err == nil && time.Since(stat.ModTime()) > staleAge {
+			logger.Printf("Removing stale lock file: %s", path)
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("failed removing stale lock file '%s': %w", path, err)
+			}
+			continue
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock file '%s'", path)
+		} else if !waiting {
+			logger.Printf("Waiting for lock file: %s", path)
+			waiting = true
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// refreshLockFile updates the modification time of the given (held) lock file at the given interval, until the
+// returned function is called - which stops refreshing it, and removes it.
+func refreshLockFile(path string, interval time.Duration) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				_ = os.Chtimes(path, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		os.Remove(path)
+	}
+}
@@ -42,3 +42,40 @@ func FormatYAML(yamlString io.Reader) (string, error) {
 	encoder.Close()
 	return formatted.String(), nil
 }
+
+// MappingField returns the value of the given key in the given mapping node, or nil if the node is not a mapping or
+// does not contain the key.
+func MappingField(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// RemoveMappingKey removes the given key (and its value) from the given mapping node, if it exists.
+func RemoveMappingKey(node *yaml.Node, key string) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// CopyNode returns a deep copy of the given node.
+func CopyNode(node *yaml.Node) *yaml.Node {
+	c := *node
+	c.Content = make([]*yaml.Node, len(node.Content))
+	for i, child := range node.Content {
+		c.Content[i] = CopyNode(child)
+	}
+	return &c
+}
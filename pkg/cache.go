@@ -0,0 +1,187 @@
+package kude
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/arikkfir/kude/internal"
+	"github.com/hashicorp/go-getter/v2"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CacheDirEnvVar is the environment variable used to override the default cache directory.
+	CacheDirEnvVar = "KUDE_CACHE_DIR"
+
+	// DefaultCacheTTL is the default amount of time downloaded resources are reused before being downloaded again.
+	DefaultCacheTTL = 24 * time.Hour
+
+	// cacheLockTimeout is the maximum amount of time to wait for another process to finish downloading the same entry.
+	cacheLockTimeout = 10 * time.Minute
+
+	// cacheStaleLockAge is the age after which an entry's lock file is considered abandoned (e.g. by a crashed process).
+	cacheStaleLockAge = 15 * time.Minute
+)
+
+// immutableRefRE matches go-getter URLs whose "ref" is a full Git commit SHA; such downloads never change, and are
+// therefore cached indefinitely.
+var immutableRefRE = regexp.MustCompile(`[?&]ref=[0-9a-f]{40}(&|$)`)
+
+// Cache is a download cache for remote resources, shared across builds. Entries are keyed by their normalized source
+// URL (including its ref), and are reused until they expire; entries pinned to a Git commit never expire.
+type Cache struct {
+	dir       string
+	ttl       time.Duration
+	refresh   bool
+	mutex     sync.Mutex
+	locks     map[string]*sync.Mutex
+	refreshed map[string]bool
+}
+
+// DefaultCacheDir returns the cache directory to use - the value of the KUDE_CACHE_DIR environment variable if set,
+// or a "kude" directory in the user's cache directory ($XDG_CACHE_HOME or ~/.cache on Linux) otherwise.
+func DefaultCacheDir() (string, error) {
+	if dir := os.Getenv(CacheDirEnvVar); dir != "" {
+		return dir, nil
+	}
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed resolving user cache directory: %w", err)
+	}
+	return filepath.Join(userCacheDir, "kude"), nil
+}
+
+// NewCache creates a download cache in the given directory. Entries older than the given TTL are downloaded again;
+// if refresh is true, all entries are downloaded again (once per build).
+func NewCache(dir string, ttl time.Duration, refresh bool) *Cache {
+	return &Cache{
+		dir:       dir,
+		ttl:       ttl,
+		refresh:   refresh,
+		locks:     make(map[string]*sync.Mutex),
+		refreshed: make(map[string]bool),
+	}
+}
+
+// get copies the cached copy of the given URL to the given destination path, and returns the path of the copy. The
+// URL is downloaded first (using the given getters, or the default ones if nil) if it's not cached yet, or if the
+// cached copy expired. Concurrent requests for the same URL wait for each other, rather than downloading twice -
+// whether they come from this process, or from other processes sharing the cache directory (which are excluded using
+// a lock file per entry). The entry is copied while the lock is still held, since once it is released, another
+// process may replace the entry at any time.
+func (c *Cache) get(ctx context.Context, logger *log.Logger, url, pwd, dst string, getters []getter.Getter) (string, error) {
+	key := cacheKey(url)
+	lock := c.lock(key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	unlock, err := internal.AcquireLockFile(logger, filepath.Join(c.dir, "locks", key+".lock"), cacheLockTimeout, cacheStaleLockAge)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	entryDir := filepath.Join(c.dir, "downloads", key)
+	contentPath := filepath.Join(entryDir, "content")
+	if stat, err := os.Stat(contentPath); err == nil {
+		if !c.mustRefresh(key) && (immutableRefRE.MatchString(url) || time.Since(stat.ModTime()) < c.ttl) {
+			return c.copy(ctx, url, contentPath, dst, getters)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to stat '%s': %w", contentPath, err)
+	}
+
+	// Download into a temporary sibling directory, and only then swap it into place, so that readers never see a
+	// partially downloaded entry
+	if err := os.MkdirAll(filepath.Dir(entryDir), 0755); err != nil {
+		return "", fmt.Errorf("failed creating cache directory: %w", err)
+	}
+	tempDir, err := os.MkdirTemp(filepath.Dir(entryDir), key+".tmp-")
+	if err != nil {
+		return "", fmt.Errorf("failed creating temporary cache directory: %w", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	client := getter.Client{Getters: getters}
+	req := getter.Request{Src: url, Dst: filepath.Join(tempDir, "content"), Pwd: pwd, GetMode: getter.ModeAny}
+	if _, err := client.Get(ctx, &req); err != nil {
+		return "", fmt.Errorf("failed to download '%s': %w", redactURL(url), redactError(err))
+	}
+	if err := os.RemoveAll(entryDir); err != nil {
+		return "", fmt.Errorf("failed removing stale cache entry '%s': %w", entryDir, err)
+	} else if err := os.Rename(tempDir, entryDir); err != nil {
+		return "", fmt.Errorf("failed storing cache entry '%s': %w", entryDir, err)
+	}
+
+	// Entry age is tracked by the modification time of its content
+	now := time.Now()
+	if err := os.Chtimes(contentPath, now, now); err != nil {
+		return "", fmt.Errorf("failed updating cache entry '%s': %w", entryDir, err)
+	}
+
+	c.mutex.Lock()
+	c.refreshed[key] = true
+	c.mutex.Unlock()
+	return c.copy(ctx, url, contentPath, dst, getters)
+}
+
+// copy copies the given cache entry content to the given destination path, and returns the path of the copy.
+func (c *Cache) copy(ctx context.Context, url, contentPath, dst string, getters []getter.Getter) (string, error) {
+	client := getter.Client{Getters: getters}
+	req := getter.Request{Src: contentPath, Dst: dst, Copy: true, GetMode: getter.ModeAny}
+	if result, err := client.Get(ctx, &req); err != nil {
+		return "", fmt.Errorf("failed copying cached copy of '%s': %w", url, err)
+	} else {
+		return result.Dst, nil
+	}
+}
+
+// mustRefresh checks whether the given cache key must be downloaded again regardless of its age. When refreshing,
+// each entry is only downloaded once per build, even if it's used by multiple resources or packages.
+func (c *Cache) mustRefresh(key string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.refresh && !c.refreshed[key]
+}
+
+// lock returns the mutex guarding the given cache key.
+func (c *Cache) lock(key string) *sync.Mutex {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if lock, found := c.locks[key]; found {
+		return lock
+	}
+	lock := &sync.Mutex{}
+	c.locks[key] = lock
+	return lock
+}
+
+// cacheKey returns the cache key of the given URL.
+func cacheKey(url string) string {
+	hash := sha256.Sum256([]byte(normalizeURL(url)))
+	return hex.EncodeToString(hash[:])
+}
+
+// normalizeURL normalizes the given go-getter URL, so that equivalent URLs share the same cache entry - surrounding
+// whitespace & trailing slashes are removed, and query parameters are sorted.
+func normalizeURL(url string) string {
+	base, query, _ := strings.Cut(strings.TrimSpace(url), "?")
+	if !strings.HasSuffix(base, "//") {
+		base = strings.TrimRight(base, "/")
+	}
+	if query == "" {
+		return base
+	}
+	params := strings.Split(query, "&")
+	sort.Strings(params)
+	return base + "?" + strings.Join(params, "&")
+}
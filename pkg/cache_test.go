@@ -0,0 +1,117 @@
+package kude
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/kude/internal"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheGet(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	repo := t.TempDir()
+	if err := os.WriteFile(filepath.Join(repo, "file.yaml"), []byte("foo: bar\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "-A"}, {"commit", "-q", "-m", "initial"}} {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+	}
+	url := "git::file://" + filepath.ToSlash(repo)
+	dir := t.TempDir()
+	logger := log.New(&internal.TestWriter{T: t}, "", 0)
+
+	copies := t.TempDir()
+	dst := func(name string) string { return filepath.Join(copies, name) }
+
+	// Concurrent requests for the same URL must share a single cache entry, each receiving its own copy of it
+	cache := NewCache(dir, time.Hour, false)
+	wg := sync.WaitGroup{}
+	paths := make([]string, 5)
+	errs := make([]error, 5)
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], errs[i] = cache.get(context.Background(), logger, url, "", dst(fmt.Sprintf("shared-%d", i)), nil)
+		}(i)
+	}
+	wg.Wait()
+	for i := range paths {
+		if errs[i] != nil {
+			t.Fatalf("failed getting cached copy: %v", errs[i])
+		} else if b, err := os.ReadFile(filepath.Join(paths[i], "file.yaml")); err != nil {
+			t.Fatalf("failed reading cached file: %v", err)
+		} else if string(b) != "foo: bar\n" {
+			t.Errorf("unexpected cached content: %s", b)
+		}
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "downloads")); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Errorf("expected a single cache entry without leftover temporary directories, found %d", len(entries))
+	}
+
+	// Separate caches sharing the directory (as separate processes would) must not clobber each other's downloads,
+	// nor the copies handed out before
+	for i := range paths {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = NewCache(dir, time.Hour, true).get(context.Background(), logger, url, "", dst(fmt.Sprintf("refreshed-%d", i)), nil)
+		}(i)
+	}
+	wg.Wait()
+	for i := range errs {
+		if errs[i] != nil {
+			t.Errorf("failed refreshing cached copy concurrently: %v", errs[i])
+		} else if _, err := os.Stat(filepath.Join(paths[i], "file.yaml")); err != nil {
+			t.Errorf("expected copy to survive a refresh of its cache entry: %v", err)
+		}
+	}
+
+	// Fresh entries must be served from the cache, even if the source is gone (equivalent URLs included)
+	if err := os.RemoveAll(repo); err != nil {
+		t.Fatal(err)
+	} else if _, err := NewCache(dir, time.Hour, false).get(context.Background(), logger, url+"/", "", dst("cached"), nil); err != nil {
+		t.Errorf("expected cached copy to be used, got: %v", err)
+	}
+
+	// Expired or refreshed entries must be downloaded again
+	if _, err := NewCache(dir, 0, false).get(context.Background(), logger, url, "", dst("expired"), nil); err == nil {
+		t.Errorf("expected expired entry to be downloaded again, got nil")
+	} else if !strings.Contains(err.Error(), "failed to download") {
+		t.Errorf("unexpected error: %v", err)
+	} else if _, err := NewCache(dir, time.Hour, true).get(context.Background(), logger, url, "", dst("refreshed"), nil); err == nil {
+		t.Errorf("expected refreshed entry to be downloaded again, got nil")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "downloads", cacheKey(url), "content", "file.yaml")); err != nil {
+		t.Errorf("expected failed downloads to retain the previous cache entry: %v", err)
+	}
+}
+
+func TestNormalizeURL(t *testing.T) {
+	testCases := map[string]string{
+		" github.com/a/b/ ":             "github.com/a/b",
+		"github.com/a/b?ref=v1&depth=1": "github.com/a/b?depth=1&ref=v1",
+		"github.com/a/b//":              "github.com/a/b//",
+	}
+	for url, expected := range testCases {
+		if actual := normalizeURL(url); actual != expected {
+			t.Errorf("expected '%s' for '%s', got '%s'", expected, url, actual)
+		}
+	}
+}
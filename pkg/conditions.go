@@ -0,0 +1,102 @@
+package kude
+
+import (
+	"fmt"
+	"github.com/antonmedv/expr"
+	"github.com/antonmedv/expr/ast"
+	"github.com/blang/semver"
+	"os"
+	"strings"
+)
+
+// conditionEnvironment returns the variables available to step "when" expressions:
+//
+//   - "params" holds the pipeline's parameter values
+//   - "env" holds the environment variables of the Kude process
+//   - "kude.version" holds the running Kude version
+//
+// as well as the "semver(version, range)" function, which checks whether a version satisfies a range (e.g. ">=1.2.0").
+func conditionEnvironment(parameters map[string]interface{}) map[string]interface{} {
+	env := make(map[string]interface{})
+	for _, entry := range os.Environ() {
+		if name, value, found := strings.Cut(entry, "="); found {
+			env[name] = value
+		}
+	}
+	if parameters == nil {
+		parameters = make(map[string]interface{})
+	}
+	return map[string]interface{}{
+		"params": parameters,
+		"env":    env,
+		"kude":   map[string]interface{}{"version": GetVersion().String()},
+		"semver": func(version, versionRange string) (bool, error) {
+			v, err := semver.ParseTolerant(version)
+			if err != nil {
+				return false, fmt.Errorf("invalid version '%s': %w", version, err)
+			}
+			r, err := semver.ParseRange(versionRange)
+			if err != nil {
+				return false, fmt.Errorf("invalid version range '%s': %w", versionRange, err)
+			}
+			return r(v), nil
+		},
+	}
+}
+
+// evaluateCondition evaluates the given "when" expression, which must result in a boolean value. An empty expression
+// is always true. Referencing an unknown variable, parameter or property (e.g. a typo such as "params.debgu") is an
+// error rather than a silent nil; environment variables are exempt, since testing for a missing one is legitimate.
+func evaluateCondition(condition string, environment map[string]interface{}) (bool, error) {
+	if strings.TrimSpace(condition) == "" {
+		return true, nil
+	}
+	references := &undefinedReferences{environment: environment}
+	program, err := expr.Compile(condition, expr.Env(environment), expr.AsBool(), expr.Patch(references))
+	if err != nil {
+		return false, fmt.Errorf("invalid condition '%s': %w", condition, err)
+	} else if len(references.undefined) > 0 {
+		return false, fmt.Errorf("invalid condition '%s': undefined references: %s", condition, strings.Join(references.undefined, ", "))
+	}
+	result, err := expr.Run(program, environment)
+	if err != nil {
+		return false, fmt.Errorf("failed evaluating condition '%s': %w", condition, err)
+	}
+	return result.(bool), nil
+}
+
+// undefinedReferences is an expression visitor collecting references to keys missing from the condition environment's
+// maps (e.g. "params.debgu" or `params["debgu"]`), which the expression compiler cannot detect on its own.
+type undefinedReferences struct {
+	environment map[string]interface{}
+	undefined   []string
+}
+
+func (v *undefinedReferences) Enter(_ *ast.Node) {}
+
+func (v *undefinedReferences) Exit(node *ast.Node) {
+	var target ast.Node
+	var key string
+	switch n := (*node).(type) {
+	case *ast.PropertyNode:
+		target, key = n.Node, n.Property
+	case *ast.IndexNode:
+		if index, ok := n.Index.(*ast.StringNode); ok {
+			target, key = n.Node, index.Value
+		} else {
+			return
+		}
+	default:
+		return
+	}
+
+	identifier, ok := target.(*ast.IdentifierNode)
+	if !ok || identifier.Value == "env" {
+		return
+	}
+	if values, ok := v.environment[identifier.Value].(map[string]interface{}); ok {
+		if _, found := values[key]; !found {
+			v.undefined = append(v.undefined, identifier.Value+"."+key)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package kude
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEvaluateCondition(t *testing.T) {
+	t.Setenv("KUDE_TEST_CONDITION", "on")
+	env := conditionEnvironment(map[string]interface{}{"environment": "dev", "replicas": 3})
+
+	testCases := map[string]struct {
+		condition     string
+		expected      bool
+		expectedError string
+	}{
+		"empty":              {condition: "", expected: true},
+		"parameter equals":   {condition: `params.environment == "dev"`, expected: true},
+		"parameter compare":  {condition: `params.replicas > 5`, expected: false},
+		"environment":        {condition: `env.KUDE_TEST_CONDITION == "on"`, expected: true},
+		"missing env":        {condition: `env.KUDE_TEST_MISSING == "on"`, expected: false},
+		"version":            {condition: `semver(kude.version, ">=0.0.0-0")`, expected: true},
+		"invalid range":      {condition: `semver(kude.version, "bad")`, expectedError: "invalid version range 'bad'"},
+		"not boolean":        {condition: `params.environment`, expectedError: "invalid condition"},
+		"invalid expression": {condition: `params.environment ==`, expectedError: "invalid condition"},
+		"unknown parameter":  {condition: `params.enviroment == "dev"`, expectedError: "undefined references: params.enviroment"},
+		"unknown index":      {condition: `params["enviroment"] == "dev"`, expectedError: "undefined references: params.enviroment"},
+		"unknown variable":   {condition: `parms.environment == "dev"`, expectedError: "invalid condition"},
+		"unknown property":   {condition: `kude.versoin != ""`, expectedError: "undefined references: kude.versoin"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if actual, err := evaluateCondition(tc.condition, env); tc.expectedError != "" {
+				if err == nil {
+					t.Errorf("expected error containing '%s', got nil", tc.expectedError)
+				} else if !strings.Contains(err.Error(), tc.expectedError) {
+					t.Errorf("expected error containing '%s', got: %v", tc.expectedError, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			} else if actual != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
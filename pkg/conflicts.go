@@ -0,0 +1,85 @@
+package kude
+
+import (
+	"fmt"
+	"github.com/arikkfir/kyaml/pkg"
+	"gopkg.in/yaml.v3"
+	kustomizeyaml "sigs.k8s.io/kustomize/kyaml/yaml"
+	"sigs.k8s.io/kustomize/kyaml/yaml/merge2"
+)
+
+// Conflict policies, determining what happens when a pipeline emits more than one resource with the same apiVersion,
+// kind, namespace & name.
+const (
+	// ConflictPolicyError fails the pipeline.
+	ConflictPolicyError = "error"
+
+	// ConflictPolicyFirst keeps the first resource, discarding the rest.
+	ConflictPolicyFirst = "first"
+
+	// ConflictPolicyLast keeps the last resource, discarding the rest (the default).
+	ConflictPolicyLast = "last"
+
+	// ConflictPolicyMerge strategically merges each resource into the resource emitted before it.
+	ConflictPolicyMerge = "merge"
+)
+
+var conflictPolicies = []string{ConflictPolicyError, ConflictPolicyFirst, ConflictPolicyLast, ConflictPolicyMerge}
+
+// resolveConflict resolves a conflict between a collated resource and a later resource with the same identity,
+// according to the given policy, returning the resource to keep in place of the collated one.
+func resolveConflict(policy string, existing, rn *kyaml.RNode) (*kyaml.RNode, error) {
+	switch policy {
+	case ConflictPolicyFirst:
+		return existing, nil
+	case ConflictPolicyLast:
+		return rn, nil
+	case ConflictPolicyMerge:
+		if merged, err := strategicMerge(existing, rn); err != nil {
+			return nil, fmt.Errorf("failed merging duplicate resource: %w", err)
+		} else {
+			return merged, nil
+		}
+	default:
+		if source, err := GetResourceSource(existing); err != nil || source == nil {
+			return nil, fmt.Errorf("duplicate resource (set the pipeline's 'onConflict' property to allow it)")
+		} else {
+			return nil, fmt.Errorf("duplicate resource, also defined at %s (set the pipeline's 'onConflict' property to allow it)", source)
+		}
+	}
+}
+
+// strategicMerge merges the given patch resource into the given base resource, the way "kubectl apply" & Kustomize
+// do: mappings are merged recursively, lists of objects are merged by their identifying key (e.g. containers by
+// name), and values of the patch take precedence. The source location of the base resource is retained.
+func strategicMerge(base, patch *kyaml.RNode) (*kyaml.RNode, error) {
+	source, err := base.GetAnnotation(SourceAnnotationName)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting annotation: %w", err)
+	}
+
+	baseYAML, err := yaml.Marshal(base.N)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding resource: %w", err)
+	}
+	patchYAML, err := yaml.Marshal(patch.N)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding resource: %w", err)
+	}
+	mergedYAML, err := merge2.MergeStrings(string(patchYAML), string(baseYAML), true, kustomizeyaml.MergeOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	merged := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(mergedYAML), merged); err != nil {
+		return nil, fmt.Errorf("failed decoding merged resource: %w", err)
+	}
+	rn := &kyaml.RNode{N: documentContent(merged)}
+	if source != "" {
+		if err := rn.SetAnnotation(SourceAnnotationName, source); err != nil {
+			return nil, fmt.Errorf("failed setting annotation: %w", err)
+		}
+	}
+	return rn, nil
+}
@@ -0,0 +1,544 @@
+package kude
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/types"
+	"sort"
+	"strings"
+)
+
+// kudeFunctionsImagePrefix is the common prefix of the images of Kude's own functions.
+const kudeFunctionsImagePrefix = "ghcr.io/arikkfir/kude/functions/"
+
+// convertedPipeline is the pipeline manifest produced by converting a kustomization. It is separate from pipelineImpl
+// so that empty properties are omitted from the generated manifest.
+type convertedPipeline struct {
+	APIVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Resources  []string         `yaml:"resources,omitempty"`
+	Steps      []*convertedStep `yaml:"steps,omitempty"`
+}
+
+type convertedStep struct {
+	Image  string                 `yaml:"image"`
+	Config map[string]interface{} `yaml:"config"`
+	Mounts []string               `yaml:"mounts,omitempty"`
+}
+
+// kustomizationConverter translates a kustomization into a pipeline, collecting notes about anything it could not
+// translate (or translated only partially) along the way.
+type kustomizationConverter struct {
+	dir      string
+	pipeline *convertedPipeline
+	notes    []string
+}
+
+// ConvertKustomization translates the kustomization in the given directory into an equivalent Kude pipeline manifest.
+// Resources are kept as-is, generators are translated to "create-configmap" & "create-secret" steps, common labels,
+// annotations & namespace to "label", "annotate" & "set-namespace" steps, patches to "patch" steps, images to a
+// "set-image" step, and replacements to a "replacements" step. Kustomization features that could not be translated are returned as human-readable notes.
+func ConvertKustomization(dir string) ([]byte, []string, error) {
+	var kustomizationFile string
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			kustomizationFile = filepath.Join(dir, name)
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, nil, fmt.Errorf("failed to stat '%s': %w", filepath.Join(dir, name), err)
+		}
+	}
+	if kustomizationFile == "" {
+		return nil, nil, fmt.Errorf("no kustomization file found in '%s'", dir)
+	}
+
+	b, err := os.ReadFile(kustomizationFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed reading '%s': %w", kustomizationFile, err)
+	}
+	k := &types.Kustomization{}
+	if err := k.Unmarshal(b); err != nil {
+		return nil, nil, fmt.Errorf("failed parsing '%s': %w", kustomizationFile, err)
+	}
+	k.FixKustomizationPostUnmarshalling()
+	if k.Kind == types.ComponentKind {
+		return nil, nil, fmt.Errorf("'%s' is a Kustomize component, which cannot be converted to a pipeline", kustomizationFile)
+	}
+
+	c := &kustomizationConverter{dir: dir, pipeline: &convertedPipeline{APIVersion: PipelineAPIVersion, Kind: PipelineKind}}
+	c.convertResources(k.Resources)
+	for _, generator := range k.ConfigMapGenerator {
+		c.convertGenerator("create-configmap", "ConfigMap", generator.GeneratorArgs, "", k.GeneratorOptions)
+	}
+	for _, generator := range k.SecretGenerator {
+		c.convertGenerator("create-secret", "Secret", generator.GeneratorArgs, generator.Type, k.GeneratorOptions)
+	}
+	if err := c.convertStrategicMergePatches(k.PatchesStrategicMerge); err != nil {
+		return nil, nil, err
+	}
+	if err := c.convertPatches("patches", k.Patches); err != nil {
+		return nil, nil, err
+	}
+	if err := c.convertPatches("patchesJson6902", k.PatchesJson6902); err != nil {
+		return nil, nil, err
+	}
+	if k.Namespace != "" {
+		c.addStep("set-namespace", map[string]interface{}{"namespace": k.Namespace})
+	}
+	c.convertLabels(k.CommonLabels, true)
+	for i, label := range k.Labels {
+		if len(label.FieldSpecs) > 0 {
+			c.note("labels #%d: custom label fields are not supported; labels were only applied to their default fields", i)
+		}
+		c.convertLabels(label.Pairs, label.IncludeSelectors)
+	}
+	for _, name := range sortedKeys(k.CommonAnnotations) {
+		c.addStep("annotate", map[string]interface{}{"name": name, "value": k.CommonAnnotations[name]})
+	}
+	c.convertImages(k.Images)
+	if err := c.convertReplacements(k.Replacements); err != nil {
+		return nil, nil, err
+	}
+	c.noteUnsupportedFields(k)
+
+	var output bytes.Buffer
+	encoder := yaml.NewEncoder(&output)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c.pipeline); err != nil {
+		return nil, nil, fmt.Errorf("failed encoding pipeline: %w", err)
+	} else if err := encoder.Close(); err != nil {
+		return nil, nil, fmt.Errorf("failed encoding pipeline: %w", err)
+	}
+	return output.Bytes(), c.notes, nil
+}
+
+func (c *kustomizationConverter) note(format string, args ...interface{}) {
+	c.notes = append(c.notes, fmt.Sprintf(format, args...))
+}
+
+func (c *kustomizationConverter) addStep(function string, config map[string]interface{}, mounts ...string) {
+	step := &convertedStep{Image: kudeFunctionsImagePrefix + function, Config: config, Mounts: mounts}
+	c.pipeline.Steps = append(c.pipeline.Steps, step)
+}
+
+// convertResources copies the kustomization's resources as-is. Local resources (files, Kude packages & kustomizations)
+// are read the same way by Kude, but remote resources use Kustomize's URL format, which might need adjusting.
+func (c *kustomizationConverter) convertResources(resources []string) {
+	for _, resource := range resources {
+		c.pipeline.Resources = append(c.pipeline.Resources, resource)
+		if _, err := os.Stat(filepath.Join(c.dir, resource)); err != nil {
+			c.note("resources: '%s' is not a local path; verify that it is a valid Kude resource URL (see https://github.com/hashicorp/go-getter)", resource)
+		}
+	}
+}
+
+// convertGenerator translates a ConfigMap or Secret generator into a "create-configmap" or "create-secret" step.
+func (c *kustomizationConverter) convertGenerator(function, kind string, args types.GeneratorArgs, secretType string, globalOptions *types.GeneratorOptions) {
+	name := args.Name
+	if args.Behavior != "" && args.Behavior != "create" {
+		c.note("%s '%s': behavior '%s' is not supported; generator was not converted", kind, name, args.Behavior)
+		return
+	}
+
+	var contents []interface{}
+	var mounts []string
+	for _, literal := range args.LiteralSources {
+		key, value, found := strings.Cut(literal, "=")
+		if !found {
+			c.note("%s '%s': literal '%s' has no value (expected 'KEY=VALUE'); literal was not converted", kind, name, literal)
+			continue
+		}
+		contents = append(contents, map[string]interface{}{"key": key, "value": unquoteLiteral(value)})
+	}
+	for _, file := range args.FileSources {
+		key, path, found := strings.Cut(file, "=")
+		if !found {
+			key, path = filepath.Base(file), file
+		}
+		mount, ok := mountPath(path)
+		if !ok {
+			c.note("%s '%s': file '%s' cannot be mounted, since mounts cannot contain ':'; rename it or move it into a directory, and add it manually", kind, name, path)
+			continue
+		}
+		contents = append(contents, map[string]interface{}{"key": key, "path": path})
+		mounts = appendUnique(mounts, mount)
+	}
+	for _, env := range args.EnvSources {
+		c.note("%s '%s': env files are not supported; entries of '%s' were not converted", kind, name, env)
+	}
+
+	config := map[string]interface{}{"name": name}
+	if args.Namespace != "" {
+		config["namespace"] = args.Namespace
+	}
+	if secretType != "" {
+		config["type"] = secretType
+	}
+	if len(contents) > 0 {
+		config["contents"] = contents
+	}
+	for _, options := range []*types.GeneratorOptions{globalOptions, args.Options} {
+		if options == nil {
+			continue
+		} else if options.Immutable {
+			config["immutable"] = true
+		}
+		if len(options.Labels) > 0 || len(options.Annotations) > 0 {
+			c.note("%s '%s': generator labels & annotations are not supported; add 'label' or 'annotate' steps instead", kind, name)
+		}
+		if options.DisableNameSuffixHash {
+			c.note("%s '%s': disabling the name hash suffix is not supported", kind, name)
+		}
+	}
+	c.addStep(function, config, mounts...)
+}
+
+// convertStrategicMergePatches translates the entries of the deprecated "patchesStrategicMerge" field (each a path to
+// a patch file, or an inline patch) into "patch" steps.
+func (c *kustomizationConverter) convertStrategicMergePatches(patches []types.PatchStrategicMerge) error {
+	for _, patch := range patches {
+		if strings.Contains(string(patch), "\n") {
+			if err := c.convertPatch("patchesStrategicMerge", types.Patch{Patch: string(patch)}); err != nil {
+				return err
+			}
+		} else if err := c.convertPatch("patchesStrategicMerge", types.Patch{Path: string(patch)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *kustomizationConverter) convertPatches(field string, patches []types.Patch) error {
+	for _, patch := range patches {
+		if err := c.convertPatch(field, patch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convertPatch translates a patch into one or more "patch" steps. Like Kustomize, the patch type is detected from its
+// contents: a list of operations is a JSON 6902 patch, and anything else is a strategic merge patch. Strategic merge
+// patches without a target apply to the resource they identify, so their identity is translated into the step's
+// includes; files with multiple such patches are split into one (inline) step per patch.
+func (c *kustomizationConverter) convertPatch(field string, patch types.Patch) error {
+	content, source := patch.Patch, "inline patch"
+	if patch.Path != "" {
+		path := filepath.Join(c.dir, patch.Path)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed reading patch '%s': %w", path, err)
+		}
+		content, source = string(b), fmt.Sprintf("patch '%s'", patch.Path)
+	}
+	for option := range patch.Options {
+		c.note("%s: %s: option '%s' is not supported", field, source, option)
+	}
+
+	var documents []*yaml.Node
+	decoder := yaml.NewDecoder(strings.NewReader(content))
+	for {
+		document := &yaml.Node{}
+		if err := decoder.Decode(document); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed parsing %s: %w", source, err)
+		}
+		documents = append(documents, document.Content[0])
+	}
+	if len(documents) == 0 {
+		c.note("%s: %s is empty; patch was not converted", field, source)
+		return nil
+	}
+
+	config := map[string]interface{}{}
+	if documents[0].Kind == yaml.SequenceNode {
+		config["type"] = "json6902"
+	}
+	if patch.Target != nil {
+		config["includes"] = []interface{}{c.convertSelector(field, source, patch.Target)}
+	} else if documents[0].Kind == yaml.SequenceNode {
+		c.note("%s: %s has no target; patch was not converted", field, source)
+		return nil
+	}
+
+	if patch.Target != nil || len(documents) == 1 {
+		if patch.Target == nil {
+			config["includes"] = []interface{}{patchIdentity(documents[0])}
+		}
+		if patch.Path != "" {
+			mount, ok := mountPath(patch.Path)
+			if !ok {
+				c.note("%s: %s cannot be mounted, since mounts cannot contain ':'; patch was not converted", field, source)
+				return nil
+			}
+			config["path"] = patch.Path
+			c.addStep("patch", config, mount)
+		} else {
+			config["patch"] = content
+			c.addStep("patch", config)
+		}
+		return nil
+	}
+	for _, document := range documents {
+		b, err := yaml.Marshal(document)
+		if err != nil {
+			return fmt.Errorf("failed encoding %s: %w", source, err)
+		}
+		c.addStep("patch", map[string]interface{}{"patch": string(b), "includes": []interface{}{patchIdentity(document)}})
+	}
+	return nil
+}
+
+// convertSelector translates a Kustomize patch target into a targeting filter.
+func (c *kustomizationConverter) convertSelector(field, source string, selector *types.Selector) map[string]interface{} {
+	filter := map[string]interface{}{}
+	if selector.Group != "" && selector.Version != "" {
+		filter["apiVersion"] = selector.Group + "/" + selector.Version
+	} else if selector.Version != "" {
+		filter["apiVersion"] = selector.Version
+	} else if selector.Group != "" {
+		c.note("%s: %s: targeting a group without a version is not supported; target group was ignored", field, source)
+	}
+	for key, value := range map[string]string{"kind": selector.Kind, "name": selector.Name, "namespace": selector.Namespace, "labelSelector": selector.LabelSelector} {
+		if value != "" {
+			filter[key] = value
+		}
+	}
+	if selector.AnnotationSelector != "" {
+		c.note("%s: %s: annotation selectors are not supported; target annotation selector was ignored", field, source)
+	}
+	return filter
+}
+
+// patchIdentity returns a targeting filter matching the resource identified by the given strategic merge patch.
+func patchIdentity(patch *yaml.Node) map[string]interface{} {
+	var resource struct {
+		APIVersion string `yaml:"apiVersion"`
+		Kind       string `yaml:"kind"`
+		Metadata   struct {
+			Name      string `yaml:"name"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"metadata"`
+	}
+	_ = patch.Decode(&resource)
+	filter := map[string]interface{}{}
+	for key, value := range map[string]string{"apiVersion": resource.APIVersion, "kind": resource.Kind, "name": resource.Metadata.Name, "namespace": resource.Metadata.Namespace} {
+		if value != "" {
+			filter[key] = value
+		}
+	}
+	return filter
+}
+
+// convertLabels translates the given labels into "label" steps, applied to selectors & pod templates as well if
+// requested (as Kustomize's "commonLabels" always are).
+func (c *kustomizationConverter) convertLabels(labels map[string]string, includeSelectors bool) {
+	for _, name := range sortedKeys(labels) {
+		config := map[string]interface{}{"name": name, "value": labels[name]}
+		if includeSelectors {
+			config["includeSelectors"] = true
+			config["includeTemplates"] = true
+		}
+		c.addStep("label", config)
+	}
+}
+
+func (c *kustomizationConverter) convertImages(images []types.Image) {
+	if len(images) == 0 {
+		return
+	}
+	var entries []interface{}
+	for _, image := range images {
+		entry := map[string]interface{}{"name": image.Name}
+		for key, value := range map[string]string{"newName": image.NewName, "newTag": image.NewTag, "digest": image.Digest} {
+			if value != "" {
+				entry[key] = value
+			}
+		}
+		entries = append(entries, entry)
+	}
+	c.addStep("set-image", map[string]interface{}{"images": entries})
+}
+
+// convertReplacements translates the kustomization's replacements (inline, or read from the files they refer to) into a
+// single "replacements" step.
+func (c *kustomizationConverter) convertReplacements(fields []types.ReplacementField) error {
+	var replacements []types.Replacement
+	for i, field := range fields {
+		if field.Path == "" {
+			replacements = append(replacements, field.Replacement)
+			continue
+		}
+		path := filepath.Join(c.dir, field.Path)
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed reading replacements '%s': %w", path, err)
+		}
+		node := &yaml.Node{}
+		if err := yaml.Unmarshal(b, node); err != nil {
+			return fmt.Errorf("failed parsing replacements '%s': %w", path, err)
+		} else if len(node.Content) == 0 {
+			c.note("replacements #%d: '%s' is empty; replacements were not converted", i, field.Path)
+			continue
+		} else if node.Content[0].Kind == yaml.SequenceNode {
+			var list []types.Replacement
+			if err := node.Content[0].Decode(&list); err != nil {
+				return fmt.Errorf("failed parsing replacements '%s': %w", path, err)
+			}
+			replacements = append(replacements, list...)
+		} else {
+			var replacement types.Replacement
+			if err := node.Content[0].Decode(&replacement); err != nil {
+				return fmt.Errorf("failed parsing replacements '%s': %w", path, err)
+			}
+			replacements = append(replacements, replacement)
+		}
+	}
+
+	var entries []interface{}
+	for i, replacement := range replacements {
+		if replacement.Source == nil {
+			c.note("replacements #%d: no source; replacement was not converted", i)
+			continue
+		}
+		field, source := "replacements", fmt.Sprintf("replacement #%d", i)
+		sourceConfig := c.convertSelector(field, source, &types.Selector{ResId: replacement.Source.ResId})
+		if replacement.Source.FieldPath != "" {
+			sourceConfig["fieldPath"] = replacement.Source.FieldPath
+		}
+		if options := c.convertFieldOptions(source, replacement.Source.Options); len(options) > 0 {
+			sourceConfig["options"] = options
+		}
+
+		var targets []interface{}
+		for j, target := range replacement.Targets {
+			if target == nil || target.Select == nil {
+				c.note("replacements #%d: target #%d has no selector; target was not converted", i, j)
+				continue
+			}
+			targetConfig := map[string]interface{}{"includes": []interface{}{c.convertSelector(field, source, target.Select)}}
+			var excludes []interface{}
+			for _, reject := range target.Reject {
+				excludes = append(excludes, c.convertSelector(field, source, reject))
+			}
+			if len(excludes) > 0 {
+				targetConfig["excludes"] = excludes
+			}
+			if len(target.FieldPaths) > 0 {
+				targetConfig["fieldPaths"] = target.FieldPaths
+			} else {
+				targetConfig["fieldPaths"] = []string{types.DefaultReplacementFieldPath}
+			}
+			if options := c.convertFieldOptions(source, target.Options); len(options) > 0 {
+				targetConfig["options"] = options
+			}
+			targets = append(targets, targetConfig)
+		}
+		if len(targets) == 0 {
+			c.note("replacements #%d: no targets; replacement was not converted", i)
+			continue
+		}
+		entries = append(entries, map[string]interface{}{"source": sourceConfig, "targets": targets})
+	}
+	if len(entries) > 0 {
+		c.addStep("replacements", map[string]interface{}{"replacements": entries})
+	}
+	return nil
+}
+
+// convertFieldOptions translates the options of a replacement source or target.
+func (c *kustomizationConverter) convertFieldOptions(source string, options *types.FieldOptions) map[string]interface{} {
+	config := map[string]interface{}{}
+	if options == nil {
+		return config
+	}
+	if options.Delimiter != "" {
+		config["delimiter"] = options.Delimiter
+		config["index"] = options.Index
+	}
+	if options.Create {
+		config["create"] = true
+	}
+	if options.Encoding != "" {
+		c.note("replacements: %s: option 'encoding' is not supported", source)
+	}
+	return config
+}
+
+// noteUnsupportedFields adds a note for each kustomization field that has no Kude equivalent.
+func (c *kustomizationConverter) noteUnsupportedFields(k *types.Kustomization) {
+	unsupported := []struct {
+		field string
+		set   bool
+	}{
+		{"buildMetadata", len(k.BuildMetadata) > 0},
+		{"components", len(k.Components) > 0},
+		{"configurations", len(k.Configurations) > 0},
+		{"crds", len(k.Crds) > 0},
+		{"generators", len(k.Generators) > 0},
+		{"helmCharts", len(k.HelmCharts) > 0 || k.HelmGlobals != nil},
+		{"inventory", k.Inventory != nil},
+		{"namePrefix", k.NamePrefix != ""},
+		{"nameSuffix", k.NameSuffix != ""},
+		{"openapi", len(k.OpenAPI) > 0},
+		{"replicas", len(k.Replicas) > 0},
+		{"transformers", len(k.Transformers) > 0},
+		{"validators", len(k.Validators) > 0},
+		{"vars", len(k.Vars) > 0},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			c.note("%s: not supported; field was not converted", u.field)
+		}
+	}
+}
+
+// unquoteLiteral removes the quotes surrounding the given literal value, if it's wrapped in a matching pair of single or
+// double quotes (as Kustomize does); other quotes are part of the value.
+func unquoteLiteral(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+// mountPath returns the path to mount for the given file. Since mounts are given as "local:remote", paths containing
+// ':' cannot be mounted as-is; their closest parent directory without ':' is mounted instead (which makes the file
+// available under the same path). If there is no such directory (other than the package directory or the root), false
+// is returned.
+func mountPath(path string) (string, bool) {
+	mount := filepath.Clean(path)
+	for strings.Contains(mount, ":") {
+		mount = filepath.Dir(mount)
+		if mount == "." || mount == string(filepath.Separator) {
+			return "", false
+		}
+	}
+	return mount, true
+}
+
+// appendUnique appends the given value to the given slice, unless it's already in it.
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
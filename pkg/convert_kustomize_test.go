@@ -0,0 +1,324 @@
+package kude
+
+import (
+	"bytes"
+	"context"
+	"github.com/arikkfir/kude/internal"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvertKustomization(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"kustomization.yaml": `apiVersion: kustomize.config.k8s.io/v1beta1
+kind: Kustomization
+namespace: web
+namePrefix: prod-
+commonLabels:
+  app.kubernetes.io/part-of: shop
+commonAnnotations:
+  owner: team-a
+resources:
+  - deployment.yaml
+  - github.com/my-org/my-repo/deploy?ref=v1
+configMapGenerator:
+  - name: settings
+    literals:
+      - color=blue
+    files:
+      - config.properties
+    envs:
+      - settings.env
+secretGenerator:
+  - name: credentials
+    type: kubernetes.io/basic-auth
+    literals:
+      - username=admin
+patchesStrategicMerge:
+  - replicas.yaml
+patches:
+  - target:
+      group: apps
+      version: v1
+      kind: Deployment
+    patch: |
+      - op: add
+        path: /spec/minReadySeconds
+        value: 10
+images:
+  - name: test/test
+    newTag: v1.2.3
+`,
+		"deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: test
+spec:
+  selector:
+    matchLabels:
+      app.kubernetes.io/component: test
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/component: test
+    spec:
+      containers:
+        - image: test/test
+          name: server
+`,
+		"config.properties": "key=value\n",
+		"settings.env":      "SIZE=large\n",
+		"replicas.yaml":     "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: test\nspec:\n  replicas: 3\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, notes, err := ConvertKustomization(dir)
+	if err != nil {
+		t.Fatalf("Conversion failed: %v", err)
+	}
+
+	expected := `apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+resources:
+  - deployment.yaml
+  - github.com/my-org/my-repo/deploy?ref=v1
+steps:
+  - image: ghcr.io/arikkfir/kude/functions/create-configmap
+    config:
+      contents:
+        - key: color
+          value: blue
+        - key: config.properties
+          path: config.properties
+      name: settings
+    mounts:
+      - config.properties
+  - image: ghcr.io/arikkfir/kude/functions/create-secret
+    config:
+      contents:
+        - key: username
+          value: admin
+      name: credentials
+      type: kubernetes.io/basic-auth
+  - image: ghcr.io/arikkfir/kude/functions/patch
+    config:
+      includes:
+        - apiVersion: apps/v1
+          kind: Deployment
+          name: test
+      path: replicas.yaml
+    mounts:
+      - replicas.yaml
+  - image: ghcr.io/arikkfir/kude/functions/patch
+    config:
+      includes:
+        - apiVersion: apps/v1
+          kind: Deployment
+      patch: |
+        - op: add
+          path: /spec/minReadySeconds
+          value: 10
+      type: json6902
+  - image: ghcr.io/arikkfir/kude/functions/set-namespace
+    config:
+      namespace: web
+  - image: ghcr.io/arikkfir/kude/functions/label
+    config:
+      includeSelectors: true
+      includeTemplates: true
+      name: app.kubernetes.io/part-of
+      value: shop
+  - image: ghcr.io/arikkfir/kude/functions/annotate
+    config:
+      name: owner
+      value: team-a
+  - image: ghcr.io/arikkfir/kude/functions/set-image
+    config:
+      images:
+        - name: test/test
+          newTag: v1.2.3
+`
+	if string(manifest) != expected {
+		t.Errorf("Incorrect pipeline manifest; expected:\n%s\nactual:\n%s", expected, manifest)
+	}
+
+	expectedNotes := []string{
+		"resources: 'github.com/my-org/my-repo/deploy?ref=v1' is not a local path; verify that it is a valid Kude resource URL (see https://github.com/hashicorp/go-getter)",
+		"ConfigMap 'settings': env files are not supported; entries of 'settings.env' were not converted",
+		"namePrefix: not supported; field was not converted",
+	}
+	if !reflect.DeepEqual(notes, expectedNotes) {
+		t.Errorf("Incorrect notes; expected:\n%s\nactual:\n%s", strings.Join(expectedNotes, "\n"), strings.Join(notes, "\n"))
+	}
+}
+
+func TestConvertKustomizationProducesWorkingPipeline(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"kustomization.yaml": "resources:\n  - service.yaml\ncommonLabels:\n  app: test\npatchesStrategicMerge:\n  - |-\n    apiVersion: v1\n    kind: Service\n    metadata:\n      name: test\n    spec:\n      type: NodePort\nconfigMapGenerator:\n  - name: settings\n    literals:\n      - color=\"blue\"\n      - empty=\nreplacements:\n  - source:\n      kind: ConfigMap\n      name: settings\n      fieldPath: data.color\n    targets:\n      - select:\n          kind: Service\n        fieldPaths:\n          - metadata.annotations.color\n        options:\n          create: true\n",
+		"service.yaml":       "apiVersion: v1\nkind: Service\nmetadata:\n  name: test\nspec:\n  ports:\n    - port: 80\n  selector:\n    component: web\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, notes, err := ConvertKustomization(dir)
+	if err != nil {
+		t.Fatalf("Conversion failed: %v", err)
+	} else if len(notes) > 0 {
+		t.Errorf("Unexpected notes: %v", notes)
+	} else if err := os.WriteFile(filepath.Join(dir, "kude.yaml"), manifest, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newInliningPipeline(dir)
+	if err != nil {
+		t.Fatalf("Failed loading converted pipeline: %v\n%s", err, manifest)
+	}
+	e, err := NewExecution(p, log.New(&internal.TestWriter{T: t}, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err := e.ExecuteToWriter(context.Background(), out); err != nil {
+		t.Fatalf("Converted pipeline failed: %v\n%s", err, manifest)
+	}
+
+	expected := "apiVersion: v1\ndata:\n  color: blue\n  empty: \"\"\nkind: ConfigMap\nmetadata:\n  annotations:\n    kude.kfirs.com/previous-name: settings\n  labels:\n    app: test\n  name: settings-4c9a82ce72ca2519f38d0af0abbb4cecb9fceca9\n---\n" +
+		"apiVersion: v1\nkind: Service\nmetadata:\n  annotations:\n    color: blue\n  labels:\n    app: test\n  name: test\nspec:\n  ports:\n    - port: 80\n  selector:\n    app: test\n    component: web\n  type: NodePort\n"
+	if actual, err := internal.FormatYAML(out); err != nil {
+		t.Fatal(err)
+	} else if actual != expected {
+		t.Errorf("Incorrect output; expected:\n%s\nactual:\n%s", expected, actual)
+	}
+}
+
+func TestConvertKustomizationLiteralsMountsAndReplacements(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"kustomization.yaml": `configMapGenerator:
+  - name: settings
+    literals:
+      - empty=
+      - quoted="blue"
+      - unbalanced="it's'
+      - inner='a'b'
+    files:
+      - files/a:b.txt
+      - c:d.txt
+replacements:
+  - path: replacements.yaml
+  - source:
+      kind: Service
+      name: test
+      fieldPath: spec.ports.0.port
+    targets:
+      - select:
+          kind: Deployment
+        reject:
+          - name: legacy
+        fieldPaths:
+          - spec.template.spec.containers.[name=web].ports.0.containerPort
+        options:
+          create: true
+`,
+		"replacements.yaml": `source:
+  version: v1
+  kind: ConfigMap
+  name: settings
+  options:
+    delimiter: "-"
+    index: 1
+targets:
+  - select:
+      group: apps
+      version: v1
+      kind: Deployment
+`,
+		"files/a:b.txt": "ab\n",
+		"c:d.txt":       "cd\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		} else if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	manifest, notes, err := ConvertKustomization(dir)
+	if err != nil {
+		t.Fatalf("Conversion failed: %v", err)
+	}
+
+	expected := `apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+steps:
+  - image: ghcr.io/arikkfir/kude/functions/create-configmap
+    config:
+      contents:
+        - key: empty
+          value: ""
+        - key: quoted
+          value: blue
+        - key: unbalanced
+          value: '"it''s'''
+        - key: inner
+          value: a'b
+        - key: a:b.txt
+          path: files/a:b.txt
+      name: settings
+    mounts:
+      - files
+  - image: ghcr.io/arikkfir/kude/functions/replacements
+    config:
+      replacements:
+        - source:
+            apiVersion: v1
+            kind: ConfigMap
+            name: settings
+            options:
+              delimiter: '-'
+              index: 1
+          targets:
+            - fieldPaths:
+                - metadata.name
+              includes:
+                - apiVersion: apps/v1
+                  kind: Deployment
+        - source:
+            fieldPath: spec.ports.0.port
+            kind: Service
+            name: test
+          targets:
+            - excludes:
+                - name: legacy
+              fieldPaths:
+                - spec.template.spec.containers.[name=web].ports.0.containerPort
+              includes:
+                - kind: Deployment
+              options:
+                create: true
+`
+	if string(manifest) != expected {
+		t.Errorf("Incorrect pipeline manifest; expected:\n%s\nactual:\n%s", expected, manifest)
+	}
+
+	expectedNotes := []string{
+		"ConfigMap 'settings': file 'c:d.txt' cannot be mounted, since mounts cannot contain ':'; rename it or move it into a directory, and add it manually",
+	}
+	if !reflect.DeepEqual(notes, expectedNotes) {
+		t.Errorf("Incorrect notes; expected:\n%s\nactual:\n%s", strings.Join(expectedNotes, "\n"), strings.Join(notes, "\n"))
+	}
+}
@@ -0,0 +1,47 @@
+package kude
+
+import (
+	"fmt"
+	"github.com/arikkfir/kude/internal"
+	"github.com/arikkfir/kyaml/pkg"
+	"github.com/blang/semver"
+	"log"
+)
+
+// checkAPIVersions checks the given resources for API versions that are deprecated or removed in the given Kubernetes
+// version. Resources using removed API versions are reported in the returned ValidationError; resources using API
+// versions that are only deprecated are logged as warnings.
+func checkAPIVersions(logger *log.Logger, resources []*kyaml.RNode, kubernetesVersion semver.Version) error {
+	var errs []error
+	for _, rn := range resources {
+		apiVersion, err := rn.GetAPIVersion()
+		if err != nil {
+			return newResourceError(rn, fmt.Errorf("failed getting API version for resource: %w", err))
+		}
+		kind, err := rn.GetKind()
+		if err != nil {
+			return newResourceError(rn, fmt.Errorf("failed getting kind for resource: %w", err))
+		}
+
+		api := internal.FindDeprecatedAPI(apiVersion, kind)
+		if api == nil {
+			continue
+		}
+		hint := ""
+		if replacedBy, convertible := api.ReplacementIn(&kubernetesVersion); replacedBy != "" {
+			hint = fmt.Sprintf("; use '%s' instead", replacedBy)
+			if convertible {
+				hint += " (the migrate-apis function can convert it automatically)"
+			}
+		}
+		if api.IsRemovedIn(kubernetesVersion) {
+			errs = append(errs, newResourceError(rn, fmt.Errorf("API version '%s' of %s was removed in Kubernetes %s%s", apiVersion, kind, api.RemovedIn, hint)))
+		} else if api.IsDeprecatedIn(kubernetesVersion) {
+			logger.Printf("Warning: %s", newResourceError(rn, fmt.Errorf("API version '%s' of %s is deprecated since Kubernetes %s, and will be removed in Kubernetes %s%s", apiVersion, kind, api.DeprecatedIn, api.RemovedIn, hint)))
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
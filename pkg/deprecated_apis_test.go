@@ -0,0 +1,85 @@
+package kude
+
+import (
+	"bytes"
+	"errors"
+	"github.com/arikkfir/kude/internal"
+	"log"
+	"strings"
+	"testing"
+)
+
+const deprecatedAPIsManifest = `
+apiVersion: networking.k8s.io/v1beta1
+kind: Ingress
+metadata:
+  name: web
+---
+apiVersion: autoscaling/v2beta2
+kind: HorizontalPodAutoscaler
+metadata:
+  name: web
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+`
+
+func TestCheckAPIVersionsRemoved(t *testing.T) {
+	version, err := internal.ParseKubernetesVersion("v1.22.4")
+	if err != nil {
+		t.Fatalf("failed parsing version: %v", err)
+	}
+
+	logs := bytes.Buffer{}
+	err = checkAPIVersions(log.New(&logs, "", 0), parseResources(t, deprecatedAPIsManifest), version)
+	var validationError *ValidationError
+	if !errors.As(err, &validationError) {
+		t.Fatalf("expected a validation error, got: %v", err)
+	} else if len(validationError.Errors) != 1 {
+		t.Fatalf("expected 1 error, got: %v", validationError)
+	} else if msg := validationError.Errors[0].Error(); !strings.Contains(msg, "API version 'networking.k8s.io/v1beta1' of Ingress was removed in Kubernetes 1.22; use 'networking.k8s.io/v1' instead") {
+		t.Errorf("unexpected error: %s", msg)
+	}
+	if strings.Contains(logs.String(), "autoscaling/v2beta2") {
+		t.Errorf("unexpected warning for API not yet deprecated in 1.22: %s", logs.String())
+	}
+}
+
+func TestCheckAPIVersionsDeprecated(t *testing.T) {
+	version, err := internal.ParseKubernetesVersion("1.23")
+	if err != nil {
+		t.Fatalf("failed parsing version: %v", err)
+	}
+
+	resources := parseResources(t, deprecatedAPIsManifest)[1:]
+	logs := bytes.Buffer{}
+	if err := checkAPIVersions(log.New(&logs, "", 0), resources, version); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !strings.Contains(logs.String(), "API version 'autoscaling/v2beta2' of HorizontalPodAutoscaler is deprecated since Kubernetes 1.23, and will be removed in Kubernetes 1.26") {
+		t.Errorf("expected deprecation warning, got: %s", logs.String())
+	}
+}
+
+func TestCheckAPIVersionsRemovedWithoutReplacement(t *testing.T) {
+	version, err := internal.ParseKubernetesVersion("1.25")
+	if err != nil {
+		t.Fatalf("failed parsing version: %v", err)
+	}
+
+	resources := parseResources(t, "apiVersion: extensions/v1beta1\nkind: PodSecurityPolicy\nmetadata:\n  name: restricted\n")
+	var validationError *ValidationError
+	if err := checkAPIVersions(log.New(&bytes.Buffer{}, "", 0), resources, version); !errors.As(err, &validationError) {
+		t.Fatalf("expected a validation error, got: %v", err)
+	} else if msg := validationError.Errors[0].Error(); !strings.HasSuffix(msg, "API version 'extensions/v1beta1' of PodSecurityPolicy was removed in Kubernetes 1.16") {
+		t.Errorf("expected no replacement to be suggested, got: %s", msg)
+	}
+
+	version, _ = internal.ParseKubernetesVersion("1.24")
+	if err := checkAPIVersions(log.New(&bytes.Buffer{}, "", 0), resources, version); !errors.As(err, &validationError) {
+		t.Fatalf("expected a validation error, got: %v", err)
+	} else if msg := validationError.Errors[0].Error(); !strings.Contains(msg, "use 'policy/v1beta1' instead (the migrate-apis function can convert it automatically)") {
+		t.Errorf("expected 'policy/v1beta1' to be suggested, got: %s", msg)
+	}
+}
@@ -40,6 +40,10 @@ var (
 		Name: "kude_pipeline_step_running_total",
 		Help: "Gauge of Kude pipeline steps currently running",
 	}, []string{"id", "name"})
+	stepSkippedCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kude_pipeline_step_skipped_total",
+		Help: "Counter of steps skipped due to their conditions",
+	}, []string{"id", "name"})
 	stepInputResourcesCounter = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "kude_pipeline_step_input_resources_total",
 		Help: "Counter of input resources by step",
@@ -1,12 +1,80 @@
 package kude
 
 import (
+	"fmt"
+	"github.com/arikkfir/kude/internal"
+	"io"
 	"log"
 )
 
-func NewExecution(p Pipeline, logger *log.Logger) (Execution, error) {
-	return &executionImpl{
+// ExecutionOption customizes an execution. Options are propagated to the executions of nested packages.
+type ExecutionOption func(e *executionImpl)
+
+// WithLock makes the execution pin & verify remote resources and function images using the given lock. A nil lock
+// disables locking.
+func WithLock(lock *Lock) ExecutionOption {
+	return func(e *executionImpl) { e.lock = lock }
+}
+
+// WithVendor makes the execution use the given vendor directory - either populating it with remote resources &
+// function images, or (in offline mode) reading them exclusively from it. A nil vendor disables vendoring.
+func WithVendor(vendor *Vendor) ExecutionOption {
+	return func(e *executionImpl) { e.vendor = vendor }
+}
+
+// WithCache makes the execution download remote resources through the given cache. A nil cache disables caching.
+func WithCache(cache *Cache) ExecutionOption {
+	return func(e *executionImpl) { e.cache = cache }
+}
+
+// WithAuth makes the execution authenticate downloads of remote resources using the given configuration.
+func WithAuth(auth *AuthConfig) ExecutionOption {
+	return func(e *executionImpl) { e.auth = auth }
+}
+
+// WithValidator makes the execution validate its output resources using the given validator. Nested packages are not
+// validated on their own, since the resources they depend on (e.g. custom resource definitions) might be provided by
+// the including package. A nil validator disables validation.
+func WithValidator(validator *Validator) ExecutionOption {
+	return func(e *executionImpl) { e.validator = validator }
+}
+
+// WithKubernetesVersion makes the execution check its output resources for API versions that are deprecated (logged as
+// warnings) or removed (failing the execution) as of the given Kubernetes version. Like validation, this is only done
+// by the root execution. An empty version disables the check.
+func WithKubernetesVersion(kubernetesVersion string) ExecutionOption {
+	return func(e *executionImpl) { e.kubernetesVersion = kubernetesVersion }
+}
+
+// WithInput makes the execution read its input resources from the given reader (a stream of YAML documents), instead
+// of from the pipeline's resources, which are ignored. This is used to run a pipeline's steps over resources rendered by
+// other tools (e.g. as a Helm post-renderer). Nested packages are unaffected, since they are only read from resources.
+func WithInput(input io.Reader) ExecutionOption {
+	return func(e *executionImpl) { e.input = input }
+}
+
+func NewExecution(p Pipeline, logger *log.Logger, opts ...ExecutionOption) (Execution, error) {
+	e := &executionImpl{
 		pipeline: p,
 		logger:   logger,
-	}, nil
+		options:  opts,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	if e.auth != nil {
+		getters, err := e.auth.getters()
+		if err != nil {
+			return nil, fmt.Errorf("failed configuring authentication: %w", err)
+		}
+		e.getters = getters
+	}
+	if e.kubernetesVersion != "" {
+		kubernetesVersion, err := internal.ParseKubernetesVersion(e.kubernetesVersion)
+		if err != nil {
+			return nil, err
+		}
+		e.targetVersion = &kubernetesVersion
+	}
+	return e, nil
 }
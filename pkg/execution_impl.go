@@ -9,11 +9,13 @@ import (
 	"github.com/arikkfir/kude/internal"
 	"github.com/arikkfir/kude/internal/functions"
 	"github.com/arikkfir/kyaml/pkg"
+	"github.com/blang/semver"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/hashicorp/go-getter/v2"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v3"
@@ -37,6 +39,9 @@ const (
 	// execution. This is used to avoid reallocating the buffer every time a new resource is added, but is required in order
 	// to support resource references resolving - which requires reading all resources into memory.
 	defaultInMemoryResourceCapacity = 1_000
+
+	// inputSourcePath is the source path reported for resources read from an execution's input reader.
+	inputSourcePath = "<input>"
 )
 
 var (
@@ -49,15 +54,38 @@ var (
 		"ghcr.io/arikkfir/kude/functions/create-namespace": func() functions.Function { return &functions.CreateNamespace{} },
 		"ghcr.io/arikkfir/kude/functions/create-secret":    func() functions.Function { return &functions.CreateSecret{} },
 		"ghcr.io/arikkfir/kude/functions/helm":             func() functions.Function { return &functions.Helm{} },
+		"ghcr.io/arikkfir/kude/functions/helm-template":    func() functions.Function { return &functions.HelmTemplate{} },
+		"ghcr.io/arikkfir/kude/functions/kustomize":        func() functions.Function { return &functions.Kustomize{} },
 		"ghcr.io/arikkfir/kude/functions/label":            func() functions.Function { return &functions.Label{} },
+		"ghcr.io/arikkfir/kude/functions/migrate-apis":     func() functions.Function { return &functions.MigrateAPIs{} },
+		"ghcr.io/arikkfir/kude/functions/patch":            func() functions.Function { return &functions.Patch{} },
+		"ghcr.io/arikkfir/kude/functions/policy":           func() functions.Function { return &functions.Policy{} },
+		"ghcr.io/arikkfir/kude/functions/remove":           func() functions.Function { return &functions.Remove{} },
+		"ghcr.io/arikkfir/kude/functions/replacements":     func() functions.Function { return &functions.Replacements{} },
+		"ghcr.io/arikkfir/kude/functions/set-image":        func() functions.Function { return &functions.SetImage{} },
 		"ghcr.io/arikkfir/kude/functions/set-namespace":    func() functions.Function { return &functions.SetNamespace{} },
 		"ghcr.io/arikkfir/kude/functions/yq":               func() functions.Function { return &functions.YQ{} },
 	}
 )
 
 type executionImpl struct {
-	pipeline Pipeline
-	logger   *log.Logger
+	pipeline   Pipeline
+	logger     *log.Logger
+	nested     bool
+	sourceRoot string
+	graph      *packageGraph
+	chain      []string
+	options    []ExecutionOption
+	lock       *Lock
+	vendor     *Vendor
+	cache      *Cache
+	auth       *AuthConfig
+	validator  *Validator
+	input      io.Reader
+	getters    []getter.Getter
+
+	kubernetesVersion string
+	targetVersion     *semver.Version
 }
 
 func (e *executionImpl) GetPipeline() Pipeline  { return e.pipeline }
@@ -105,6 +133,28 @@ func (e *executionImpl) ExecuteToWriter(ctx context.Context, w io.Writer) error
 	}
 }
 
+// newResourceReader creates a reader for the given resource of the pipeline, pushing its resources into the given
+// target channel.
+func (e *executionImpl) newResourceReader(ctx context.Context, resource Resource, target chan *kyaml.RNode) *resourceReader {
+	return &resourceReader{
+		ctx:        ctx,
+		pwd:        e.GetPipeline().GetDirectory(),
+		logger:     e.GetLogger(),
+		target:     target,
+		sourceRoot: e.sourceRoot,
+		graph:      e.graph,
+		chain:      e.chain,
+		parameters: resource.GetWith(),
+		options:    e.options,
+		lock:       e.lock,
+		vendor:     e.vendor,
+		cache:      e.cache,
+		getters:    e.getters,
+
+		inlineBuiltinFunctions: e.pipeline.(*pipelineImpl).inlineBuiltinFunctions,
+	}
+}
+
 func (e *executionImpl) ExecuteToChannel(ctx context.Context, target chan *kyaml.RNode) error {
 	timer := prometheus.NewTimer(executionsDurationHistogramMetric)
 	defer timer.ObserveDuration()
@@ -112,6 +162,19 @@ func (e *executionImpl) ExecuteToChannel(ctx context.Context, target chan *kyaml
 	pwd := e.pipeline.GetDirectory()
 	e.logger.Printf("Executing pipeline at '%s'", pwd)
 
+	// The root execution resolves the graph of imported packages before anything is rendered, rejecting import cycles;
+	// the graph is then shared by all nested executions
+	if e.graph == nil {
+		e.graph = newPackageGraph()
+		e.chain = []string{pwd}
+		if _, err := e.graph.visit(nil, pwd, nil); err != nil {
+			return fmt.Errorf("pipeline error: %w", err)
+		} else if err := e.graph.resolve(ctx, e); err != nil {
+			return fmt.Errorf("pipeline error: %w", err)
+		}
+		e.graph.leave(pwd, nil)
+	}
+
 	cacheDir := filepath.Join(pwd, ".kude", "cache")
 	if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
 		return fmt.Errorf("failed creating cache directory '%s': %w", cacheDir, err)
@@ -142,31 +205,56 @@ func (e *executionImpl) ExecuteToChannel(ctx context.Context, target chan *kyaml
 	// if it is a directory, remote URL, GitHub reference, Git repository, etc.
 	// Every Kubernetes resource from the processed pipeline resources will be
 	// pushed into the "resources" channel, to be consumed downstream.
+	//
+	// Resources are read concurrently, but are pushed downstream in the order
+	// they are declared in, so that the output (and the resolution of
+	// conflicting resources) does not depend on which download finished first.
+	//
+	// If an input reader was provided, it replaces the pipeline's resources.
 	////////////////////////////////////////////////////////////////////////////
-	rwg := sync.WaitGroup{}
 	resources := make(chan *kyaml.RNode, 5000)
-	for _, r := range e.pipeline.GetResources() {
-		rwg.Add(1)
-		go func(path string) {
-			defer rwg.Done()
+	var readers []chan *kyaml.RNode
+	pipelineResources := e.pipeline.GetResourceEntries()
+	if e.input != nil && !e.nested {
+		pipelineResources = nil
+		reader := make(chan *kyaml.RNode, 5000)
+		readers = append(readers, reader)
+		go func(target chan *kyaml.RNode) {
+			defer close(target)
+			e.logger.Printf("Processing: %s", inputSourcePath)
+			if err := decodeResources(e.input, inputSourcePath, target); err != nil {
+				exitCh <- fmt.Errorf("failed to parse input resources: %w", err)
+			}
+		}(reader)
+	}
+	for _, r := range pipelineResources {
+		reader := make(chan *kyaml.RNode, 5000)
+		readers = append(readers, reader)
+		go func(resource Resource, target chan *kyaml.RNode) {
+			defer close(target)
 
+			path := resource.GetURL()
 			timer := prometheus.NewTimer(resGenDurationHistogramMetric.WithLabelValues(path))
 			defer timer.ObserveDuration()
 			resGenCounterMetric.WithLabelValues(path).Inc()
 
-			r := &resourceReader{ctx: ctx, pwd: e.GetPipeline().GetDirectory(), logger: e.GetLogger(), target: resources}
+			r := e.newResourceReader(ctx, resource, target)
 			if err := r.Read(path); err != nil {
 				// TODO: add error counter
-				exitCh <- fmt.Errorf("failed streaming resources found in '%s': %w", path, err)
+				exitCh <- fmt.Errorf("failed streaming resources found in '%s': %w", redactURL(path), redactError(err))
 				return
 			}
-		}(r)
+		}(r, reader)
 	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		defer close(resources)
-		rwg.Wait()
+		for _, reader := range readers {
+			for rn := range reader {
+				resources <- rn
+			}
+		}
 	}()
 
 	////////////////////////////////////////////////////////////////////////////
@@ -177,6 +265,10 @@ func (e *executionImpl) ExecuteToChannel(ctx context.Context, target chan *kyaml
 	// into the next output channel. That output channel will be the input
 	// channel of the next step, and so on.
 	////////////////////////////////////////////////////////////////////////////
+	for _, step := range e.pipeline.GetSkippedSteps() {
+		e.logger.Printf("Skipping step '%s' (condition not met: %s)", step.GetName(), step.GetWhen())
+		stepSkippedCounter.WithLabelValues(step.GetID(), step.GetName()).Inc()
+	}
 	stepInput := resources
 	for _, step := range e.pipeline.GetSteps() {
 		stepOutput := make(chan *kyaml.RNode, 5000)
@@ -216,9 +308,13 @@ func (e *executionImpl) ExecuteToChannel(ctx context.Context, target chan *kyaml
 	//	-> "my-secret": "my-secret-k8fg21i"
 	//
 	// Additionally, the resource will be cleaned from internal annotations.
+	//
+	// Resources with the same apiVersion, kind, namespace & name are resolved according to the pipeline's conflict
+	// policy - failing the pipeline, keeping the first or last of them, or merging them (in the position of the first).
 	////////////////////////////////////////////////////////////////////////////
 	renamedResources := make(map[string]string)
 	collatedResources := make([]*kyaml.RNode, 0, defaultInMemoryResourceCapacity)
+	collatedIndices := make(map[string]int)
 	wg.Add(1)
 	go func(input chan *kyaml.RNode) {
 		defer wg.Done()
@@ -227,39 +323,50 @@ func (e *executionImpl) ExecuteToChannel(ctx context.Context, target chan *kyaml
 			if ok {
 				apiVersion, err := rn.GetAPIVersion()
 				if err != nil {
-					exitCh <- fmt.Errorf("failed getting API version for resource: %w", err)
+					exitCh <- newResourceError(rn, fmt.Errorf("failed getting API version for resource: %w", err))
 					return
 				} else if apiVersion == "" {
-					exitCh <- fmt.Errorf("failed getting API version for resource: apiVersion is missing or empty")
+					exitCh <- newResourceError(rn, fmt.Errorf("failed getting API version for resource: apiVersion is missing or empty"))
 					return
 				}
 				kind, err := rn.GetKind()
 				if err != nil {
-					exitCh <- fmt.Errorf("failed getting kind for resource: %w", err)
+					exitCh <- newResourceError(rn, fmt.Errorf("failed getting kind for resource: %w", err))
 					return
 				} else if kind == "" {
-					exitCh <- fmt.Errorf("failed getting kind for resource: kind is missing or empty")
+					exitCh <- newResourceError(rn, fmt.Errorf("failed getting kind for resource: kind is missing or empty"))
 					return
 				}
 				namespace, err := rn.GetNamespace()
 				if err != nil {
-					exitCh <- fmt.Errorf("failed getting namespace for resource: %w", err)
+					exitCh <- newResourceError(rn, fmt.Errorf("failed getting namespace for resource: %w", err))
 					return
 				}
 				name, err := rn.GetName()
 				if err != nil {
-					exitCh <- fmt.Errorf("failed getting name for resource: %w", err)
+					exitCh <- newResourceError(rn, fmt.Errorf("failed getting name for resource: %w", err))
 					return
 				}
 				if previousName, err := GetResourcePreviousName(rn); err != nil {
-					exitCh <- fmt.Errorf("failed getting previous name for resource: %w", err)
+					exitCh <- newResourceError(rn, fmt.Errorf("failed getting previous name for resource: %w", err))
 					return
 				} else if previousName != "" {
 					key := fmt.Sprintf("%s/%s/%s/%s", apiVersion, kind, namespace, previousName)
 					renamedResources[key] = name
 				}
-				collatedResources = append(collatedResources, rn)
 				collectedResourcesCounter.Inc()
+				key := fmt.Sprintf("%s/%s/%s/%s", apiVersion, kind, namespace, name)
+				if i, found := collatedIndices[key]; found {
+					if resolved, err := resolveConflict(e.pipeline.GetOnConflict(), collatedResources[i], rn); err != nil {
+						exitCh <- newResourceError(rn, err)
+						return
+					} else {
+						collatedResources[i] = resolved
+					}
+				} else {
+					collatedIndices[key] = len(collatedResources)
+					collatedResources = append(collatedResources, rn)
+				}
 			} else {
 				break
 			}
@@ -280,19 +387,42 @@ func (e *executionImpl) ExecuteToChannel(ctx context.Context, target chan *kyaml
 	}
 
 	////////////////////////////////////////////////////////////////////////////
-	// PIPE RESOURCES TO TARGET SINK
+	// VALIDATE & PIPE RESOURCES TO TARGET SINK
+	// ----------------------------------------
+	// Once references are resolved, resources are validated (unless this is a
+	// nested package execution, whose resources are validated by the root
+	// execution). Source annotations are removed at this point, unless this is
+	// a nested package execution, in which case the parent execution still
+	// needs them for error reporting.
 	////////////////////////////////////////////////////////////////////////////
 	e.logger.Printf("Resolving references in %d resources...", len(collatedResources))
 	for i, rn := range collatedResources {
 		if err := referencesCatalog.resolve(rn, renamedResources); err != nil {
-			return fmt.Errorf("failed resolving references in resource %d: %w", i, err)
+			return fmt.Errorf("failed resolving references: %w", newResourceError(rn, err))
 		}
 		resolvedResourcesCounter.Inc()
-		target <- rn
 		if i > 0 && i%1000 == 0 {
 			e.logger.Printf("  Resolved %d resources...", i)
 		}
 	}
+	if e.targetVersion != nil && !e.nested {
+		e.logger.Printf("Checking API versions of %d resources against Kubernetes %s...", len(collatedResources), e.kubernetesVersion)
+		if err := checkAPIVersions(e.logger, collatedResources, *e.targetVersion); err != nil {
+			return err
+		}
+	}
+	if e.validator != nil && !e.nested {
+		e.logger.Printf("Validating %d resources against %s...", len(collatedResources), e.validator.GetSchemaSource())
+		if err := e.validator.Validate(collatedResources); err != nil {
+			return err
+		}
+	}
+	for _, rn := range collatedResources {
+		if !e.nested {
+			removeResourceSource(rn)
+		}
+		target <- rn
+	}
 	return nil
 }
 
@@ -312,6 +442,16 @@ func (e *executionImpl) ExecuteStep(ctx context.Context, dockerClient *client.Cl
 		return fmt.Errorf("failed to create step input pipe: %w", err)
 	}
 
+	// When the step targets specific resources, only those are sent to the function; the rest bypass it, and are
+	// merged back into the output in their original position once the function is done. The layout records the order
+	// of input resources - bypassed resources as-is, and placeholders for resources sent to the function.
+	targeting := newStepTargeting(step)
+	var layout []targetingSlot
+	var results []*kyaml.RNode
+
+	// Functions never see Kude's internal source annotation; it is restored on their output instead
+	sources := newStepSources()
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
@@ -322,7 +462,18 @@ func (e *executionImpl) ExecuteStep(ctx context.Context, dockerClient *client.Cl
 		for {
 			rn, ok := <-input
 			if ok {
+				if targeting != nil {
+					if matches, err := targeting.matches(ctx, rn); err != nil {
+						exitCh <- newResourceError(rn, err)
+						return
+					} else if !matches {
+						layout = append(layout, newTargetingSlot(rn, true))
+						continue
+					}
+					layout = append(layout, newTargetingSlot(rn, false))
+				}
 				stepInputResourcesCounter.WithLabelValues(step.GetID(), step.GetName()).Inc()
+				sources.strip(rn)
 				if err := encoder.Encode(rn.N); err != nil {
 					exitCh <- fmt.Errorf("failed encoding resource into container stdin: %w", err)
 					return
@@ -361,7 +512,7 @@ func (e *executionImpl) ExecuteStep(ctx context.Context, dockerClient *client.Cl
 		defer wg.Done()
 
 		decoder := yaml.NewDecoder(stdoutReader)
-		for {
+		for document := 1; ; document++ {
 			node := &yaml.Node{}
 			if err := decoder.Decode(node); err != nil {
 				if errors.Is(err, io.EOF) {
@@ -379,8 +530,15 @@ func (e *executionImpl) ExecuteStep(ctx context.Context, dockerClient *client.Cl
 				exitCh <- fmt.Errorf("unexpected YAML - expected object, got: %v", node.Kind)
 				return
 			}
-			// TODO: call rn.IsValid()
-			output <- &kyaml.RNode{N: node}
+			rn := &kyaml.RNode{N: node}
+
+			// Resources generated by this step have no source file; attribute them to the step instead
+			sources.restore(rn, ResourceSource{Path: fmt.Sprintf("step '%s'", step.GetName()), Document: document})
+			if targeting != nil {
+				results = append(results, rn)
+			} else {
+				output <- rn
+			}
 		}
 	}()
 
@@ -392,6 +550,11 @@ func (e *executionImpl) ExecuteStep(ctx context.Context, dockerClient *client.Cl
 		}
 	default:
 	}
+	if targeting != nil {
+		for _, rn := range mergeTargetedResources(layout, results) {
+			output <- rn
+		}
+	}
 	return nil
 }
 
@@ -423,6 +586,7 @@ func (e *executionImpl) executeBuiltinFunctionInline(_ context.Context, cacheDir
 		CacheDir:       cacheDir,
 		TempDir:        tempDir,
 		Viper:          viper.New(),
+		Offline:        e.vendor != nil && e.vendor.offline,
 	}
 
 	defer func() {
@@ -491,37 +655,44 @@ func (e *executionImpl) executeContainer(ctx context.Context, dockerClient *clie
 	}
 
 	////////////////////////////////////////////////////////////////////////////
-	// PULL IMAGE
+	// PREPARE IMAGE
+	// -------------
+	// When offline, the image is loaded from the vendor directory. Otherwise
+	// it is pulled (pinned to its locked digest, if any), verified against the
+	// lock, and vendored if requested.
 	////////////////////////////////////////////////////////////////////////////
-	stepLogger.Printf("Pulling image '%s'", step.GetImage())
-	imageListFilters := filters.NewArgs(filters.Arg("reference", step.GetImage()))
-	if images, err := dockerClient.ImageList(ctx, types.ImageListOptions{Filters: imageListFilters}); err != nil {
-		return fmt.Errorf("failed listing images for filter '%s': %w", step.GetImage(), err)
-	} else if len(images) > 1 {
-		return fmt.Errorf("found multiple matching images")
-	} else if len(images) == 0 || internal.IsImageWithLatestTag(&images[0]) {
-		r, err := dockerClient.ImagePull(ctx, step.GetImage(), types.ImagePullOptions{})
-		if err != nil {
-			return fmt.Errorf("failed pulling image: %w", err)
+	image := step.GetImage()
+	if e.vendor != nil && e.vendor.offline {
+		if err := e.vendor.loadImage(ctx, dockerClient, image); err != nil {
+			return err
 		}
-		defer r.Close()
-		s := bufio.NewScanner(r)
-		for s.Scan() {
-			line := s.Text()
-			var pull map[string]interface{}
-			if err := json.Unmarshal([]byte(line), &pull); err != nil {
-				return fmt.Errorf("failed parsing image pull output: %w", err)
+	} else {
+		image = e.lock.pinImage(image)
+		if err := pullImage(ctx, dockerClient, image, stepLogger, pullLogger); err != nil {
+			return err
+		}
+		if e.lock != nil {
+			digest, err := resolveImageDigest(ctx, dockerClient, image)
+			if err != nil {
+				return fmt.Errorf("failed resolving digest of image '%s': %w", image, err)
+			} else if err := e.lock.verifyImage(step.GetImage(), digest); err != nil {
+				return err
 			}
-			pullLogger.Println(pull["status"])
 		}
-		if s.Err() != nil {
-			return fmt.Errorf("failed parsing image pull output: %w", s.Err())
+		if e.vendor != nil {
+			if err := e.vendor.storeImage(ctx, dockerClient, step.GetImage(), image); err != nil {
+				return err
+			}
 		}
 	}
 
 	////////////////////////////////////////////////////////////////////////////
 	// CREATE CONTAINER
 	////////////////////////////////////////////////////////////////////////////
+	env := []string{"KUDE=true", "KUDE_VERSION=" + GetVersion().String()}
+	if e.vendor != nil && e.vendor.offline {
+		env = append(env, functions.OfflineEnvVar+"=true")
+	}
 	cont, err := dockerClient.ContainerCreate(
 		ctx,
 		&container.Config{
@@ -533,8 +704,8 @@ func (e *executionImpl) executeContainer(ctx context.Context, dockerClient *clie
 			Tty:             false, // Important to disable this, so that the output logs are multiplexed (stdout/stderr)
 			User:            step.GetUser(),
 			WorkingDir:      step.GetWorkdir(),
-			Env:             []string{"KUDE=true", "KUDE_VERSION=" + GetVersion().String()},
-			Image:           step.GetImage(),
+			Env:             env,
+			Image:           image,
 			Entrypoint:      step.GetEntrypoint(),
 			NetworkDisabled: !step.GetNetwork(),
 			Labels:          map[string]string{"kude": "true", "kudeVersion": GetVersion().String()},
@@ -650,3 +821,48 @@ func (e *executionImpl) executeContainer(ctx context.Context, dockerClient *clie
 		return nil
 	}
 }
+
+// resolveImageDigest returns the repository digest of the given (local) image.
+func resolveImageDigest(ctx context.Context, dockerClient *client.Client, image string) (string, error) {
+	inspect, _, err := dockerClient.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return "", fmt.Errorf("failed inspecting image: %w", err)
+	}
+	repository := imageRepository(image)
+	for _, repoDigest := range inspect.RepoDigests {
+		if name, digest, found := strings.Cut(repoDigest, "@"); found && name == repository {
+			return digest, nil
+		}
+	}
+	return "", fmt.Errorf("image has no repository digest (was it built locally?)")
+}
+
+// pullImage pulls the given image, unless it's already present (and is not tagged as "latest").
+func pullImage(ctx context.Context, dockerClient *client.Client, image string, stepLogger, pullLogger *log.Logger) error {
+	stepLogger.Printf("Pulling image '%s'", image)
+	imageListFilters := filters.NewArgs(filters.Arg("reference", image))
+	if images, err := dockerClient.ImageList(ctx, types.ImageListOptions{Filters: imageListFilters}); err != nil {
+		return fmt.Errorf("failed listing images for filter '%s': %w", image, err)
+	} else if len(images) > 1 {
+		return fmt.Errorf("found multiple matching images")
+	} else if len(images) == 0 || internal.IsImageWithLatestTag(&images[0]) {
+		r, err := dockerClient.ImagePull(ctx, image, types.ImagePullOptions{})
+		if err != nil {
+			return fmt.Errorf("failed pulling image: %w", err)
+		}
+		defer r.Close()
+		s := bufio.NewScanner(r)
+		for s.Scan() {
+			line := s.Text()
+			var pull map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &pull); err != nil {
+				return fmt.Errorf("failed parsing image pull output: %w", err)
+			}
+			pullLogger.Println(pull["status"])
+		}
+		if s.Err() != nil {
+			return fmt.Errorf("failed parsing image pull output: %w", s.Err())
+		}
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -98,9 +99,61 @@ a : b : c`
 		t.Error(err)
 	} else if err := e.ExecuteToWriter(context.Background(), out); err == nil {
 		t.Errorf("expected error, got nil")
-	} else if matches, reErr := regexp.Match("pipeline error: failed streaming resources found in 'service-account.yaml': failed to stream resources of 'service-account.yaml': failed to aggregate resources from '.+/service-account.yaml': failed to parse '.+/service-account.yaml': yaml: line 2: mapping values are not allowed in this context", []byte(err.Error())); reErr != nil {
+	} else if matches, reErr := regexp.Match("pipeline error: failed streaming resources found in 'service-account.yaml': failed to stream resources of 'service-account.yaml': failed to aggregate resources from '.+/service-account.yaml': failed to parse '.+/service-account.yaml': .+/service-account.yaml:2: mapping values are not allowed in this context", []byte(err.Error())); reErr != nil {
 		t.Fatal(err)
 	} else if !matches {
 		t.Errorf("expected error to match, got: %s", err.Error())
 	}
 }
+
+func TestExecutionImplExecuteToWriterWithInput(t *testing.T) {
+	kudeYAML := `###
+apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+resources:
+- service-account.yaml
+steps:
+- image: ghcr.io/arikkfir/kude/functions/annotate
+  config:
+    name: foo
+    value: bar`
+	saYAML := `###
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: ignored`
+	inputYAML := `---
+# Source: chart/templates/config-map.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: rendered
+---
+# Source: chart/templates/service-account.yaml
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: rendered
+`
+	dir := t.TempDir()
+	out := &bytes.Buffer{}
+	if err := ioutil.WriteFile(dir+"/kude.yaml", []byte(kudeYAML), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(dir+"/service-account.yaml", []byte(saYAML), 0644); err != nil {
+		t.Fatal(err)
+	} else if p, err := newInliningPipeline(dir); err != nil {
+		t.Fatal(err)
+	} else if e, err := NewExecution(p, log.New(&internal.TestWriter{T: t}, "", 0), WithInput(strings.NewReader(inputYAML))); err != nil {
+		t.Fatal(err)
+	} else if err := e.ExecuteToWriter(context.Background(), out); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out.String(), "ignored") {
+		t.Errorf("expected pipeline resources to be ignored, got:\n%s", out.String())
+	} else if strings.Count(out.String(), "name: rendered") != 2 {
+		t.Errorf("expected both input resources in output, got:\n%s", out.String())
+	} else if strings.Count(out.String(), "foo: bar") != 2 {
+		t.Errorf("expected pipeline steps to annotate input resources, got:\n%s", out.String())
+	}
+}
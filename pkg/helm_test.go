@@ -0,0 +1,97 @@
+package kude
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/arikkfir/kude/internal"
+	"github.com/arikkfir/kude/internal/functions"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHelmDownloadFailures(t *testing.T) {
+	archive := []byte("not really an archive")
+	checksum := sha256.Sum256([]byte("something else"))
+	archiveName := "helm-v3.8.1-" + runtime.GOOS + "-" + runtime.GOARCH + ".tar.gz"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/mirror/" + archiveName:
+			_, _ = w.Write(archive)
+		case "/mirror/" + archiveName + ".sha256sum":
+			_, _ = w.Write([]byte(hex.EncodeToString(checksum[:]) + "  " + archiveName + "\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	testCases := map[string]struct {
+		helm          functions.Helm
+		expectedError string
+	}{
+		"not found": {
+			helm:          functions.Helm{Version: "3.8.1", DownloadURL: server.URL + "/missing"},
+			expectedError: "failed downloading checksum: failed downloading from '" + server.URL + "/missing/" + archiveName + ".sha256sum': 404 Not Found",
+		},
+		"published checksum mismatch": {
+			helm:          functions.Helm{Version: "3.8.1", DownloadURL: server.URL + "/mirror/"},
+			expectedError: "checksum mismatch for '" + server.URL + "/mirror/" + archiveName + "': expected '" + hex.EncodeToString(checksum[:]) + "'",
+		},
+		"configured checksum mismatch": {
+			helm:          functions.Helm{Version: "3.8.1", Checksum: strings.Repeat("0", 64), DownloadURL: server.URL + "/mirror"},
+			expectedError: "checksum mismatch for '" + server.URL + "/mirror/" + archiveName + "': expected '" + strings.Repeat("0", 64) + "'",
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cacheDir, tempDir := t.TempDir(), t.TempDir()
+			logger := log.New(&internal.TestWriter{T: t}, "", 0)
+			if err := tc.helm.Invoke(logger, t.TempDir(), cacheDir, tempDir, &bytes.Buffer{}, &bytes.Buffer{}); err == nil {
+				t.Fatalf("expected error, got nil")
+			} else if !strings.Contains(err.Error(), tc.expectedError) {
+				t.Fatalf("expected error containing '%s', got: %v", tc.expectedError, err)
+			}
+			for _, dir := range []string{cacheDir, tempDir} {
+				if entries, err := os.ReadDir(dir); err != nil {
+					t.Fatal(err)
+				} else if len(entries) > 0 {
+					t.Errorf("expected failed download to leave nothing behind in '%s', found: %s", dir, entries[0].Name())
+				}
+			}
+		})
+	}
+}
+
+func TestLockFileRefreshedWhileHeld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "entry.lock")
+	logger := log.New(&internal.TestWriter{T: t}, "", 0)
+	unlock, err := internal.AcquireLockFile(logger, path, time.Second, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed acquiring lock: %v", err)
+	}
+
+	// Lock files held longer than their stale age must not be considered abandoned
+	time.Sleep(500 * time.Millisecond)
+	if _, err := internal.AcquireLockFile(logger, path, 100*time.Millisecond, 200*time.Millisecond); err == nil {
+		t.Fatalf("expected held lock not to be acquired, got nil")
+	} else if !strings.Contains(err.Error(), "timed out waiting for lock file") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	unlock()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected lock file to be removed once released, got: %v", err)
+	} else if unlock, err := internal.AcquireLockFile(logger, path, 100*time.Millisecond, 200*time.Millisecond); err != nil {
+		t.Errorf("failed acquiring released lock: %v", err)
+	} else {
+		unlock()
+	}
+}
@@ -0,0 +1,300 @@
+package kude
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-getter/v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	LockFileName   = "kude.lock"
+	LockAPIVersion = "kude.kfirs.com/v1alpha1"
+	LockKind       = "Lock"
+)
+
+// LockedResource pins a remote resource to the exact content it had when it was locked.
+type LockedResource struct {
+	URL      string `yaml:"url"`
+	Revision string `yaml:"revision,omitempty"`
+	Checksum string `yaml:"checksum"`
+}
+
+// LockedImage pins a function image to the digest it had when it was locked.
+type LockedImage struct {
+	Image  string `yaml:"image"`
+	Digest string `yaml:"digest"`
+}
+
+// Lock pins the remote resources & function images used by a package tree (including nested packages), so that
+// subsequent builds use the exact same inputs. In verification mode, builds fail if a resource or image differs from
+// (or is missing in) the lock; in update mode, whatever is resolved during the build is recorded instead.
+type Lock struct {
+	APIVersion string           `yaml:"apiVersion"`
+	Kind       string           `yaml:"kind"`
+	Resources  []LockedResource `yaml:"resources,omitempty"`
+	Images     []LockedImage    `yaml:"images,omitempty"`
+	update     bool
+	mutex      sync.Mutex
+	resources  map[string]LockedResource
+	images     map[string]LockedImage
+}
+
+// LoadLock loads the lock file in the given package directory. In update mode, a missing lock file results in an
+// empty lock that will be populated during the build; otherwise, a missing lock file results in a nil lock, meaning
+// nothing is verified.
+func LoadLock(dir string, update bool) (*Lock, error) {
+	lock := &Lock{
+		APIVersion: LockAPIVersion,
+		Kind:       LockKind,
+		update:     update,
+		resources:  make(map[string]LockedResource),
+		images:     make(map[string]LockedImage),
+	}
+
+	path := filepath.Join(dir, LockFileName)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if update {
+			return lock, nil
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed reading '%s': %w", path, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(lock); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decode '%s': %w", path, locateYAMLError(path, err))
+	} else if lock.APIVersion != LockAPIVersion {
+		return nil, fmt.Errorf("%s: unsupported apiVersion: '%s' (should be '%s')", path, lock.APIVersion, LockAPIVersion)
+	} else if lock.Kind != LockKind {
+		return nil, fmt.Errorf("%s: unsupported kind: '%s' (should be '%s')", path, lock.Kind, LockKind)
+	}
+	if !update {
+		for _, r := range lock.Resources {
+			lock.resources[r.URL] = r
+		}
+		for _, i := range lock.Images {
+			lock.images[i.Image] = i
+		}
+	}
+	return lock, nil
+}
+
+// Save writes the lock into the lock file in the given package directory. Only the resources & images recorded
+// during the build are written, so entries no longer used by the package are pruned.
+func (l *Lock) Save(dir string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.Resources = make([]LockedResource, 0, len(l.resources))
+	for _, r := range l.resources {
+		l.Resources = append(l.Resources, r)
+	}
+	sort.Slice(l.Resources, func(i, j int) bool { return l.Resources[i].URL < l.Resources[j].URL })
+
+	l.Images = make([]LockedImage, 0, len(l.images))
+	for _, i := range l.images {
+		l.Images = append(l.Images, i)
+	}
+	sort.Slice(l.Images, func(i, j int) bool { return l.Images[i].Image < l.Images[j].Image })
+
+	b := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(l); err != nil {
+		return fmt.Errorf("failed encoding lock: %w", err)
+	} else if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed encoding lock: %w", err)
+	}
+
+	path := filepath.Join(dir, LockFileName)
+	if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed writing '%s': %w", path, err)
+	}
+	return nil
+}
+
+// pinResource returns the URL to download the given resource from. For Git resources locked to a specific revision,
+// the URL's "ref" query parameter is set to that revision, and its "depth" query parameter (if any) is removed: a
+// shallow clone only contains the history of the branch tip, which may no longer include the locked commit.
+func (l *Lock) pinResource(url string) string {
+	if l == nil || l.update {
+		return url
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if locked, found := l.resources[url]; found && locked.Revision != "" {
+		return setURLQueryParameter(removeURLQueryParameter(url, "depth"), "ref", locked.Revision)
+	}
+	return url
+}
+
+// verifyResource verifies that the given resource, as downloaded, matches the lock (or records it, in update mode).
+func (l *Lock) verifyResource(url, revision, checksum string) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	actual := LockedResource{URL: url, Revision: revision, Checksum: checksum}
+	if l.update {
+		l.resources[url] = actual
+		return nil
+	} else if locked, found := l.resources[url]; !found {
+		return fmt.Errorf("resource '%s' is not locked in %s (use --update-lock to add it)", url, LockFileName)
+	} else if locked != actual {
+		return fmt.Errorf("resource '%s' has drifted from %s: expected revision '%s' and checksum '%s', found revision '%s' and checksum '%s' (use --update-lock to accept)", url, LockFileName, locked.Revision, locked.Checksum, revision, checksum)
+	}
+	return nil
+}
+
+// pinImage returns the image reference to pull & run for the given image - pinned to its locked digest, if any.
+func (l *Lock) pinImage(image string) string {
+	if l == nil || l.update {
+		return image
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if locked, found := l.images[image]; found {
+		return imageRepository(image) + "@" + locked.Digest
+	}
+	return image
+}
+
+// verifyImage verifies that the given image's digest matches the lock (or records it, in update mode).
+func (l *Lock) verifyImage(image, digest string) error {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.update {
+		l.images[image] = LockedImage{Image: image, Digest: digest}
+		return nil
+	} else if locked, found := l.images[image]; !found {
+		return fmt.Errorf("image '%s' is not locked in %s (use --update-lock to add it)", image, LockFileName)
+	} else if locked.Digest != digest {
+		return fmt.Errorf("image '%s' has drifted from %s: expected digest '%s', found '%s' (use --update-lock to accept)", image, LockFileName, locked.Digest, digest)
+	}
+	return nil
+}
+
+// isRemoteResource checks whether the given resource URL refers to a remote resource, as opposed to a local path
+// relative to the given package directory. This is decided by the URL's form, the same way go-getter picks the getter
+// to download it with (using the given getters, or the default ones if nil): URLs handled by the file getter are local
+// paths, whether they exist or not.
+func isRemoteResource(pwd, url string, getters []getter.Getter) bool {
+	if getters == nil {
+		getters = getter.Getters
+	}
+	for _, g := range getters {
+		req := &getter.Request{Src: url, Pwd: pwd}
+		if detected, err := getter.Detect(req, g); err == nil && detected {
+			_, local := g.(*getter.FileGetter)
+			return !local
+		}
+	}
+	return false
+}
+
+// resolveGitRevision returns the commit SHA checked out in the given directory, or an empty string if the directory is
+// not a Git working tree. The directory must be the root of the clone - "//subdir" selections of a repository do not
+// retain its Git metadata, which is why remote resources are downloaded without their subdirectory first.
+func resolveGitRevision(dir string) (string, error) {
+	if stat, err := os.Stat(filepath.Join(dir, ".git")); err != nil || !stat.IsDir() {
+		return "", nil
+	}
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	if output, err := cmd.Output(); err != nil {
+		return "", fmt.Errorf("failed resolving Git revision of '%s': %w", dir, err)
+	} else {
+		return strings.TrimSpace(string(output)), nil
+	}
+}
+
+// checksumPath computes a checksum of the given file, or of the given directory's files (their relative paths and
+// contents), ignoring Git metadata.
+func checksumPath(path string) (string, error) {
+	hash := sha256.New()
+	err := filepath.WalkDir(path, func(file string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if e.IsDir() {
+			if e.Name() == ".git" {
+				return fs.SkipDir
+			}
+			return nil
+		} else if !e.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return fmt.Errorf("failed computing relative path of '%s': %w", file, err)
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("failed opening '%s': %w", file, err)
+		}
+		defer f.Close()
+		fileHash := sha256.New()
+		if _, err := io.Copy(fileHash, f); err != nil {
+			return fmt.Errorf("failed reading '%s': %w", file, err)
+		}
+		_, _ = fmt.Fprintf(hash, "%s\x00%x\n", filepath.ToSlash(rel), fileHash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// setURLQueryParameter sets the given query parameter of a go-getter URL, replacing its current value (if any).
+func setURLQueryParameter(url, name, value string) string {
+	url = removeURLQueryParameter(url, name)
+	if strings.Contains(url, "?") {
+		return url + "&" + name + "=" + value
+	}
+	return url + "?" + name + "=" + value
+}
+
+// removeURLQueryParameter removes the given query parameter from a go-getter URL, if present.
+func removeURLQueryParameter(url, name string) string {
+	base, query, _ := strings.Cut(url, "?")
+	var params []string
+	if query != "" {
+		for _, param := range strings.Split(query, "&") {
+			if key, _, _ := strings.Cut(param, "="); key != name {
+				params = append(params, param)
+			}
+		}
+	}
+	if len(params) == 0 {
+		return base
+	}
+	return base + "?" + strings.Join(params, "&")
+}
+
+// imageRepository returns the repository of the given image reference, without its tag or digest.
+func imageRepository(image string) string {
+	image, _, _ = strings.Cut(image, "@")
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[:i]
+	}
+	return image
+}
@@ -0,0 +1,240 @@
+package kude
+
+import (
+	"bytes"
+	"context"
+	"github.com/arikkfir/kude/internal"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLockPinsAndVerifiesGitResources(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	repo := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+	}
+	commit := func(name string) {
+		yml := "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: " + name + "\n"
+		if err := os.WriteFile(filepath.Join(repo, "service-account.yaml"), []byte(yml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", "-A")
+		git("commit", "-q", "-m", name)
+	}
+	git("init", "-q")
+	commit("first")
+
+	pkg := t.TempDir()
+	kudeYAML := "apiVersion: kude.kfirs.com/v1alpha2\nkind: Pipeline\nresources:\n  - git::file://" + filepath.ToSlash(repo) + "?depth=1\n"
+	if err := os.WriteFile(filepath.Join(pkg, "kude.yaml"), []byte(kudeYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cache := t.TempDir()
+	build := func(update bool) (string, error) {
+		lock, err := LoadLock(pkg, update)
+		if err != nil {
+			return "", err
+		}
+		p, err := NewPipeline(pkg)
+		if err != nil {
+			return "", err
+		}
+		e, err := NewExecution(p, log.New(&internal.TestWriter{T: t}, "", 0), WithLock(lock), WithCache(NewCache(cache, 0, false)))
+		if err != nil {
+			return "", err
+		}
+		out := &bytes.Buffer{}
+		if err := e.ExecuteToWriter(context.Background(), out); err != nil {
+			return "", err
+		} else if update {
+			if err := lock.Save(pkg); err != nil {
+				return "", err
+			}
+		}
+		return out.String(), nil
+	}
+
+	// Lock the package, then commit a change: builds must still use the locked revision
+	if _, err := build(true); err != nil {
+		t.Fatalf("failed locking package: %v", err)
+	}
+	commit("second")
+	if out, err := build(false); err != nil {
+		t.Fatalf("failed building locked package: %v", err)
+	} else if !strings.Contains(out, "name: first") {
+		t.Errorf("expected locked revision to be used, got:\n%s", out)
+	}
+
+	// Updating the lock must pick up the new revision
+	if out, err := build(true); err != nil {
+		t.Fatalf("failed updating lock: %v", err)
+	} else if !strings.Contains(out, "name: second") {
+		t.Errorf("expected new revision to be used, got:\n%s", out)
+	}
+
+	// Tampering with the locked checksum must be detected as drift
+	lockFile := filepath.Join(pkg, LockFileName)
+	b, err := os.ReadFile(lockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := strings.Replace(string(b), "checksum: sha256:", "checksum: sha256:0", 1)
+	if err := os.WriteFile(lockFile, []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	} else if _, err := build(false); err == nil {
+		t.Errorf("expected drift error, got nil")
+	} else if !strings.Contains(err.Error(), "has drifted from kude.lock") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Resources missing from the lock must be rejected
+	if err := os.WriteFile(lockFile, []byte("apiVersion: kude.kfirs.com/v1alpha1\nkind: Lock\n"), 0644); err != nil {
+		t.Fatal(err)
+	} else if _, err := build(false); err == nil {
+		t.Errorf("expected missing lock entry error, got nil")
+	} else if !strings.Contains(err.Error(), "is not locked in kude.lock") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLockResolvesRevisionOfGitSubdirectories(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	work, bare := t.TempDir(), filepath.Join(t.TempDir(), "repo.git")
+	git := func(dir string, args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	if err := os.MkdirAll(filepath.Join(work, "deploy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	yml := "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: test\n"
+	if err := os.WriteFile(filepath.Join(work, "deploy", "service-account.yaml"), []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git(work, "init", "-q")
+	git(work, "add", "-A")
+	git(work, "commit", "-q", "-m", "test")
+	git(work, "clone", "-q", "--bare", work, bare)
+	revision := git(work, "rev-parse", "HEAD")
+
+	url := "git::file://" + filepath.ToSlash(bare) + "//deploy"
+	for name, cache := range map[string]*Cache{"uncached": nil, "cached": NewCache(t.TempDir(), 0, false)} {
+		t.Run(name, func(t *testing.T) {
+			pkg := t.TempDir()
+			kudeYAML := "apiVersion: kude.kfirs.com/v1alpha2\nkind: Pipeline\nresources:\n  - " + url + "\n"
+			if err := os.WriteFile(filepath.Join(pkg, "kude.yaml"), []byte(kudeYAML), 0644); err != nil {
+				t.Fatal(err)
+			}
+			lock, err := LoadLock(pkg, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := NewPipeline(pkg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options := []ExecutionOption{WithLock(lock)}
+			if cache != nil {
+				options = append(options, WithCache(cache))
+			}
+			e, err := NewExecution(p, log.New(&internal.TestWriter{T: t}, "", 0), options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := &bytes.Buffer{}
+			if err := e.ExecuteToWriter(context.Background(), out); err != nil {
+				t.Fatalf("failed building package: %v", err)
+			} else if !strings.Contains(out.String(), "name: test") {
+				t.Errorf("expected resources of the subdirectory, got:\n%s", out)
+			} else if err := lock.Save(pkg); err != nil {
+				t.Fatal(err)
+			}
+
+			if b, err := os.ReadFile(filepath.Join(pkg, LockFileName)); err != nil {
+				t.Fatal(err)
+			} else if !strings.Contains(string(b), "revision: "+revision) {
+				t.Errorf("expected revision '%s' to be locked, got:\n%s", revision, b)
+			}
+		})
+	}
+}
+
+func TestIsRemoteResource(t *testing.T) {
+	pwd := t.TempDir()
+	testCases := map[string]bool{
+		"deployment.yaml":                    false,
+		"missing/deployment.yaml":            false,
+		"./base":                             false,
+		"/absolute/missing/path":             false,
+		"github.com/my-org/my-repo//deploy":  true,
+		"git::file:///tmp/repo.git//deploy":  true,
+		"git@github.com:my-org/my-repo.git":  true,
+		"https://example.com/manifests.yaml": true,
+	}
+	for url, expected := range testCases {
+		if actual := isRemoteResource(pwd, url, nil); actual != expected {
+			t.Errorf("expected %v for '%s', got %v", expected, url, actual)
+		}
+	}
+}
+
+func TestSetURLQueryParameter(t *testing.T) {
+	testCases := map[string]string{
+		"github.com/a/b":                      "github.com/a/b?ref=abc",
+		"github.com/a/b//dir?ref=main":        "github.com/a/b//dir?ref=abc",
+		"git::https://x/y.git?depth=1&ref=v1": "git::https://x/y.git?depth=1&ref=abc",
+	}
+	for url, expected := range testCases {
+		if actual := setURLQueryParameter(url, "ref", "abc"); actual != expected {
+			t.Errorf("expected '%s' for '%s', got '%s'", expected, url, actual)
+		}
+	}
+}
+
+func TestRemoveURLQueryParameter(t *testing.T) {
+	testCases := map[string]string{
+		"github.com/a/b":                      "github.com/a/b",
+		"github.com/a/b//dir?depth=1":         "github.com/a/b//dir",
+		"git::https://x/y.git?depth=1&ref=v1": "git::https://x/y.git?ref=v1",
+		"git::https://x/y.git?ref=v1&depth=1": "git::https://x/y.git?ref=v1",
+	}
+	for url, expected := range testCases {
+		if actual := removeURLQueryParameter(url, "depth"); actual != expected {
+			t.Errorf("expected '%s' for '%s', got '%s'", expected, url, actual)
+		}
+	}
+}
+
+func TestImageRepository(t *testing.T) {
+	testCases := map[string]string{
+		"ghcr.io/arikkfir/kude/functions/annotate:v1": "ghcr.io/arikkfir/kude/functions/annotate",
+		"localhost:5000/image":                        "localhost:5000/image",
+		"localhost:5000/image:latest":                 "localhost:5000/image",
+		"busybox@sha256:abc":                          "busybox",
+	}
+	for image, expected := range testCases {
+		if actual := imageRepository(image); actual != expected {
+			t.Errorf("expected '%s' for '%s', got '%s'", expected, image, actual)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package kude
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/arikkfir/kude/internal"
+	"github.com/arikkfir/kyaml/pkg"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"sync"
+)
+
+// packageGraph records the packages imported throughout a package tree, and their rendered resources. It is shared by
+// all executions of the tree. Before anything is rendered, the root execution resolves the whole graph (see resolve),
+// rejecting import cycles. Rendering then consults the graph before each nested package is executed, to render
+// packages imported more than once (diamond imports) only once - every importer then receives its own copy of the
+// rendered resources, to which it applies its own steps. Since the graph is acyclic, every package is rendered after
+// the packages it imports.
+type packageGraph struct {
+	mutex    sync.Mutex
+	colours  map[string]packageColour
+	rendered map[string]*renderedPackage
+}
+
+// packageColour is the resolution state of a package in the graph.
+type packageColour int
+
+const (
+	packageUnresolved packageColour = iota
+	packageResolving
+	packageResolved
+)
+
+func newPackageGraph() *packageGraph {
+	return &packageGraph{
+		colours:  make(map[string]packageColour),
+		rendered: make(map[string]*renderedPackage),
+	}
+}
+
+// resolve resolves the packages imported by the package of the given execution, depth-first. Its resources are
+// fetched, but not rendered - each nested package found in them is visited, resolved recursively and left (see
+// resourceReader.resolvePackage). An import cycle is thus detected wherever it occurs in the tree, even if its
+// packages are first imported by different importers (e.g. one importing "a" which imports "b", and another importing
+// "b" which imports "a"), which would otherwise wait for each other's rendering indefinitely.
+func (g *packageGraph) resolve(ctx context.Context, e *executionImpl) error {
+	if e.input != nil && !e.nested {
+		return nil
+	}
+	for _, resource := range e.pipeline.GetResourceEntries() {
+		r := e.newResourceReader(ctx, resource, nil)
+		r.resolving = true
+		if err := r.Read(resource.GetURL()); err != nil {
+			return fmt.Errorf("failed streaming resources found in '%s': %w", redactURL(resource.GetURL()), redactError(err))
+		}
+	}
+	return nil
+}
+
+// visit marks the given package, imported with the given parameters by the package at the end of the given chain, as
+// being resolved. It returns true if the package was resolved already (e.g. a diamond import), in which case it needs
+// not be resolved again. An error is returned if the package is being resolved, or is in the chain (with different
+// parameters) - an import cycle.
+func (g *packageGraph) visit(chain []string, pkg string, parameters map[string]interface{}) (bool, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	switch g.colours[pkg+"?"+parametersKey(parameters)] {
+	case packageResolved:
+		return true, nil
+	case packageResolving:
+		return false, cycleError(chain, pkg)
+	}
+	for _, ancestor := range chain {
+		if ancestor == pkg {
+			return false, cycleError(chain, pkg)
+		}
+	}
+	g.colours[pkg+"?"+parametersKey(parameters)] = packageResolving
+	return false, nil
+}
+
+// leave marks the given package, imported with the given parameters, as resolved.
+func (g *packageGraph) leave(pkg string, parameters map[string]interface{}) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.colours[pkg+"?"+parametersKey(parameters)] = packageResolved
+}
+
+// cycleError returns the error for the import cycle closed by importing the given package at the end of the chain.
+func cycleError(chain []string, pkg string) error {
+	cycle := []string{pkg}
+	for i, ancestor := range chain {
+		if ancestor == pkg {
+			cycle = append(append([]string{}, chain[i:]...), pkg)
+			break
+		}
+	}
+	return fmt.Errorf("package import cycle detected: %s", strings.Join(cycle, " -> "))
+}
+
+// renderedPackage is the rendering of a package imported in the tree, shared by all of its importers.
+type renderedPackage struct {
+	importer  string
+	done      chan struct{}
+	resources []*yaml.Node
+	err       error
+}
+
+// add records that the package at the end of the given chain imports the given package with the given parameters. The
+// chain lists the packages leading to the importing package, starting with the root package; the graph must have been
+// resolved beforehand, so it is known to be free of import cycles. The package's rendering is returned, along with
+// whether the caller is the first importer, and must therefore render the package and complete the rendering; other
+// importers (the same package imported with the same parameters elsewhere in the tree) must wait for it instead. A nil
+// rendering is returned if the graph is not tracked, in which case the caller renders the package on its own.
+func (g *packageGraph) add(chain []string, pkg string, parameters map[string]interface{}) (*renderedPackage, bool) {
+	if g == nil || len(chain) == 0 {
+		return nil, true
+	}
+
+	importer := chain[len(chain)-1]
+	key := pkg + "?" + parametersKey(parameters)
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if rendering, found := g.rendered[key]; found {
+		return rendering, false
+	}
+	rendering := &renderedPackage{importer: importer, done: make(chan struct{})}
+	g.rendered[key] = rendering
+	return rendering, true
+}
+
+// complete records the outcome of rendering the package, releasing the importers waiting for it. The given resources
+// are retained as-is, so the caller must not modify them afterwards.
+func (p *renderedPackage) complete(resources []*yaml.Node, err error) {
+	p.resources, p.err = resources, err
+	close(p.done)
+}
+
+// wait waits for the package to be rendered, and returns a copy of its resources.
+func (p *renderedPackage) wait(ctx context.Context) ([]*kyaml.RNode, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.done:
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("failed rendering package for '%s': %w", p.importer, p.err)
+	}
+	resources := make([]*kyaml.RNode, len(p.resources))
+	for i, node := range p.resources {
+		resources[i] = &kyaml.RNode{N: internal.CopyNode(node)}
+	}
+	return resources, nil
+}
+
+// parametersKey returns a canonical representation of the given package parameters.
+func parametersKey(parameters map[string]interface{}) string {
+	if len(parameters) == 0 {
+		return ""
+	} else if b, err := json.Marshal(parameters); err == nil {
+		return string(b) // JSON encoding sorts map keys
+	} else {
+		return fmt.Sprintf("%v", parameters) // fmt sorts map keys as well
+	}
+}
@@ -0,0 +1,75 @@
+package kude
+
+import (
+	"context"
+	"gopkg.in/yaml.v3"
+	"testing"
+)
+
+func TestPackageGraphRejectsCycles(t *testing.T) {
+	g := newPackageGraph()
+	chain := []string{"/root", "/root/a", "/root/a/b"}
+	for i, pkg := range chain {
+		if _, err := g.visit(chain[:i], pkg, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := g.visit(chain, "/root/a", nil); err == nil {
+		t.Fatalf("expected cycle error")
+	} else if expected := "package import cycle detected: /root/a -> /root/a/b -> /root/a"; err.Error() != expected {
+		t.Fatalf("incorrect error: expected '%s', got '%s'", expected, err)
+	}
+	if _, err := g.visit(chain, "/root/a", map[string]interface{}{"env": "prod"}); err == nil {
+		t.Fatalf("expected cycle error for package imported by itself with different parameters")
+	}
+}
+
+func TestPackageGraphResolvesDiamonds(t *testing.T) {
+	g := newPackageGraph()
+	if resolved, err := g.visit([]string{"/root", "/root/a"}, "/base", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if resolved {
+		t.Fatalf("first import must be resolved")
+	}
+	g.leave("/base", nil)
+	if resolved, err := g.visit([]string{"/root", "/root/b"}, "/base", nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if !resolved {
+		t.Fatalf("second import must not be resolved again")
+	}
+}
+
+func TestPackageGraphDetectsDiamonds(t *testing.T) {
+	g := newPackageGraph()
+	rendering, first := g.add([]string{"/root", "/root/a"}, "base", nil)
+	if !first {
+		t.Fatalf("first import must be rendered, but was reported as rendered by '%s'", rendering.importer)
+	}
+	if reused, first := g.add([]string{"/root", "/root/b"}, "base", nil); first {
+		t.Fatalf("second import must reuse the first rendering")
+	} else if reused != rendering || reused.importer != "/root/a" {
+		t.Fatalf("second import must be reported as rendered by '/root/a', got '%s'", reused.importer)
+	}
+	if _, first := g.add([]string{"/root", "/root/b"}, "base", map[string]interface{}{"env": "prod"}); !first {
+		t.Fatalf("import with different parameters must be rendered")
+	}
+
+	// Importers reusing a rendering receive their own copies of its resources
+	node := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte("apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: base\n"), node); err != nil {
+		t.Fatal(err)
+	}
+	rendering.complete([]*yaml.Node{node.Content[0]}, nil)
+	copy1, err := rendering.wait(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := copy1[0].SetNamespace("changed"); err != nil {
+		t.Fatal(err)
+	}
+	if copy2, err := rendering.wait(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	} else if namespace, _ := copy2[0].GetNamespace(); namespace != "" {
+		t.Errorf("expected an unmodified copy of the rendered resources, got namespace '%s'", namespace)
+	}
+}
@@ -0,0 +1,209 @@
+package kude
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	ParameterTypeString  = "string"
+	ParameterTypeInteger = "integer"
+	ParameterTypeNumber  = "number"
+	ParameterTypeBoolean = "boolean"
+)
+
+var (
+	// parameterNameRE matches valid parameter names.
+	parameterNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_-]*$`)
+
+	// parameterReferenceRE matches parameter references inside pipeline values, e.g. "${{ params.replicas }}", as well
+	// as the "$${{" escape sequence, which stands for a literal "${{".
+	parameterReferenceRE = regexp.MustCompile(`\$\$\{\{|\$\{\{\s*params\.([a-zA-Z_][a-zA-Z0-9_-]*)\s*}}`)
+)
+
+// coerce converts the given value to this parameter's type. String values (e.g. from the command line) are parsed,
+// while values that are already typed (e.g. from a YAML file) are only checked for compatibility.
+func (p *parameterImpl) coerce(value interface{}) (interface{}, error) {
+	switch p.Type {
+	case ParameterTypeString:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case float32, float64, bool:
+			return fmt.Sprint(v), nil
+		}
+		if _, ok := integerValue(value); ok {
+			return fmt.Sprint(value), nil
+		}
+	case ParameterTypeInteger:
+		if i, ok := integerValue(value); ok {
+			return i, nil
+		}
+		switch v := value.(type) {
+		case string:
+			if i, err := strconv.Atoi(strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("invalid integer value '%s' for parameter '%s'", v, p.Name)
+			} else {
+				return i, nil
+			}
+		}
+	case ParameterTypeNumber:
+		if i, ok := integerValue(value); ok {
+			return float64(i), nil
+		}
+		switch v := value.(type) {
+		case float32:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+				return nil, fmt.Errorf("invalid number value '%s' for parameter '%s'", v, p.Name)
+			} else {
+				return f, nil
+			}
+		}
+	case ParameterTypeBoolean:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(v)); err != nil {
+				return nil, fmt.Errorf("invalid boolean value '%s' for parameter '%s'", v, p.Name)
+			} else {
+				return b, nil
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type '%s' for parameter '%s'", p.Type, p.Name)
+	}
+	return nil, fmt.Errorf("invalid %s value '%v' for parameter '%s'", p.Type, value, p.Name)
+}
+
+// integerValue returns the given value as an int, if it is of any Go integer type, and fits in one.
+func integerValue(value interface{}) (int, bool) {
+	switch v := reflect.ValueOf(value); v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if i := v.Int(); int64(int(i)) == i {
+			return int(i), true
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := v.Uint(); u <= math.MaxInt {
+			return int(u), true
+		}
+	}
+	return 0, false
+}
+
+// resolveParameters validates the pipeline's parameter declarations, and computes the value of each parameter from
+// the given overrides (falling back to the parameter's default). Parameters with no default must be provided.
+func resolveParameters(parameters []*parameterImpl, overrides map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(parameters))
+	for i, parameter := range parameters {
+		if parameter.Name == "" {
+			return nil, fmt.Errorf("parameter #%d has no name", i)
+		} else if !parameterNameRE.MatchString(parameter.Name) {
+			return nil, fmt.Errorf("invalid parameter name '%s'", parameter.Name)
+		} else if _, found := values[parameter.Name]; found {
+			return nil, fmt.Errorf("parameter '%s' is declared more than once", parameter.Name)
+		}
+		if parameter.Type == "" {
+			parameter.Type = ParameterTypeString
+		}
+
+		value, found := overrides[parameter.Name]
+		if !found {
+			if parameter.Default == nil {
+				return nil, fmt.Errorf("parameter '%s' has no default value, and no value was provided", parameter.Name)
+			}
+			value = parameter.Default
+		}
+		if coerced, err := parameter.coerce(value); err != nil {
+			return nil, err
+		} else {
+			values[parameter.Name] = coerced
+		}
+	}
+	for name := range overrides {
+		if _, found := values[name]; !found {
+			return nil, fmt.Errorf("unknown parameter '%s'", name)
+		}
+	}
+	return values, nil
+}
+
+// interpolate replaces parameter references in the given value with the values of the referenced parameters. Maps
+// and slices are interpolated recursively. A string that consists solely of a single reference is replaced by the
+// parameter's value as-is, retaining its type; references embedded in longer strings are replaced textually. A "$${{"
+// sequence is replaced by a literal "${{", and is not treated as a reference.
+func interpolate(value interface{}, parameters map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return interpolateString(v, parameters)
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			if interpolated, err := interpolate(item, parameters); err != nil {
+				return nil, fmt.Errorf("failed interpolating '%s': %w", key, err)
+			} else {
+				result[key] = interpolated
+			}
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			if interpolated, err := interpolate(item, parameters); err != nil {
+				return nil, fmt.Errorf("failed interpolating item #%d: %w", i, err)
+			} else {
+				result[i] = interpolated
+			}
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
+
+func interpolateString(s string, parameters map[string]interface{}) (interface{}, error) {
+	if groups := parameterReferenceRE.FindStringSubmatch(s); groups != nil && groups[0] == s && groups[1] != "" {
+		if value, found := parameters[groups[1]]; found {
+			return value, nil
+		}
+		return nil, fmt.Errorf("unknown parameter '%s'", groups[1])
+	}
+
+	var err error
+	result := parameterReferenceRE.ReplaceAllStringFunc(s, func(reference string) string {
+		name := parameterReferenceRE.FindStringSubmatch(reference)[1]
+		if name == "" {
+			return "${{"
+		} else if value, found := parameters[name]; found {
+			return fmt.Sprint(value)
+		} else if err == nil {
+			err = fmt.Errorf("unknown parameter '%s'", name)
+		}
+		return reference
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// interpolateStrings interpolates each of the given strings, expecting the results to be strings as well.
+func interpolateStrings(values []string, parameters map[string]interface{}) ([]string, error) {
+	result := make([]string, len(values))
+	for i, value := range values {
+		if interpolated, err := interpolateString(value, parameters); err != nil {
+			return nil, err
+		} else {
+			result[i] = fmt.Sprint(interpolated)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,125 @@
+package kude
+
+import (
+	"io/ioutil"
+	"math"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestResolveParameters(t *testing.T) {
+	parameters := []*parameterImpl{
+		{Name: "name", Default: "test"},
+		{Name: "replicas", Type: ParameterTypeInteger, Default: 1},
+		{Name: "ratio", Type: ParameterTypeNumber, Default: 1},
+		{Name: "debug", Type: ParameterTypeBoolean, Default: false},
+		{Name: "port", Type: ParameterTypeInteger, Default: 80},
+		{Name: "timeout", Type: ParameterTypeNumber, Default: 1.5},
+		{Name: "tag", Default: 1},
+	}
+	values, err := resolveParameters(parameters, map[string]interface{}{"replicas": "3", "debug": true, "port": uint64(8080), "timeout": int64(30), "tag": int32(7)})
+	if err != nil {
+		t.Fatalf("failed resolving parameters: %v", err)
+	}
+	expected := map[string]interface{}{"name": "test", "replicas": 3, "ratio": 1.0, "debug": true, "port": 8080, "timeout": 30.0, "tag": "7"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+
+	testCases := map[string]struct {
+		parameters    []*parameterImpl
+		overrides     map[string]interface{}
+		expectedError string
+	}{
+		"missing value":    {[]*parameterImpl{{Name: "a"}}, nil, "parameter 'a' has no default value, and no value was provided"},
+		"unknown":          {[]*parameterImpl{{Name: "a", Default: "x"}}, map[string]interface{}{"b": "y"}, "unknown parameter 'b'"},
+		"duplicate":        {[]*parameterImpl{{Name: "a", Default: "x"}, {Name: "a", Default: "y"}}, nil, "parameter 'a' is declared more than once"},
+		"invalid name":     {[]*parameterImpl{{Name: "a.b", Default: "x"}}, nil, "invalid parameter name 'a.b'"},
+		"invalid type":     {[]*parameterImpl{{Name: "a", Type: "list", Default: "x"}}, nil, "unsupported type 'list' for parameter 'a'"},
+		"invalid integer":  {[]*parameterImpl{{Name: "a", Type: ParameterTypeInteger, Default: 1}}, map[string]interface{}{"a": "x"}, "invalid integer value 'x' for parameter 'a'"},
+		"integer overflow": {[]*parameterImpl{{Name: "a", Type: ParameterTypeInteger, Default: uint64(math.MaxUint64)}}, nil, "invalid integer value '18446744073709551615' for parameter 'a'"},
+		"invalid boolean":  {[]*parameterImpl{{Name: "a", Type: ParameterTypeBoolean, Default: 1}}, nil, "invalid boolean value '1' for parameter 'a'"},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := resolveParameters(tc.parameters, tc.overrides); err == nil {
+				t.Errorf("expected error, got nil")
+			} else if err.Error() != tc.expectedError {
+				t.Errorf("expected error '%s', got '%s'", tc.expectedError, err.Error())
+			}
+		})
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	parameters := map[string]interface{}{"name": "web", "replicas": 3}
+	config := map[string]interface{}{
+		"replicas": "${{ params.replicas }}",
+		"name":     "${{params.name}}-${{ params.replicas }}",
+		"escaped":  "$${{ params.name }}",
+		"mixed":    "$${{ env.X }}-${{ params.name }}",
+		"nested": map[string]interface{}{
+			"list": []interface{}{"${{ params.name }}", 1, true},
+		},
+	}
+	expected := map[string]interface{}{
+		"replicas": 3,
+		"name":     "web-3",
+		"escaped":  "${{ params.name }}",
+		"mixed":    "${{ env.X }}-web",
+		"nested": map[string]interface{}{
+			"list": []interface{}{"web", 1, true},
+		},
+	}
+	if actual, err := interpolate(config, parameters); err != nil {
+		t.Errorf("failed interpolating: %v", err)
+	} else if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	if _, err := interpolate(map[string]interface{}{"a": "x-${{ params.unknown }}"}, parameters); err == nil {
+		t.Errorf("expected error, got nil")
+	} else if err.Error() != "failed interpolating 'a': unknown parameter 'unknown'" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNewPipelineWithParameters(t *testing.T) {
+	kudeYAML := `###
+apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+parameters:
+  - name: replicas
+    type: integer
+    default: 1
+steps:
+  - image: ghcr.io/arikkfir/kude/functions/yq
+    config:
+      expression: .spec.replicas = ${{ params.replicas }}
+    mounts:
+      - replicas-${{ params.replicas }}.txt`
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(dir+"/kude.yaml", []byte(kudeYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewPipelineWithParameters(dir, map[string]interface{}{"replicas": "5"})
+	if err != nil {
+		t.Fatalf("failed creating pipeline: %v", err)
+	} else if value := p.GetParameterValues()["replicas"]; value != 5 {
+		t.Errorf("expected parameter value 5, got %v", value)
+	} else if expression := p.GetSteps()[0].GetConfig()["expression"]; expression != ".spec.replicas = 5" {
+		t.Errorf("expected interpolated expression, got '%v'", expression)
+	} else if mounts := p.GetSteps()[0].GetMounts(); len(mounts) != 1 || mounts[0] != "replicas-5.txt" {
+		t.Errorf("expected interpolated mounts, got %v", mounts)
+	}
+
+	if _, err := NewPipelineWithParameters(dir, map[string]interface{}{"replicas": "many"}); err == nil {
+		t.Errorf("expected error, got nil")
+	} else if matches, reErr := regexp.MatchString(`^.+/kude.yaml:5:3: invalid integer value 'many' for parameter 'replicas'$`, err.Error()); reErr != nil {
+		t.Fatal(reErr)
+	} else if !matches {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package kude
 
+import "github.com/arikkfir/kyaml/pkg"
+
 const (
 	PipelineAPIVersion = "kude.kfirs.com/v1alpha2"
 	PipelineKind       = "Pipeline"
@@ -10,7 +12,24 @@ type Pipeline interface {
 	GetKind() string
 	GetDirectory() string
 	GetResources() []string
+	GetResourceEntries() []Resource
+	GetOnConflict() string
+	GetParameters() []Parameter
+	GetParameterValues() map[string]interface{}
 	GetSteps() []Step
+	GetSkippedSteps() []Step
+}
+
+type Parameter interface {
+	GetName() string
+	GetType() string
+	GetDefault() interface{}
+	GetDescription() string
+}
+
+type Resource interface {
+	GetURL() string
+	GetWith() map[string]interface{}
 }
 
 type Step interface {
@@ -23,4 +42,7 @@ type Step interface {
 	GetNetwork() bool
 	GetMounts() []string
 	GetConfig() map[string]interface{}
+	GetWhen() string
+	GetIncludes() []kyaml.TargetingFilter
+	GetExcludes() []kyaml.TargetingFilter
 }
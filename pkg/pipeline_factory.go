@@ -1,7 +1,9 @@
 package kude
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/arikkfir/kude/internal"
 	"gopkg.in/yaml.v3"
 	"os"
 	"path/filepath"
@@ -19,31 +21,88 @@ func newInliningPipeline(dir string) (Pipeline, error) {
 }
 
 func NewPipeline(dir string) (Pipeline, error) {
+	return NewPipelineWithParameters(dir, nil)
+}
+
+// NewPipelineWithParameters creates a pipeline from the "kude.yaml" file in the given directory, using the given values
+// for the pipeline's parameters instead of their defaults. Parameter references in the pipeline's resources and in its
+// steps' configuration & mounts are interpolated with the resulting values.
+func NewPipelineWithParameters(dir string, parameters map[string]interface{}) (Pipeline, error) {
 	pwd, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
 	pipelineFilePath := filepath.Join(pwd, "kude.yaml")
-	f, err := os.Open(pipelineFilePath)
+	b, err := os.ReadFile(pipelineFilePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open '%s': %w", pipelineFilePath, err)
 	}
 
-	decoder := yaml.NewDecoder(f)
+	// Decode into a generic node first, so we can point at offending lines when validating the pipeline
+	root := &yaml.Node{}
+	if err := yaml.Unmarshal(b, root); err != nil {
+		return nil, fmt.Errorf("failed to decode '%s': %w", pipelineFilePath, locateYAMLError(pipelineFilePath, err))
+	}
+	root = documentContent(root)
+	location := func(n *yaml.Node) ResourceSource {
+		if n == nil {
+			return ResourceSource{Path: pipelineFilePath}
+		}
+		return ResourceSource{Path: pipelineFilePath, Line: n.Line, Column: n.Column}
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
 	decoder.KnownFields(true)
 	p := pipelineImpl{pwd: pwd}
 	if err := decoder.Decode(&p); err != nil {
-		return nil, fmt.Errorf("failed to decode '%s': %w", pipelineFilePath, err)
+		return nil, fmt.Errorf("failed to decode '%s': %w", pipelineFilePath, locateYAMLError(pipelineFilePath, err))
 	}
 
 	if apiVersion := p.GetAPIVersion(); apiVersion != PipelineAPIVersion {
-		return nil, fmt.Errorf("unsupported apiVersion: '%s' (should be '%s')", apiVersion, PipelineAPIVersion)
+		return nil, fmt.Errorf("%s: unsupported apiVersion: '%s' (should be '%s')", location(internal.MappingField(root, "apiVersion")), apiVersion, PipelineAPIVersion)
 	} else if kind := p.GetKind(); kind != PipelineKind {
-		return nil, fmt.Errorf("unsupported kind: '%s' (should be '%s')", kind, PipelineKind)
+		return nil, fmt.Errorf("%s: unsupported kind: '%s' (should be '%s')", location(internal.MappingField(root, "kind")), kind, PipelineKind)
+	}
+
+	switch p.OnConflict {
+	case "":
+		p.OnConflict = ConflictPolicyLast
+	case ConflictPolicyError, ConflictPolicyFirst, ConflictPolicyLast, ConflictPolicyMerge:
+	default:
+		return nil, fmt.Errorf("%s: invalid onConflict policy: '%s' (should be one of: %s)", location(internal.MappingField(root, "onConflict")), p.OnConflict, strings.Join(conflictPolicies, ", "))
+	}
+
+	if values, err := resolveParameters(p.Parameters, parameters); err != nil {
+		return nil, fmt.Errorf("%s: %w", location(internal.MappingField(root, "parameters")), err)
+	} else {
+		p.parameterValues = values
+	}
+	for i, resource := range p.Resources {
+		if url, err := interpolateString(resource.URL, p.parameterValues); err != nil {
+			return nil, fmt.Errorf("%s: failed interpolating URL of resource #%d: %w", location(internal.MappingField(root, "resources")), i, err)
+		} else {
+			resource.URL = fmt.Sprint(url)
+		}
+		if resource.With != nil {
+			if with, err := interpolate(resource.With, p.parameterValues); err != nil {
+				return nil, fmt.Errorf("%s: failed interpolating parameters of resource '%s': %w", location(internal.MappingField(root, "resources")), resource.URL, err)
+			} else {
+				resource.With = with.(map[string]interface{})
+			}
+		}
 	}
 
+	var stepNodes []*yaml.Node
+	if steps := internal.MappingField(root, "steps"); steps != nil && steps.Kind == yaml.SequenceNode {
+		stepNodes = steps.Content
+	}
+	conditionEnv := conditionEnvironment(p.parameterValues)
 	for i, step := range p.Steps {
+		var stepNode *yaml.Node
+		if i < len(stepNodes) {
+			stepNode = stepNodes[i]
+		}
 		if step.ID == "" {
 			step.ID = strconv.Itoa(i + 1)
 			if len(step.ID) < 3 {
@@ -51,7 +110,7 @@ func NewPipeline(dir string) (Pipeline, error) {
 			}
 		}
 		if step.Image == "" {
-			return nil, fmt.Errorf("step #%d (%s) has an empty image", i, step.Name)
+			return nil, fmt.Errorf("%s: step #%d (%s) has an empty image", location(stepNode), i, step.Name)
 		} else if !strings.Contains(step.Image, ":") {
 			step.Image = step.Image + ":" + strings.Join(GetVersion().Build, ".")
 		}
@@ -61,6 +120,23 @@ func NewPipeline(dir string) (Pipeline, error) {
 		if step.Workdir == "" {
 			step.Workdir = "/workspace"
 		}
+		if mounts, err := interpolateStrings(step.Mounts, p.parameterValues); err != nil {
+			return nil, fmt.Errorf("%s: failed interpolating mounts of step '%s': %w", location(stepNode), step.Name, err)
+		} else {
+			step.Mounts = mounts
+		}
+		if step.Config != nil {
+			if config, err := interpolate(step.Config, p.parameterValues); err != nil {
+				return nil, fmt.Errorf("%s: failed interpolating config of step '%s': %w", location(stepNode), step.Name, err)
+			} else {
+				step.Config = config.(map[string]interface{})
+			}
+		}
+		if enabled, err := evaluateCondition(step.When, conditionEnv); err != nil {
+			return nil, fmt.Errorf("%s: failed evaluating condition of step '%s': %w", location(internal.MappingField(stepNode, "when")), step.Name, err)
+		} else {
+			step.skipped = !enabled
+		}
 	}
 
 	return &p, nil
@@ -0,0 +1,76 @@
+package kude
+
+import (
+	"io/ioutil"
+	"regexp"
+	"testing"
+)
+
+func TestNewPipelineLocatesErrors(t *testing.T) {
+	testCases := map[string]struct {
+		kudeYAML      string
+		expectedError string
+	}{
+		"unknown field": {
+			kudeYAML: `###
+apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+unknown: true`,
+			expectedError: `^failed to decode '(.+)/kude.yaml': (.+)/kude.yaml:4: field unknown not found in type kude.pipelineImpl$`,
+		},
+		"bad apiVersion": {
+			kudeYAML: `###
+apiVersion: kude.kfirs.com/v1
+kind: Pipeline`,
+			expectedError: `^.+/kude.yaml:2:13: unsupported apiVersion: 'kude.kfirs.com/v1' \(should be 'kude.kfirs.com/v1alpha2'\)$`,
+		},
+		"unknown resource field": {
+			kudeYAML: `###
+apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+resources:
+  - url: foo
+    params: {}`,
+			expectedError: `^failed to decode '(.+)/kude.yaml': (.+)/kude.yaml:6: field params not found in resource$`,
+		},
+		"invalid condition": {
+			kudeYAML: `###
+apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+steps:
+  - image: foo
+    when: params.foo ==`,
+			expectedError: `^.+/kude.yaml:6:11: failed evaluating condition of step '001 // foo:.*': invalid condition 'params.foo ==': `,
+		},
+		"empty image": {
+			kudeYAML: `###
+apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+steps:
+  - image: foo
+  - name: bar`,
+			expectedError: `^.+/kude.yaml:6:5: step #1 \(bar\) has an empty image$`,
+		},
+		"invalid conflict policy": {
+			kudeYAML: `###
+apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+onConflict: ignore`,
+			expectedError: `^.+/kude.yaml:4:13: invalid onConflict policy: 'ignore' \(should be one of: error, first, last, merge\)$`,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := ioutil.WriteFile(dir+"/kude.yaml", []byte(tc.kudeYAML), 0644); err != nil {
+				t.Fatal(err)
+			} else if _, err := NewPipeline(dir); err == nil {
+				t.Errorf("expected error, got nil")
+			} else if matches, reErr := regexp.MatchString(tc.expectedError, err.Error()); reErr != nil {
+				t.Fatal(reErr)
+			} else if !matches {
+				t.Errorf("expected error to match '%s', got: %s", tc.expectedError, err.Error())
+			}
+		})
+	}
+}
@@ -1,27 +1,110 @@
 package kude
 
+import (
+	"fmt"
+	"github.com/arikkfir/kyaml/pkg"
+	"gopkg.in/yaml.v3"
+)
+
 type pipelineImpl struct {
-	APIVersion             string      `yaml:"apiVersion"`
-	Kind                   string      `yaml:"kind"`
-	pwd                    string      `yaml:"-"`
-	Resources              []string    `yaml:"resources"`
-	Steps                  []*stepImpl `yaml:"steps"`
+	APIVersion             string           `yaml:"apiVersion"`
+	Kind                   string           `yaml:"kind"`
+	pwd                    string           `yaml:"-"`
+	Parameters             []*parameterImpl `yaml:"parameters"`
+	Resources              []*resourceImpl  `yaml:"resources"`
+	OnConflict             string           `yaml:"onConflict"`
+	Steps                  []*stepImpl      `yaml:"steps"`
 	inlineBuiltinFunctions bool
+	parameterValues        map[string]interface{}
+}
+
+func (p *pipelineImpl) GetAPIVersion() string                      { return p.APIVersion }
+func (p *pipelineImpl) GetKind() string                            { return p.Kind }
+func (p *pipelineImpl) GetDirectory() string                       { return p.pwd }
+func (p *pipelineImpl) GetOnConflict() string                      { return p.OnConflict }
+func (p *pipelineImpl) GetParameterValues() map[string]interface{} { return p.parameterValues }
+
+// GetResources returns the URLs of the pipeline's resources.
+func (p *pipelineImpl) GetResources() []string {
+	urls := make([]string, len(p.Resources))
+	for i, resource := range p.Resources {
+		urls[i] = resource.GetURL()
+	}
+	return urls
+}
+
+// GetResourceEntries returns the pipeline's resources, including the parameter values passed to each of them.
+func (p *pipelineImpl) GetResourceEntries() []Resource {
+	resources := make([]Resource, len(p.Resources))
+	for i, resource := range p.Resources {
+		resources[i] = resource
+	}
+	return resources
 }
 
-func (p *pipelineImpl) GetAPIVersion() string  { return p.APIVersion }
-func (p *pipelineImpl) GetKind() string        { return p.Kind }
-func (p *pipelineImpl) GetDirectory() string   { return p.pwd }
-func (p *pipelineImpl) GetResources() []string { return p.Resources }
+func (p *pipelineImpl) GetParameters() []Parameter {
+	parameters := make([]Parameter, len(p.Parameters))
+	for i, parameter := range p.Parameters {
+		parameters[i] = parameter
+	}
+	return parameters
+}
 
+// GetSteps returns the steps to execute, omitting steps whose "when" condition evaluated to false.
 func (p *pipelineImpl) GetSteps() []Step {
-	steps := make([]Step, len(p.Steps))
-	for i, step := range p.Steps {
-		steps[i] = step
+	steps := make([]Step, 0, len(p.Steps))
+	for _, step := range p.Steps {
+		if !step.skipped {
+			steps = append(steps, step)
+		}
+	}
+	return steps
+}
+
+// GetSkippedSteps returns the steps whose "when" condition evaluated to false.
+func (p *pipelineImpl) GetSkippedSteps() []Step {
+	var steps []Step
+	for _, step := range p.Steps {
+		if step.skipped {
+			steps = append(steps, step)
+		}
 	}
 	return steps
 }
 
+// resourceImpl is an entry in the pipeline's resources list. It is either a plain URL string, or an object with a "url"
+// property and an optional "with" property providing parameter values to the Kude packages found in that URL.
+type resourceImpl struct {
+	URL  string                 `yaml:"url"`
+	With map[string]interface{} `yaml:"with"`
+}
+
+func (r *resourceImpl) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		r.URL = node.Value
+	case yaml.MappingNode:
+		for i := 0; i < len(node.Content); i += 2 {
+			if key := node.Content[i]; key.Value != "url" && key.Value != "with" {
+				return fmt.Errorf("line %d: field %s not found in resource", key.Line, key.Value)
+			}
+		}
+		type plainResource resourceImpl
+		if err := node.Decode((*plainResource)(r)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("line %d: resource must be a URL or an object", node.Line)
+	}
+	if r.URL == "" {
+		return fmt.Errorf("line %d: resource URL is empty", node.Line)
+	}
+	return nil
+}
+
+func (r resourceImpl) GetURL() string                  { return r.URL }
+func (r resourceImpl) GetWith() map[string]interface{} { return r.With }
+
 type stepImpl struct {
 	ID         string                 `yaml:"id"`
 	Name       string                 `yaml:"name"`
@@ -32,14 +115,33 @@ type stepImpl struct {
 	Network    bool                   `yaml:"network"`
 	Mounts     []string               `yaml:"mounts"`
 	Config     map[string]interface{} `yaml:"config"`
+	When       string                 `yaml:"when"`
+	Includes   targetingFilters       `yaml:"includes"`
+	Excludes   targetingFilters       `yaml:"excludes"`
+	skipped    bool
+}
+
+func (s stepImpl) GetID() string                        { return s.ID }
+func (s stepImpl) GetName() string                      { return s.Name }
+func (s stepImpl) GetImage() string                     { return s.Image }
+func (s stepImpl) GetEntrypoint() []string              { return s.Entrypoint }
+func (s stepImpl) GetUser() string                      { return s.User }
+func (s stepImpl) GetWorkdir() string                   { return s.Workdir }
+func (s stepImpl) GetNetwork() bool                     { return s.Network }
+func (s stepImpl) GetMounts() []string                  { return s.Mounts }
+func (s stepImpl) GetConfig() map[string]interface{}    { return s.Config }
+func (s stepImpl) GetWhen() string                      { return s.When }
+func (s stepImpl) GetIncludes() []kyaml.TargetingFilter { return s.Includes }
+func (s stepImpl) GetExcludes() []kyaml.TargetingFilter { return s.Excludes }
+
+type parameterImpl struct {
+	Name        string      `yaml:"name"`
+	Type        string      `yaml:"type"`
+	Default     interface{} `yaml:"default"`
+	Description string      `yaml:"description"`
 }
 
-func (s stepImpl) GetID() string                     { return s.ID }
-func (s stepImpl) GetName() string                   { return s.Name }
-func (s stepImpl) GetImage() string                  { return s.Image }
-func (s stepImpl) GetEntrypoint() []string           { return s.Entrypoint }
-func (s stepImpl) GetUser() string                   { return s.User }
-func (s stepImpl) GetWorkdir() string                { return s.Workdir }
-func (s stepImpl) GetNetwork() bool                  { return s.Network }
-func (s stepImpl) GetMounts() []string               { return s.Mounts }
-func (s stepImpl) GetConfig() map[string]interface{} { return s.Config }
+func (p parameterImpl) GetName() string         { return p.Name }
+func (p parameterImpl) GetType() string         { return p.Type }
+func (p parameterImpl) GetDefault() interface{} { return p.Default }
+func (p parameterImpl) GetDescription() string  { return p.Description }
@@ -1,6 +1,7 @@
 package kude
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -14,13 +15,36 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/kyaml/filesys"
+	"strings"
 )
 
 type resourceReader struct {
-	ctx    context.Context
-	pwd    string
-	logger *log.Logger
-	target chan *kyaml.RNode
+	ctx        context.Context
+	pwd        string
+	logger     *log.Logger
+	target     chan *kyaml.RNode
+	url        string
+	root       string
+	sourceRoot string
+	parameters map[string]interface{}
+	packages   int
+	graph      *packageGraph
+	chain      []string
+	options    []ExecutionOption
+	lock       *Lock
+	vendor     *Vendor
+	cache      *Cache
+	getters    []getter.Getter
+
+	// inlineBuiltinFunctions is inherited by nested packages from the importing pipeline
+	inlineBuiltinFunctions bool
+
+	// resolving makes the reader only resolve the packages imported by the resource (see packageGraph.resolve), rather
+	// than read its resources
+	resolving bool
 }
 
 func (r *resourceReader) Read(url string) error {
@@ -29,19 +53,78 @@ func (r *resourceReader) Read(url string) error {
 		return fmt.Errorf("failed to create temp directory: %w", err)
 	}
 	// We only use "ioutil.TempDir" to create a temporary name, but we might need it as a file (we don't yet know)
-	// So we delete it right after...
+	// So we delete it right after... and once more when we're done with it
 	os.RemoveAll(path)
+	defer os.RemoveAll(path)
 
-	client := getter.Client{}
-	var result *getter.GetResult
+	// Remote resources are read from the vendor directory when offline; otherwise they are pinned to their locked
+	// revision (if any), and vendored if requested. Either way, they are verified against the lock. Downloads of
+	// remote resources go through the cache (if any), which copies them to the temporary path.
+	//
+	// Resources are fetched in full, without their "//subdir" part (if any), and the subdirectory is then selected
+	// locally; this lets the Git revision of remote resources be resolved from the clone (which the subdirectory alone
+	// lacks), and lets kustomizations in the subdirectory reference bases elsewhere in the fetched tree (e.g. "../base").
+	remote := isRemoteResource(r.pwd, url, r.getters)
+	offline := remote && r.vendor != nil && r.vendor.offline
+	src, subdir, revision := url, "", ""
+	cached := false
+	if offline {
+		if src, subdir, revision, err = r.vendor.resolveResource(url); err != nil {
+			return err
+		}
+	} else {
+		if remote {
+			src = r.lock.pinResource(url)
+		}
+		src, subdir = getter.SourceDirSubdir(src)
+		cached = remote && r.cache != nil
+	}
+
+	var root string
+	if cached {
+		if root, err = r.cache.get(r.ctx, r.logger, src, r.pwd, path, r.getters); err != nil {
+			return err
+		}
+	} else {
+		client := getter.Client{Getters: r.getters}
+		req := getter.Request{Src: src, Dst: path, Pwd: r.pwd, Copy: true, GetMode: getter.ModeAny}
+		if result, err := client.Get(r.ctx, &req); err != nil {
+			return fmt.Errorf("failed to download '%s': %w", redactURL(url), redactError(err))
+		} else {
+			root = result.Dst
+		}
+	}
 
-	req := getter.Request{Src: url, Dst: path, Pwd: r.pwd, Copy: true, GetMode: getter.ModeAny}
-	if result, err = client.Get(r.ctx, &req); err != nil {
-		return fmt.Errorf("failed to download '%s': %w", url, err)
+	dst := root
+	if subdir != "" {
+		if dst, err = getter.SubdirGlob(root, subdir); err != nil {
+			return fmt.Errorf("failed to find '%s' in '%s': %w", subdir, url, err)
+		}
+	}
+	if remote && !offline && !r.resolving && (r.lock != nil || r.vendor != nil) {
+		if revision, err = resolveGitRevision(root); err != nil {
+			return err
+		}
+	}
+	if remote && !offline && !r.resolving && r.vendor != nil {
+		if err := r.vendor.storeResource(url, root, dst, revision); err != nil {
+			return err
+		}
+	}
+	if remote && !r.resolving && r.lock != nil {
+		if checksum, err := checksumPath(dst); err != nil {
+			return fmt.Errorf("failed computing checksum of '%s': %w", url, err)
+		} else if err := r.lock.verifyResource(url, revision, checksum); err != nil {
+			return err
+		}
 	}
 
-	if err := r.process(result.Dst); err != nil {
+	r.url = url
+	r.root = dst
+	if err := r.process(dst); err != nil {
 		return fmt.Errorf("failed to stream resources of '%s': %w", url, err)
+	} else if r.parameters != nil && r.packages == 0 {
+		return fmt.Errorf("parameters provided for '%s', but no Kude package was found in it", url)
 	}
 	return nil
 }
@@ -61,28 +144,70 @@ func (r *resourceReader) process(path string) error {
 }
 
 func (r *resourceReader) processFile(path string) error {
+	if r.resolving {
+		return nil
+	}
 	f, err := os.Open(path)
 	if err != nil {
 		return fmt.Errorf("failed to open '%s': %w", path, err)
 	}
 
 	r.logger.Printf("Processing: %s", path)
-	decoder := yaml.NewDecoder(f)
-	for {
+	if err := decodeResources(f, r.sourcePath(path), r.target); err != nil {
+		return fmt.Errorf("failed to parse '%s': %w", path, err)
+	}
+	return nil
+}
+
+// decodeResources decodes the YAML documents in the given reader into resources, pushing them into the given target
+// channel. Resources are marked as read from the given source path, for error reporting.
+func decodeResources(r io.Reader, sourcePath string, target chan *kyaml.RNode) error {
+	decoder := yaml.NewDecoder(r)
+	for document := 1; ; document++ {
 		node := &yaml.Node{}
 		if err := decoder.Decode(node); err != nil {
 			if errors.Is(err, io.EOF) {
-				break
+				return nil
 			} else {
-				return fmt.Errorf("failed to parse '%s': %w", path, err)
+				return locateYAMLError(sourcePath, err)
 			}
 		}
 		if node.Kind == yaml.DocumentNode {
 			node = node.Content[0]
 		}
-		r.target <- &kyaml.RNode{N: node}
+		rn := &kyaml.RNode{N: node}
+		setResourceSource(rn, ResourceSource{Path: sourcePath, Document: document, Line: node.Line, Column: node.Column})
+		target <- rn
 	}
-	return nil
+}
+
+// sourcePath translates the path of a downloaded file back to the location it was read from, for error reporting.
+// Local files are reported by their absolute path (or relative to the source root of the package, if it is nested),
+// and files from remote URLs are reported relative to that URL.
+func (r *resourceReader) sourcePath(path string) string {
+	if r.root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+
+	local := r.url
+	if !filepath.IsAbs(local) {
+		local = filepath.Join(r.pwd, local)
+	}
+	if _, err := os.Stat(local); err != nil {
+		return joinSourcePath(r.url, rel)
+	}
+
+	path = filepath.Join(local, rel)
+	if r.sourceRoot != "" {
+		if relToPwd, err := filepath.Rel(r.pwd, path); err == nil && !strings.HasPrefix(relToPwd, "..") {
+			return joinSourcePath(r.sourceRoot, relToPwd)
+		}
+	}
+	return path
 }
 
 func (r *resourceReader) processDirectory(path string) error {
@@ -104,31 +229,73 @@ func (r *resourceReader) walkSimpleDirectory(path string, e fs.DirEntry, err err
 		// TODO: support file symlinks (not just directories)
 		return r.processDirectory(target)
 	} else if e.IsDir() {
+		if _, err := os.Stat(filepath.Join(path, VendorManifestFileName)); err == nil {
+			// vendored copies of remote resources are only read through the resources referencing them
+			return fs.SkipDir
+		}
 		kudeYAMLFile := filepath.Join(path, "kude.yaml")
 		if stat, err := os.Stat(kudeYAMLFile); err != nil {
 			if errors.Is(err, os.ErrNotExist) {
-				// no kude.yaml inside this directory; let walker traverse into this path
-				return nil
+				// no kude.yaml inside this directory; render it if it's a kustomization, or let walker traverse into it
+				return r.processKustomization(path)
 			} else {
 				return fmt.Errorf("failed to stat '%s': %w", kudeYAMLFile, err)
 			}
 		} else if stat.IsDir() {
 			return fmt.Errorf("expecting 'kude.yaml' to be a file, not a directory: %s", kudeYAMLFile)
 		} else {
+			// Nested packages are identified by the location they were read from, rather than their temporary copy
+			pkg := r.sourcePath(path)
+			if r.resolving {
+				return r.resolvePackage(path, pkg)
+			}
+			rendering, first := r.graph.add(r.chain, pkg, r.parameters)
+			if !first {
+				r.logger.Printf("Reusing pipeline: %s (already rendered for '%s')", pkg, rendering.importer)
+				r.packages++
+				resources, err := rendering.wait(r.ctx)
+				if err != nil {
+					return fmt.Errorf("failed to reuse pipeline in '%s': %w", path, err)
+				}
+				for _, rn := range resources {
+					r.target <- rn
+				}
+				return fs.SkipDir
+			}
+
 			r.logger.Printf("Processing pipeline: %s", path)
-			p, err := NewPipeline(path)
+			p, err := NewPipelineWithParameters(path, r.parameters)
 			if err != nil {
 				return fmt.Errorf("failed to create pipeline from '%s': %w", path, err)
 			}
+			p.(*pipelineImpl).inlineBuiltinFunctions = r.inlineBuiltinFunctions
 
-			e, err := NewExecution(p, internal.NamedLogger(r.logger, filepath.Base(path)))
+			e, err := NewExecution(p, internal.NamedLogger(r.logger, filepath.Base(path)), r.options...)
 			if err != nil {
 				return fmt.Errorf("failed to create execution for pipeline in '%s': %w", path, err)
 			}
+			e.(*executionImpl).nested = true
+			e.(*executionImpl).sourceRoot = pkg
+			e.(*executionImpl).graph = r.graph
+			e.(*executionImpl).chain = append(append([]string{}, r.chain...), pkg)
+			r.packages++
 
-			if err := e.ExecuteToChannel(r.ctx, r.target); err != nil {
+			if rendering == nil {
+				if err := e.ExecuteToChannel(r.ctx, r.target); err != nil {
+					return fmt.Errorf("failed to execute pipeline in '%s': %w", path, err)
+				}
+				return fs.SkipDir
+			}
+
+			// The package is rendered in full before its resources are sent downstream, so that other importers
+			// waiting for it never depend on this importer's consumers
+			resources, err := r.render(e, rendering)
+			if err != nil {
 				return fmt.Errorf("failed to execute pipeline in '%s': %w", path, err)
 			}
+			for _, rn := range resources {
+				r.target <- rn
+			}
 			return fs.SkipDir
 		}
 	} else if filepath.Ext(path) == ".yaml" || filepath.Ext(path) == ".yml" {
@@ -137,3 +304,133 @@ func (r *resourceReader) walkSimpleDirectory(path string, e fs.DirEntry, err err
 		return nil
 	}
 }
+
+// resolvePackage resolves the packages imported by the nested package at the given path, unless it was resolved
+// already (see packageGraph.resolve).
+func (r *resourceReader) resolvePackage(path, pkg string) error {
+	r.packages++
+	if resolved, err := r.graph.visit(r.chain, pkg, r.parameters); err != nil {
+		return err
+	} else if resolved {
+		return fs.SkipDir
+	}
+
+	r.logger.Printf("Resolving pipeline: %s", path)
+	p, err := NewPipelineWithParameters(path, r.parameters)
+	if err != nil {
+		return fmt.Errorf("failed to create pipeline from '%s': %w", path, err)
+	}
+	p.(*pipelineImpl).inlineBuiltinFunctions = r.inlineBuiltinFunctions
+
+	e, err := NewExecution(p, internal.NamedLogger(r.logger, filepath.Base(path)), r.options...)
+	if err != nil {
+		return fmt.Errorf("failed to create execution for pipeline in '%s': %w", path, err)
+	}
+	e.(*executionImpl).nested = true
+	e.(*executionImpl).sourceRoot = pkg
+	e.(*executionImpl).graph = r.graph
+	e.(*executionImpl).chain = append(append([]string{}, r.chain...), pkg)
+	if err := r.graph.resolve(r.ctx, e.(*executionImpl)); err != nil {
+		return fmt.Errorf("failed to resolve pipeline in '%s': %w", path, err)
+	}
+	r.graph.leave(pkg, r.parameters)
+	return fs.SkipDir
+}
+
+// render executes the given execution of a package imported in the tree, and completes its rendering with (a copy of)
+// its resources, for other importers of the same package to reuse.
+func (r *resourceReader) render(e Execution, rendering *renderedPackage) ([]*kyaml.RNode, error) {
+	output := make(chan *kyaml.RNode, 5000)
+	var resources []*kyaml.RNode
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for rn := range output {
+			resources = append(resources, rn)
+		}
+	}()
+	err := e.ExecuteToChannel(r.ctx, output)
+	close(output)
+	<-collected
+
+	var nodes []*yaml.Node
+	if err == nil {
+		nodes = make([]*yaml.Node, len(resources))
+		for i, rn := range resources {
+			nodes[i] = internal.CopyNode(rn.N)
+		}
+	}
+	rendering.complete(nodes, err)
+	return resources, err
+}
+
+// processKustomization renders the given directory using kustomize, if it contains a kustomization file, and skips
+// it; otherwise, it returns nil to let the walker traverse into it. Local kustomizations are rendered from their original
+// location rather than their temporary copy, so they can reference bases outside their directory (e.g. "../base").
+func (r *resourceReader) processKustomization(path string) error {
+	var kustomizationFile string
+	for _, name := range konfig.RecognizedKustomizationFileNames() {
+		if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+			kustomizationFile = name
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to stat '%s': %w", filepath.Join(path, name), err)
+		}
+	}
+	if kustomizationFile == "" {
+		return nil
+	} else if r.resolving {
+		return fs.SkipDir
+	}
+
+	dir := r.localPath(path)
+	r.logger.Printf("Processing kustomization: %s", dir)
+	k := krusty.MakeKustomizer(krusty.MakeDefaultOptions())
+	resMap, err := k.Run(filesys.MakeFsOnDisk(), dir)
+	if err != nil {
+		return fmt.Errorf("failed to build kustomization in '%s': %w", dir, err)
+	}
+	manifests, err := resMap.AsYaml()
+	if err != nil {
+		return fmt.Errorf("failed to serialize resources of kustomization in '%s': %w", dir, err)
+	}
+	if err := decodeResources(bytes.NewReader(manifests), r.sourcePath(filepath.Join(path, kustomizationFile)), r.target); err != nil {
+		return fmt.Errorf("failed to parse resources of kustomization in '%s': %w", dir, err)
+	}
+	return fs.SkipDir
+}
+
+// localPath translates the path of a downloaded file back to its original location on disk, if it was read from a
+// local path; otherwise (e.g. for remote URLs), the given path is returned as-is.
+func (r *resourceReader) localPath(path string) string {
+	if r.root == "" {
+		return path
+	}
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return path
+	}
+
+	local := r.url
+	if !filepath.IsAbs(local) {
+		local = filepath.Join(r.pwd, local)
+	}
+	if stat, err := os.Stat(local); err != nil || !stat.IsDir() {
+		return path
+	}
+	return filepath.Join(local, rel)
+}
+
+// joinSourcePath appends the given relative path to a source location, which is either a local path or a URL.
+func joinSourcePath(base, rel string) string {
+	if rel == "." {
+		return base
+	} else if filepath.IsAbs(base) {
+		return filepath.Join(base, rel)
+	}
+	base, query, found := strings.Cut(base, "?")
+	if found {
+		query = "?" + query
+	}
+	return strings.TrimSuffix(base, "/") + "/" + filepath.ToSlash(rel) + query
+}
@@ -108,7 +108,7 @@ metadata:
 		t.Errorf("failed to close file: %v", err)
 	} else if err := rr.Read(f.Name()); err == nil {
 		t.Error("expected error, got nil")
-	} else if matches, reErr := regexp.Match(fmt.Sprintf("failed to stream resources of '%s': failed to aggregate resources from '.+': failed to parse '.+': yaml: line 4: mapping values are not allowed in this context", f.Name()), []byte(err.Error())); reErr != nil {
+	} else if matches, reErr := regexp.Match(fmt.Sprintf("failed to stream resources of '%s': failed to aggregate resources from '.+': failed to parse '.+': %s:4: mapping values are not allowed in this context", f.Name(), f.Name()), []byte(err.Error())); reErr != nil {
 		t.Errorf("failed matching error message: %v", err)
 	} else if !matches {
 		t.Errorf("unexpected error message for dir '%s' and file '%s': %s", dir, f.Name(), err.Error())
@@ -156,3 +156,47 @@ metadata:
 		}
 	}
 }
+
+func TestResourceReaderReadFileRecordsSource(t *testing.T) {
+	target := make(chan *kyaml.RNode, 100)
+	rr := &resourceReader{
+		ctx:    context.Background(),
+		pwd:    internal.MustGetwd(),
+		logger: log.New(&internal.TestWriter{T: t}, "", 0),
+		target: target,
+	}
+	yml := `###
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: sa1
+---
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: sa2`
+	if f, err := ioutil.TempFile("", "*.yaml"); err != nil {
+		t.Errorf("failed to create temp file: %v", err)
+	} else if _, err := io.WriteString(f, yml); err != nil {
+		t.Errorf("failed to create file: %v", err)
+	} else if err := f.Close(); err != nil {
+		t.Errorf("failed to close file: %v", err)
+	} else if err := rr.Read(f.Name()); err != nil {
+		t.Errorf("failed to read file '%s': %v", f.Name(), err)
+	} else {
+		close(target)
+		expected := []ResourceSource{
+			{Path: f.Name(), Document: 1, Line: 2, Column: 1},
+			{Path: f.Name(), Document: 2, Line: 7, Column: 1},
+		}
+		for _, e := range expected {
+			if r, ok := <-target; !ok || r == nil {
+				t.Errorf("no resource found")
+			} else if source, err := GetResourceSource(r); err != nil {
+				t.Errorf("failed to get resource source: %v", err)
+			} else if source == nil || *source != e {
+				t.Errorf("expected source %+v, got %+v", e, source)
+			}
+		}
+	}
+}
@@ -4,14 +4,14 @@ import (
 	"github.com/arikkfir/kyaml/pkg"
 )
 
+// Deprecated API versions (and the versions replacing them) are listed in internal.DeprecatedAPIs.
+
 const APIVersionV1 = "v1"
-const APIVersionV1Beta1 = "policy/v1beta1"
 const APIVersionAdmissionRegistrationV1 = "admissionregistration.k8s.io/v1"
 const APIVersionAPIExtensionsV1 = "apiextensions.k8s.io/v1"
 const APIVersionAppsV1 = "apps/v1"
 const APIVersionAutoscalingV1 = "autoscaling/v1"
 const APIVersionAutoscalingV2 = "autoscaling/v2"
-const APIVersionAutoscalingV2Beta2 = "autoscaling/v2beta2"
 const APIVersionBatchV1 = "batch/v1"
 const APIVersionNetworkingV1 = "networking.k8s.io/v1"
 const APIVersionPolicyV1 = "policy/v1"
@@ -40,7 +40,6 @@ const KindPersistentVolume = "PersistentVolume"
 const KindPersistentVolumeClaim = "PersistentVolumeClaim"
 const KindPod = "Pod"
 const KindPodDisruptionBudget = "PodDisruptionBudget"
-const KindPodSecurityPolicy = "PodSecurityPolicy"
 const KindPodTemplate = "PodTemplate"
 const KindPriorityClass = "PriorityClass"
 const KindReplicaSet = "ReplicaSet"
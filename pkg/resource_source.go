@@ -0,0 +1,298 @@
+package kude
+
+import (
+	"fmt"
+	"github.com/arikkfir/kude/internal"
+	"github.com/arikkfir/kyaml/pkg"
+	"gopkg.in/yaml.v3"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SourceAnnotationName is the name of the annotation used to track the location a resource was originally read from,
+// so that errors concerning that resource can point back to it. It is removed from resources before they are emitted.
+const SourceAnnotationName = "kude.kfirs.com/source"
+
+// createdMappingMarker is appended to the source annotation of resources that had no "annotations" mapping (or no
+// "metadata" mapping either) before the annotation was added, followed by the name of the outermost mapping Kude
+// created for it, so that only mappings created by Kude are removed along with the annotation.
+const createdMappingMarker = ";created="
+
+// yamlErrorLineRE matches the line prefix in error messages generated by the YAML decoder.
+var yamlErrorLineRE = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// ResourceSource describes where a resource was read from.
+type ResourceSource struct {
+	Path     string
+	Document int
+	Line     int
+	Column   int
+}
+
+// String formats the source location the way compilers do, e.g. "path/to/file.yaml:12:3".
+func (s ResourceSource) String() string {
+	location := s.Path
+	if s.Line > 0 {
+		location += ":" + strconv.Itoa(s.Line)
+		if s.Column > 0 {
+			location += ":" + strconv.Itoa(s.Column)
+		}
+	}
+	return location
+}
+
+func (s ResourceSource) annotationValue() string {
+	return fmt.Sprintf("%s:%d:%d#%d", s.Path, s.Line, s.Column, s.Document)
+}
+
+func parseResourceSource(value string) (*ResourceSource, error) {
+	value, _ = cutCreatedMappingMarker(value)
+	rest, document, found := cutLast(value, "#")
+	if !found {
+		return nil, fmt.Errorf("missing document index in '%s'", value)
+	}
+	rest, column, found := cutLast(rest, ":")
+	if !found {
+		return nil, fmt.Errorf("missing column in '%s'", value)
+	}
+	path, line, found := cutLast(rest, ":")
+	if !found {
+		return nil, fmt.Errorf("missing line in '%s'", value)
+	}
+
+	source := &ResourceSource{Path: path}
+	var err error
+	if source.Document, err = strconv.Atoi(document); err != nil {
+		return nil, fmt.Errorf("invalid document index in '%s': %w", value, err)
+	} else if source.Line, err = strconv.Atoi(line); err != nil {
+		return nil, fmt.Errorf("invalid line in '%s': %w", value, err)
+	} else if source.Column, err = strconv.Atoi(column); err != nil {
+		return nil, fmt.Errorf("invalid column in '%s': %w", value, err)
+	}
+	return source, nil
+}
+
+// GetResourceSource returns the source location recorded on the given resource, or nil if none was recorded.
+func GetResourceSource(rn *kyaml.RNode) (*ResourceSource, error) {
+	value, err := rn.GetAnnotation(SourceAnnotationName)
+	if err != nil {
+		return nil, fmt.Errorf("failed getting annotation: %w", err)
+	} else if value == "" {
+		return nil, nil
+	}
+	return parseResourceSource(value)
+}
+
+// setResourceSource records the given source location on the resource, unless one is already recorded (e.g. by a
+// nested package that read it first). Nodes that are not objects are left untouched, as they will be rejected later.
+func setResourceSource(rn *kyaml.RNode, source ResourceSource) {
+	if node := documentContent(rn.N); node == nil || node.Kind != yaml.MappingNode {
+		return
+	} else if existing, err := rn.GetAnnotation(SourceAnnotationName); err != nil || existing != "" {
+		return
+	}
+	setSourceAnnotation(rn, source.annotationValue())
+}
+
+// setSourceAnnotation sets the source annotation of the given resource to the given value, recording which mappings
+// were created to hold it (see createdMappingMarker).
+func setSourceAnnotation(rn *kyaml.RNode, value string) {
+	if metadata := internal.MappingField(documentContent(rn.N), "metadata"); metadata == nil || metadata.Kind != yaml.MappingNode {
+		value += createdMappingMarker + "metadata"
+	} else if annotations := internal.MappingField(metadata, "annotations"); annotations == nil || annotations.Kind != yaml.MappingNode {
+		value += createdMappingMarker + "annotations"
+	}
+	_ = rn.SetAnnotation(SourceAnnotationName, value)
+}
+
+// cutCreatedMappingMarker splits the given source annotation value into the source location, and the name of the
+// outermost mapping created to hold the annotation, if any (see createdMappingMarker).
+func cutCreatedMappingMarker(value string) (string, string) {
+	if before, created, found := cutLast(value, createdMappingMarker); found && (created == "metadata" || created == "annotations") {
+		return before, created
+	}
+	return value, ""
+}
+
+// removeResourceSource removes the source annotation from the given resource, along with the "annotations" and
+// "metadata" mappings if they were created to hold it, and are left empty. Returns the removed annotation value (the
+// source location), if any.
+func removeResourceSource(rn *kyaml.RNode) string {
+	metadata := internal.MappingField(documentContent(rn.N), "metadata")
+	annotations := internal.MappingField(metadata, "annotations")
+	annotation := internal.MappingField(annotations, SourceAnnotationName)
+	if annotation == nil {
+		return ""
+	}
+	value, created := cutCreatedMappingMarker(annotation.Value)
+	internal.RemoveMappingKey(annotations, SourceAnnotationName)
+	if created != "" && len(annotations.Content) == 0 {
+		internal.RemoveMappingKey(metadata, "annotations")
+		if created == "metadata" && len(metadata.Content) == 0 {
+			internal.RemoveMappingKey(documentContent(rn.N), "metadata")
+		}
+	}
+	return value
+}
+
+// stepSources tracks the source annotations of resources sent to a step, so that functions never see Kude's internal
+// annotation, yet the resources they emit can still be traced back to where they were read from. Emitted resources are
+// matched to input resources by identity; if a function changed a resource's API version or namespace, it is matched
+// by kind & name as long as that is unambiguous. Resources that cannot be matched are attributed to the step itself.
+type stepSources struct {
+	mu     sync.Mutex
+	byID   map[string]string
+	byName map[string][]string
+}
+
+func newStepSources() *stepSources {
+	return &stepSources{byID: make(map[string]string), byName: make(map[string][]string)}
+}
+
+// strip removes the source annotation from the given resource before it is sent to the step, remembering it.
+func (s *stepSources) strip(rn *kyaml.RNode) {
+	value := removeResourceSource(rn)
+	if value == "" {
+		return
+	}
+	id, name := resourceIdentityKeys(rn)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[id] = value
+	s.byName[name] = append(s.byName[name], value)
+}
+
+// restore records the source of the given resource emitted by the step: the source of the matching input resource,
+// or the given fallback if there is none.
+func (s *stepSources) restore(rn *kyaml.RNode, fallback ResourceSource) {
+	if node := documentContent(rn.N); node == nil || node.Kind != yaml.MappingNode {
+		return
+	}
+	id, name := resourceIdentityKeys(rn)
+	s.mu.Lock()
+	value, found := s.byID[id]
+	if !found && len(s.byName[name]) == 1 {
+		value, found = s.byName[name][0], true
+	}
+	s.mu.Unlock()
+	if found {
+		setSourceAnnotation(rn, value)
+	} else {
+		setResourceSource(rn, fallback)
+	}
+}
+
+func resourceIdentityKeys(rn *kyaml.RNode) (id string, name string) {
+	apiVersion, _ := rn.GetAPIVersion()
+	kind, _ := rn.GetKind()
+	namespace, _ := rn.GetNamespace()
+	resourceName, _ := rn.GetName()
+	return apiVersion + "/" + kind + "/" + namespace + "/" + resourceName, kind + "/" + resourceName
+}
+
+// ResourceError is an error concerning a specific resource. Its message is formatted like a compiler diagnostic,
+// pointing at the resource's source location (when known) and identifying the resource.
+type ResourceError struct {
+	Source     *ResourceSource
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+	Err        error
+}
+
+// newResourceError creates a ResourceError for the given resource. Identity fields that cannot be read from the
+// resource (which is often why the error is reported in the first place) are simply left out.
+func newResourceError(rn *kyaml.RNode, err error) *ResourceError {
+	re := &ResourceError{Err: err}
+	if source, sourceErr := GetResourceSource(rn); sourceErr == nil {
+		re.Source = source
+	}
+	re.APIVersion, _ = rn.GetAPIVersion()
+	re.Kind, _ = rn.GetKind()
+	re.Namespace, _ = rn.GetNamespace()
+	re.Name, _ = rn.GetName()
+	return re
+}
+
+func (e *ResourceError) Error() string {
+	identity := make([]string, 0, 4)
+	for _, field := range []struct{ name, value string }{
+		{"apiVersion", e.APIVersion},
+		{"kind", e.Kind},
+		{"namespace", e.Namespace},
+		{"name", e.Name},
+	} {
+		if field.value != "" {
+			identity = append(identity, field.name+"="+field.value)
+		}
+	}
+
+	subject := make([]string, 0, 2)
+	if e.Source != nil && e.Source.Document > 0 {
+		subject = append(subject, fmt.Sprintf("document #%d", e.Source.Document))
+	}
+	if len(identity) > 0 {
+		subject = append(subject, "("+strings.Join(identity, ", ")+")")
+	}
+
+	b := strings.Builder{}
+	if e.Source != nil {
+		b.WriteString(e.Source.String() + ": ")
+	}
+	if len(subject) > 0 {
+		b.WriteString(strings.Join(subject, " ") + ": ")
+	}
+	b.WriteString(e.Err.Error())
+	return b.String()
+}
+
+func (e *ResourceError) Unwrap() error { return e.Err }
+
+// locatedError is an error from decoding a YAML file, prefixed with the file path and line it originated from.
+type locatedError struct {
+	msg string
+	err error
+}
+
+func (e *locatedError) Error() string { return e.msg }
+func (e *locatedError) Unwrap() error { return e.err }
+
+// locateYAMLError rewrites errors returned by the YAML decoder for the given file so that they point at the file and
+// line they refer to, e.g. "yaml: line 3: did not find expected key" becomes "kude.yaml:3: did not find expected key".
+// Type errors, which may contain multiple messages, are rewritten line by line.
+func locateYAMLError(path string, err error) error {
+	var messages []string
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	} else {
+		messages = []string{err.Error()}
+	}
+
+	located := make([]string, len(messages))
+	for i, msg := range messages {
+		source := ResourceSource{Path: path}
+		if groups := yamlErrorLineRE.FindStringSubmatch(msg); groups != nil {
+			source.Line, _ = strconv.Atoi(groups[1])
+			msg = groups[2]
+		}
+		located[i] = source.String() + ": " + msg
+	}
+	return &locatedError{msg: strings.Join(located, "\n"), err: err}
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+func documentContent(n *yaml.Node) *yaml.Node {
+	if n != nil && n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		return n.Content[0]
+	}
+	return n
+}
@@ -0,0 +1,120 @@
+package kude
+
+import (
+	"errors"
+	"fmt"
+	"github.com/arikkfir/kude/internal"
+	"github.com/arikkfir/kyaml/pkg"
+	"gopkg.in/yaml.v3"
+	"strings"
+	"testing"
+)
+
+func TestResourceSourceAnnotationRoundTrip(t *testing.T) {
+	n := &yaml.Node{}
+	yml := `####
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: sa`
+	if err := yaml.Unmarshal([]byte(yml), n); err != nil {
+		t.Fatalf("failed decoding input YAML: %v", err)
+	}
+
+	rn := &kyaml.RNode{N: n}
+	setResourceSource(rn, ResourceSource{Path: "/a:b/resources.yaml", Document: 3, Line: 12, Column: 1})
+	setResourceSource(rn, ResourceSource{Path: "/other.yaml", Document: 1, Line: 1, Column: 1})
+	if source, err := GetResourceSource(rn); err != nil {
+		t.Errorf("failed getting resource source: %v", err)
+	} else if source == nil {
+		t.Errorf("expected resource source, got nil")
+	} else if *source != (ResourceSource{Path: "/a:b/resources.yaml", Document: 3, Line: 12, Column: 1}) {
+		t.Errorf("unexpected resource source: %+v", *source)
+	}
+
+	if value := removeResourceSource(rn); value != "/a:b/resources.yaml:12:1#3" {
+		t.Errorf("unexpected removed annotation value: %s", value)
+	}
+	if actual, err := internal.NodeToString(n); err != nil {
+		t.Errorf("failed encoding node: %v", err)
+	} else if expected := "####\napiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: sa\n"; actual != expected {
+		t.Errorf("expected source annotation to be removed cleanly, got:\n%s", actual)
+	}
+}
+
+func TestRemoveResourceSourceRetainsUserMappings(t *testing.T) {
+	testCases := map[string]string{
+		"no metadata":            "apiVersion: v1\nkind: ServiceAccount\n",
+		"empty metadata":         "apiVersion: v1\nkind: ServiceAccount\nmetadata: {}\n",
+		"no annotations":         "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: sa\n",
+		"empty annotations":      "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  annotations: {}\n",
+		"non-empty annotations":  "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  annotations:\n    a: b\n",
+		"only empty annotations": "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: sa\n  annotations: {}\n",
+	}
+	for name, yml := range testCases {
+		t.Run(name, func(t *testing.T) {
+			n := &yaml.Node{}
+			if err := yaml.Unmarshal([]byte(yml), n); err != nil {
+				t.Fatalf("failed decoding input YAML: %v", err)
+			}
+			rn := &kyaml.RNode{N: n}
+			setResourceSource(rn, ResourceSource{Path: "/resources.yaml", Document: 1, Line: 1, Column: 1})
+			if source, err := GetResourceSource(rn); err != nil {
+				t.Fatalf("failed getting resource source: %v", err)
+			} else if *source != (ResourceSource{Path: "/resources.yaml", Document: 1, Line: 1, Column: 1}) {
+				t.Fatalf("unexpected resource source: %+v", *source)
+			}
+
+			if value := removeResourceSource(rn); value != "/resources.yaml:1:1#1" {
+				t.Errorf("unexpected removed annotation value: %s", value)
+			}
+			if actual, err := internal.NodeToString(n); err != nil {
+				t.Errorf("failed encoding node: %v", err)
+			} else if actual != yml {
+				t.Errorf("expected resource to be restored as-is:\n%s\ngot:\n%s", yml, actual)
+			}
+		})
+	}
+}
+
+func TestResourceErrorMessage(t *testing.T) {
+	cause := errors.New("kind is missing or empty")
+	err := &ResourceError{
+		Source:     &ResourceSource{Path: "/pkg/resources.yaml", Document: 2, Line: 7, Column: 1},
+		APIVersion: "v1",
+		Name:       "sa",
+		Err:        cause,
+	}
+	if expected := "/pkg/resources.yaml:7:1: document #2 (apiVersion=v1, name=sa): kind is missing or empty"; err.Error() != expected {
+		t.Errorf("expected '%s', got '%s'", expected, err.Error())
+	}
+	if !errors.Is(fmt.Errorf("wrapped: %w", err), cause) {
+		t.Errorf("expected resource error to wrap its cause")
+	}
+
+	err = &ResourceError{Err: cause}
+	if err.Error() != cause.Error() {
+		t.Errorf("expected '%s', got '%s'", cause.Error(), err.Error())
+	}
+}
+
+func TestLocateYAMLError(t *testing.T) {
+	var target struct {
+		Foo string `yaml:"foo"`
+	}
+	decoder := yaml.NewDecoder(strings.NewReader("foo: bar\nbar: baz\nbaz: qux\n"))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&target); err == nil {
+		t.Fatalf("expected decoding error, got nil")
+	} else if located := locateYAMLError("kude.yaml", err); !strings.HasPrefix(located.Error(), "kude.yaml:2: field bar not found") {
+		t.Errorf("unexpected located error: %s", located)
+	} else if !strings.Contains(located.Error(), "\nkude.yaml:3: field baz not found") {
+		t.Errorf("expected all type errors to be located, got: %s", located)
+	}
+
+	if err := yaml.Unmarshal([]byte("a: b\nc: d: e"), &yaml.Node{}); err == nil {
+		t.Fatalf("expected syntax error, got nil")
+	} else if located := locateYAMLError("kude.yaml", err); located.Error() != "kude.yaml:2: mapping values are not allowed in this context" {
+		t.Errorf("unexpected located error: %s", located)
+	}
+}
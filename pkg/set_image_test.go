@@ -0,0 +1,88 @@
+package kude
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/arikkfir/kude/internal"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetImageResolveDigests(t *testing.T) {
+	server := httptest.NewServer(registry.New(registry.Logger(log.New(&internal.TestWriter{T: t}, "", 0))))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	image, err := random.Image(128, 1)
+	if err != nil {
+		t.Fatalf("failed creating image: %v", err)
+	}
+	digest, err := image.Digest()
+	if err != nil {
+		t.Fatalf("failed computing image digest: %v", err)
+	}
+	ref, err := name.ParseReference(host + "/app:1.0")
+	if err != nil {
+		t.Fatalf("failed parsing reference: %v", err)
+	} else if err := remote.Write(ref, image); err != nil {
+		t.Fatalf("failed pushing image: %v", err)
+	}
+
+	dir := t.TempDir()
+	kudeYAML := fmt.Sprintf(`
+apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+resources:
+  - deployment.yaml
+steps:
+  - image: ghcr.io/arikkfir/kude/functions/set-image
+    config:
+      images:
+        - name: app
+          newName: %s/app
+          newTag: "1.0"
+      resolveDigests: true
+`, host)
+	deploymentYAML := `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  template:
+    spec:
+      containers:
+        - name: web
+          image: app:0.9
+`
+	if err := os.WriteFile(filepath.Join(dir, "kude.yaml"), []byte(kudeYAML), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(dir, "deployment.yaml"), []byte(deploymentYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := newInliningPipeline(dir)
+	if err != nil {
+		t.Fatalf("failed creating pipeline: %v", err)
+	}
+	e, err := NewExecution(p, log.New(&internal.TestWriter{T: t}, "", 0))
+	if err != nil {
+		t.Fatalf("failed creating execution: %v", err)
+	}
+	out := &bytes.Buffer{}
+	if err := e.ExecuteToWriter(context.Background(), out); err != nil {
+		t.Fatalf("execution failed: %v", err)
+	}
+	if expected := fmt.Sprintf("image: %s/app:1.0@%s", host, digest); !strings.Contains(out.String(), expected) {
+		t.Errorf("expected output to contain '%s', got:\n%s", expected, out.String())
+	}
+}
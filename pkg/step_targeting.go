@@ -0,0 +1,131 @@
+package kude
+
+import (
+	"context"
+	"fmt"
+	"github.com/arikkfir/kyaml/pkg"
+	"github.com/arikkfir/kyaml/pkg/kstream"
+	"github.com/mitchellh/mapstructure"
+	"gopkg.in/yaml.v3"
+)
+
+// targetingFilters is a list of targeting filters, as used by a step's "includes" and "excludes" properties. They are
+// decoded the same way builtin functions decode their own "includes" and "excludes" configuration.
+type targetingFilters []kyaml.TargetingFilter
+
+func (f *targetingFilters) UnmarshalYAML(node *yaml.Node) error {
+	var raw []map[string]interface{}
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	filters := make([]kyaml.TargetingFilter, len(raw))
+	for i, properties := range raw {
+		if len(properties) == 0 {
+			return fmt.Errorf("line %d: targeting filter #%d must specify at least one property", node.Content[i].Line, i)
+		}
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{ErrorUnused: true, Result: &filters[i]})
+		if err != nil {
+			return fmt.Errorf("failed creating decoder: %w", err)
+		} else if err := decoder.Decode(properties); err != nil {
+			return fmt.Errorf("line %d: invalid targeting filter #%d: %w", node.Content[i].Line, i, err)
+		}
+	}
+	*f = filters
+	return nil
+}
+
+// stepTargeting decides which resources are sent to a step's function, based on the step's "includes" and
+// "excludes" filters. Resources that are not targeted bypass the function, and are merged back into the step's
+// output in their original position (see mergeTargetedResources).
+type stepTargeting struct {
+	filter func(ctx context.Context, node *yaml.Node, output chan *yaml.Node) error
+}
+
+// newStepTargeting creates the targeting for the given step, or returns nil if the step targets all resources.
+func newStepTargeting(step Step) *stepTargeting {
+	if len(step.GetIncludes()) == 0 && len(step.GetExcludes()) == 0 {
+		return nil
+	}
+	return &stepTargeting{filter: kstream.FilterResource(step.GetIncludes(), step.GetExcludes())}
+}
+
+func (t *stepTargeting) matches(ctx context.Context, rn *kyaml.RNode) (bool, error) {
+	output := make(chan *yaml.Node, 1)
+	if err := t.filter(ctx, rn.N, output); err != nil {
+		return false, fmt.Errorf("failed matching resource: %w", err)
+	}
+	return len(output) > 0, nil
+}
+
+// targetingSlot is an entry in a step's input layout: either a resource that bypassed the function, or a placeholder
+// for a resource that was sent to it, identified by its identity keys (see resourceIdentityKeys).
+type targetingSlot struct {
+	bypassed *kyaml.RNode
+	id, name string
+}
+
+// newTargetingSlot creates a layout entry for the given resource, which either bypasses the function, or is sent to it.
+func newTargetingSlot(rn *kyaml.RNode, bypassed bool) targetingSlot {
+	if bypassed {
+		return targetingSlot{bypassed: rn}
+	}
+	id, name := resourceIdentityKeys(rn)
+	return targetingSlot{id: id, name: name}
+}
+
+// mergeTargetedResources merges the function's output back with the resources that bypassed it. The layout contains
+// the step's input in its original order, where bypassed resources are present as-is, and resources that were sent to
+// the function are placeholders. Each output resource fills the placeholder of the input resource with the same
+// identity, or - if the function changed its API version or namespace - the first placeholder with the same kind &
+// name. Placeholders left unfilled (the function removed resources) are dropped, and output resources that match no
+// placeholder (the function generated them) are appended at the end, in their output order.
+func mergeTargetedResources(layout []targetingSlot, results []*kyaml.RNode) []*kyaml.RNode {
+	byID, byName := make(map[string][]int), make(map[string][]int)
+	for i, slot := range layout {
+		if slot.bypassed == nil {
+			byID[slot.id] = append(byID[slot.id], i)
+			byName[slot.name] = append(byName[slot.name], i)
+		}
+	}
+
+	// claim returns the first unfilled placeholder in the given index entry, consuming filled ones along the way
+	filled := make([]*kyaml.RNode, len(layout))
+	claim := func(index map[string][]int, key string) int {
+		slots := index[key]
+		for len(slots) > 0 && filled[slots[0]] != nil {
+			slots = slots[1:]
+		}
+		index[key] = slots
+		if len(slots) == 0 {
+			return -1
+		}
+		return slots[0]
+	}
+
+	var unmatched []*kyaml.RNode
+	for _, rn := range results {
+		if id, _ := resourceIdentityKeys(rn); claim(byID, id) >= 0 {
+			filled[byID[id][0]] = rn
+		} else {
+			unmatched = append(unmatched, rn)
+		}
+	}
+	results, unmatched = unmatched, nil
+	for _, rn := range results {
+		if _, name := resourceIdentityKeys(rn); claim(byName, name) >= 0 {
+			filled[byName[name][0]] = rn
+		} else {
+			unmatched = append(unmatched, rn)
+		}
+	}
+
+	merged := make([]*kyaml.RNode, 0, len(layout)+len(unmatched))
+	for i, slot := range layout {
+		if slot.bypassed != nil {
+			merged = append(merged, slot.bypassed)
+		} else if filled[i] != nil {
+			merged = append(merged, filled[i])
+		}
+	}
+	return append(merged, unmatched...)
+}
@@ -0,0 +1,92 @@
+package kude
+
+import (
+	"context"
+	"github.com/arikkfir/kyaml/pkg"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTargetingFiltersUnmarshal(t *testing.T) {
+	var step stepImpl
+	if err := yaml.Unmarshal([]byte("includes:\n  - apiVersion: v1\n    kind: Secret\n"), &step); err != nil {
+		t.Fatalf("failed decoding step: %v", err)
+	}
+	rn := func(kind string) *kyaml.RNode {
+		n := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte("apiVersion: v1\nkind: "+kind+"\nmetadata:\n  name: test\n"), n); err != nil {
+			t.Fatalf("failed decoding resource: %v", err)
+		}
+		return &kyaml.RNode{N: n.Content[0]}
+	}
+	targeting := newStepTargeting(step)
+	if targeting == nil {
+		t.Fatalf("expected step targeting, got nil")
+	} else if matches, err := targeting.matches(context.Background(), rn("Secret")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if !matches {
+		t.Errorf("expected secret to match")
+	} else if matches, err := targeting.matches(context.Background(), rn("ConfigMap")); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if matches {
+		t.Errorf("expected config map not to match")
+	}
+
+	if newStepTargeting(stepImpl{}) != nil {
+		t.Errorf("expected no targeting for a step with no filters")
+	}
+
+	for yml, expectedError := range map[string]string{
+		"includes:\n  - {}\n":                         "line 2: targeting filter #0 must specify at least one property",
+		"excludes:\n  - kind: Secret\n    foo: bar\n": "line 2: invalid targeting filter #0",
+	} {
+		if err := yaml.Unmarshal([]byte(yml), &stepImpl{}); err == nil {
+			t.Errorf("expected error for '%s', got nil", yml)
+		} else if !strings.Contains(err.Error(), expectedError) {
+			t.Errorf("expected error containing '%s', got: %v", expectedError, err)
+		}
+	}
+}
+
+func TestMergeTargetedResources(t *testing.T) {
+	rn := func(kind, namespace, name string) *kyaml.RNode {
+		n := &yaml.Node{}
+		if err := yaml.Unmarshal([]byte("apiVersion: v1\nkind: "+kind+"\nmetadata:\n  name: "+name+"\n  namespace: "+namespace+"\n"), n); err != nil {
+			t.Fatalf("failed decoding resource: %v", err)
+		}
+		return &kyaml.RNode{N: n.Content[0]}
+	}
+	a, b, c := rn("Secret", "ns", "a"), rn("Secret", "ns", "b"), rn("Secret", "ns", "c")
+	x, y, z := rn("ConfigMap", "ns", "x"), rn("ConfigMap", "ns", "y"), rn("ConfigMap", "ns", "z")
+	movedY, thirdY := rn("ConfigMap", "other", "y"), rn("ConfigMap", "third", "y")
+	bypass := func(rn *kyaml.RNode) targetingSlot { return newTargetingSlot(rn, true) }
+	target := func(rn *kyaml.RNode) targetingSlot { return newTargetingSlot(rn, false) }
+	testCases := map[string]struct {
+		layout            []targetingSlot
+		results, expected []*kyaml.RNode
+	}{
+		"one to one":    {[]targetingSlot{bypass(a), target(x), bypass(b), target(y), bypass(c)}, []*kyaml.RNode{x, y}, []*kyaml.RNode{a, x, b, y, c}},
+		"removed first": {[]targetingSlot{target(x), bypass(a), target(y), bypass(b)}, []*kyaml.RNode{y}, []*kyaml.RNode{a, y, b}},
+		"removed last":  {[]targetingSlot{target(x), bypass(a), target(y), bypass(b)}, []*kyaml.RNode{x}, []*kyaml.RNode{x, a, b}},
+		"reordered":     {[]targetingSlot{target(x), bypass(a), target(y)}, []*kyaml.RNode{y, x}, []*kyaml.RNode{x, a, y}},
+		"generated":     {[]targetingSlot{bypass(a), target(x), bypass(b)}, []*kyaml.RNode{z, x, y}, []*kyaml.RNode{a, x, b, z, y}},
+		"renamespaced":  {[]targetingSlot{target(x), bypass(a), target(y)}, []*kyaml.RNode{x, movedY}, []*kyaml.RNode{x, a, movedY}},
+		"name taken":    {[]targetingSlot{target(y), target(movedY)}, []*kyaml.RNode{thirdY, movedY}, []*kyaml.RNode{thirdY, movedY}},
+		"no matches":    {[]targetingSlot{bypass(a), bypass(b)}, []*kyaml.RNode{x}, []*kyaml.RNode{a, b, x}},
+		"all matches":   {[]targetingSlot{target(x), target(y)}, []*kyaml.RNode{x, y}, []*kyaml.RNode{x, y}},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if actual := mergeTargetedResources(tc.layout, tc.results); !reflect.DeepEqual(actual, tc.expected) {
+				var names []string
+				for _, rn := range actual {
+					id, _ := resourceIdentityKeys(rn)
+					names = append(names, id)
+				}
+				t.Errorf("unexpected merge result: %v", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,490 @@
+package kude
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/arikkfir/kyaml/pkg"
+	openapi_v2 "github.com/google/gnostic/openapiv2"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+	"io"
+	"k8s.io/kube-openapi/pkg/validation/spec"
+	"k8s.io/kube-openapi/pkg/validation/strfmt"
+	"k8s.io/kube-openapi/pkg/validation/validate"
+	"os"
+	"path"
+	"path/filepath"
+	"sigs.k8s.io/kustomize/kyaml/openapi/kubernetesapi"
+	sigsyaml "sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DefaultKubernetesVersion is the Kubernetes version whose schemas resources are validated against by default.
+const DefaultKubernetesVersion = "1.21"
+
+// ErrUnsupportedKubernetesVersion is returned when creating a validator for a Kubernetes version whose schemas are not
+// bundled with Kude.
+var ErrUnsupportedKubernetesVersion = errors.New("unsupported Kubernetes version")
+
+// bundledSchemas maps Kubernetes versions (major & minor) to the bundled OpenAPI schemas of that version.
+var bundledSchemas = map[string]string{
+	"1.21": "v1212",
+}
+
+// SupportedKubernetesVersions returns the Kubernetes versions that resources can be validated against.
+func SupportedKubernetesVersions() []string {
+	versions := make([]string, 0, len(bundledSchemas))
+	for version := range bundledSchemas {
+		versions = append(versions, version)
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// CheckValidationVersion checks that resources can be validated against the given Kubernetes version, returning an
+// error wrapping ErrUnsupportedKubernetesVersion if its schemas are not bundled with Kude. Other Kubernetes versions
+// can still be targeted for reporting deprecated & removed API versions, just not for validation.
+func CheckValidationVersion(kubernetesVersion string) error {
+	if _, found := bundledSchemas[normalizeKubernetesVersion(kubernetesVersion)]; !found {
+		return fmt.Errorf("%w '%s' for validation (supported versions: %s)", ErrUnsupportedKubernetesVersion, kubernetesVersion, strings.Join(SupportedKubernetesVersions(), ", "))
+	}
+	return nil
+}
+
+// normalizeKubernetesVersion normalizes the given Kubernetes version (e.g. "v1.21.2") to its major & minor components
+// (e.g. "1.21").
+func normalizeKubernetesVersion(version string) string {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return strings.Join(parts, ".")
+	}
+	return parts[0] + "." + parts[1]
+}
+
+// Validator validates resources against the OpenAPI schemas of a specific Kubernetes version (or against schemas
+// provided by the user), as well as against the schemas of custom resource definitions found among the validated
+// resources. No cluster access is required.
+type Validator struct {
+	*schemaSet
+	ignoreMissingSchemas bool
+}
+
+// schemaSet is a set of OpenAPI schemas, indexed by the group, version & kind of the resources they describe.
+type schemaSet struct {
+	source      string
+	definitions spec.Definitions
+	schemas     map[string]*spec.Schema
+	mutex       sync.Mutex
+	expanded    map[string]*spec.Schema
+}
+
+var (
+	validatorsMutex sync.Mutex
+	validators      = make(map[string]*schemaSet)
+)
+
+// NewValidator creates a validator for the given Kubernetes version (see SupportedKubernetesVersions). Resources whose
+// schema is unknown fail validation, unless ignoreMissingSchemas is true.
+func NewValidator(kubernetesVersion string, ignoreMissingSchemas bool) (*Validator, error) {
+	if err := CheckValidationVersion(kubernetesVersion); err != nil {
+		return nil, err
+	}
+	version := normalizeKubernetesVersion(kubernetesVersion)
+	asset := bundledSchemas[version]
+
+	// Parsing the bundled schemas is relatively expensive, so they are only parsed once per version
+	validatorsMutex.Lock()
+	defer validatorsMutex.Unlock()
+	set, found := validators[version]
+	if !found {
+		doc := &openapi_v2.Document{}
+		if err := proto.Unmarshal(kubernetesapi.OpenAPIMustAsset[asset](path.Join("kubernetesapi", asset, "swagger.pb")), doc); err != nil {
+			return nil, fmt.Errorf("failed decoding OpenAPI schemas of Kubernetes %s: %w", version, err)
+		}
+		swagger := spec.Swagger{}
+		if _, err := swagger.FromGnostic(doc); err != nil {
+			return nil, fmt.Errorf("failed decoding OpenAPI schemas of Kubernetes %s: %w", version, err)
+		}
+		set = newSchemaSet("Kubernetes "+version, swagger.Definitions)
+		validators[version] = set
+	}
+	return &Validator{schemaSet: set, ignoreMissingSchemas: ignoreMissingSchemas}, nil
+}
+
+// NewValidatorWithSchemas creates a validator for the OpenAPI (v2) schemas in the given files, or in the JSON & YAML
+// files of the given directories, instead of the schemas bundled with Kude. This allows validating resources against
+// any Kubernetes version, e.g. using the schemas of a cluster, as exported by "kubectl get --raw /openapi/v2". Schemas
+// in later files take precedence over schemas of the same name in earlier files.
+func NewValidatorWithSchemas(paths []string, ignoreMissingSchemas bool) (*Validator, error) {
+	definitions := spec.Definitions{}
+	for _, p := range paths {
+		files := []string{p}
+		if stat, err := os.Stat(p); err != nil {
+			return nil, fmt.Errorf("failed to stat schemas '%s': %w", p, err)
+		} else if stat.IsDir() {
+			entries, err := os.ReadDir(p)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list schemas in '%s': %w", p, err)
+			}
+			files = nil
+			for _, entry := range entries {
+				switch filepath.Ext(entry.Name()) {
+				case ".json", ".yaml", ".yml":
+					if !entry.IsDir() {
+						files = append(files, filepath.Join(p, entry.Name()))
+					}
+				}
+			}
+		}
+		for _, file := range files {
+			b, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed reading schemas '%s': %w", file, err)
+			} else if filepath.Ext(file) != ".json" {
+				if b, err = sigsyaml.YAMLToJSON(b); err != nil {
+					return nil, fmt.Errorf("failed decoding schemas '%s': %w", file, err)
+				}
+			}
+			swagger := spec.Swagger{}
+			if err := swagger.UnmarshalJSON(b); err != nil {
+				return nil, fmt.Errorf("failed decoding schemas '%s': %w", file, err)
+			}
+			for name, schema := range swagger.Definitions {
+				definitions[name] = schema
+			}
+		}
+	}
+	return &Validator{schemaSet: newSchemaSet("the schemas in "+strings.Join(paths, ", "), definitions), ignoreMissingSchemas: ignoreMissingSchemas}, nil
+}
+
+func newSchemaSet(source string, definitions spec.Definitions) *schemaSet {
+	set := &schemaSet{source: source, definitions: definitions, schemas: make(map[string]*spec.Schema), expanded: make(map[string]*spec.Schema)}
+	for name := range definitions {
+		schema := definitions[name]
+		gvks, _ := schema.Extensions["x-kubernetes-group-version-kind"].([]interface{})
+		for _, gvk := range gvks {
+			if gvk, ok := gvk.(map[string]interface{}); ok {
+				group, _ := gvk["group"].(string)
+				version, _ := gvk["version"].(string)
+				kind, _ := gvk["kind"].(string)
+				set.schemas[schemaKey(group, version, kind)] = &schema
+			}
+		}
+	}
+	return set
+}
+
+// GetSchemaSource describes the schemas this validator validates resources against, e.g. "Kubernetes 1.21".
+func (v *Validator) GetSchemaSource() string { return v.source }
+
+// ValidationError lists the validation errors found in a set of resources.
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d validation error(s):\n%s", len(e.Errors), strings.Join(messages, "\n"))
+}
+
+// ValidateReader validates the resources in the given reader (a stream of YAML documents, such as the output of "kude
+// build"), reporting them as read from the given source path.
+func (v *Validator) ValidateReader(reader io.Reader, sourcePath string) error {
+	target := make(chan *kyaml.RNode)
+	decodeErr := make(chan error, 1)
+	go func() {
+		defer close(target)
+		decodeErr <- decodeResources(reader, sourcePath, target)
+	}()
+	var resources []*kyaml.RNode
+	for rn := range target {
+		resources = append(resources, rn)
+	}
+	if err := <-decodeErr; err != nil {
+		return fmt.Errorf("failed to parse resources: %w", err)
+	}
+	return v.Validate(resources)
+}
+
+// Validate validates the given resources, returning a ValidationError listing every invalid field if any are found.
+// Schemas of custom resource definitions found among the given resources are used to validate their custom resources.
+func (v *Validator) Validate(resources []*kyaml.RNode) error {
+	schemas, err := v.customResourceSchemas(resources)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, rn := range resources {
+		apiVersion, err := rn.GetAPIVersion()
+		if err != nil {
+			return newResourceError(rn, fmt.Errorf("failed getting API version for resource: %w", err))
+		}
+		kind, err := rn.GetKind()
+		if err != nil {
+			return newResourceError(rn, fmt.Errorf("failed getting kind for resource: %w", err))
+		}
+
+		group, version := "", apiVersion
+		if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+			group, version = apiVersion[:i], apiVersion[i+1:]
+		}
+		key := schemaKey(group, version, kind)
+		schema, found := schemas[key]
+		if !found {
+			schema, found = v.schema(key)
+		}
+		if !found {
+			if !v.ignoreMissingSchemas {
+				errs = append(errs, newResourceError(rn, fmt.Errorf("no schema found for %s/%s in %s or in the custom resource definitions of the package", apiVersion, kind, v.source)))
+			}
+			continue
+		}
+
+		// Kude's source annotation is not part of the resource, and is removed before it is emitted
+		value, _ := schemaValue(rn.N).(map[string]interface{})
+		if metadata, ok := value["metadata"].(map[string]interface{}); ok {
+			if annotations, ok := metadata["annotations"].(map[string]interface{}); ok {
+				if delete(annotations, SourceAnnotationName); len(annotations) == 0 {
+					delete(metadata, "annotations")
+				}
+			}
+		}
+
+		result := validate.NewSchemaValidator(schema, nil, "", strfmt.Default).Validate(value)
+		messages := make([]string, len(result.Errors))
+		for i, err := range result.Errors {
+			messages[i] = strings.Replace(err.Error(), " in body", "", 1)
+		}
+		sort.Strings(messages)
+		for _, message := range messages {
+			errs = append(errs, newResourceError(rn, errors.New(message)))
+		}
+	}
+	if len(errs) > 0 {
+		return &ValidationError{Errors: errs}
+	}
+	return nil
+}
+
+// schema returns the expanded schema of the resources with the given key (see schemaKey), if any.
+func (s *schemaSet) schema(key string) (*spec.Schema, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if schema, found := s.expanded[key]; found {
+		return schema, true
+	} else if schema, found := s.schemas[key]; found {
+		s.expanded[key] = expandResourceSchema(schema, s.definitions)
+		return s.expanded[key], true
+	}
+	return nil, false
+}
+
+// customResourceSchemas extracts the schemas of custom resources from the custom resource definitions among the given
+// resources.
+func (v *Validator) customResourceSchemas(resources []*kyaml.RNode) (map[string]*spec.Schema, error) {
+	schemas := make(map[string]*spec.Schema)
+	for _, rn := range resources {
+		if apiVersion, err := rn.GetAPIVersion(); err != nil || !strings.HasPrefix(apiVersion, "apiextensions.k8s.io/") {
+			continue
+		} else if kind, err := rn.GetKind(); err != nil || kind != "CustomResourceDefinition" {
+			continue
+		}
+
+		crd := struct {
+			Spec struct {
+				Group string `yaml:"group"`
+				Names struct {
+					Kind string `yaml:"kind"`
+				} `yaml:"names"`
+				Version    string `yaml:"version"`
+				Validation struct {
+					OpenAPIV3Schema map[string]interface{} `yaml:"openAPIV3Schema"`
+				} `yaml:"validation"`
+				Versions []struct {
+					Name   string `yaml:"name"`
+					Schema struct {
+						OpenAPIV3Schema map[string]interface{} `yaml:"openAPIV3Schema"`
+					} `yaml:"schema"`
+				} `yaml:"versions"`
+			} `yaml:"spec"`
+		}{}
+		if err := rn.N.Decode(&crd); err != nil {
+			return nil, newResourceError(rn, fmt.Errorf("failed decoding custom resource definition: %w", err))
+		}
+
+		add := func(version string, openAPIV3Schema map[string]interface{}) error {
+			if version == "" || openAPIV3Schema == nil {
+				return nil
+			}
+			schema := &spec.Schema{}
+			if b, err := json.Marshal(openAPIV3Schema); err != nil {
+				return newResourceError(rn, fmt.Errorf("failed encoding schema of version '%s': %w", version, err))
+			} else if err := schema.UnmarshalJSON(b); err != nil {
+				return newResourceError(rn, fmt.Errorf("failed decoding schema of version '%s': %w", version, err))
+			}
+			schemas[schemaKey(crd.Spec.Group, version, crd.Spec.Names.Kind)] = expandResourceSchema(schema, nil)
+			return nil
+		}
+		if err := add(crd.Spec.Version, crd.Spec.Validation.OpenAPIV3Schema); err != nil {
+			return nil, err
+		}
+		for _, version := range crd.Spec.Versions {
+			schema := version.Schema.OpenAPIV3Schema
+			if schema == nil {
+				schema = crd.Spec.Validation.OpenAPIV3Schema
+			}
+			if err := add(version.Name, schema); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return schemas, nil
+}
+
+func schemaKey(group, version, kind string) string {
+	return group + "/" + version + "/" + kind
+}
+
+// expandResourceSchema expands the given schema of a resource (see expandSchema). Since custom resource definitions
+// often omit the "apiVersion", "kind" and "metadata" properties, they are implicitly allowed.
+func expandResourceSchema(schema *spec.Schema, definitions spec.Definitions) *spec.Schema {
+	expanded := expandSchema(schema, definitions, map[string]bool{})
+	if len(expanded.Properties) > 0 {
+		for _, name := range []string{"apiVersion", "kind", "metadata"} {
+			if _, found := expanded.Properties[name]; !found {
+				expanded.Properties[name] = spec.Schema{}
+			}
+		}
+	}
+	return expanded
+}
+
+// expandSchema returns a copy of the given schema, in which references to definitions are replaced by the referenced
+// schemas, and Kubernetes extensions are replaced by their JSON schema equivalents, since the validator supports
+// neither. Objects with declared properties reject unknown fields, unless they preserve them. References to schemas
+// that are already being expanded (recursive schemas) or that are missing accept any value.
+func expandSchema(schema *spec.Schema, definitions spec.Definitions, expanding map[string]bool) *spec.Schema {
+	if ref := schema.Ref.String(); ref != "" {
+		name := strings.TrimPrefix(ref, "#/definitions/")
+		if strings.HasSuffix(name, ".api.resource.Quantity") {
+			// quantities are strings, but are also commonly (and legally) written as numbers
+			return &spec.Schema{SchemaProps: spec.SchemaProps{AnyOf: []spec.Schema{
+				{SchemaProps: spec.SchemaProps{Type: spec.StringOrArray{"string"}}},
+				{SchemaProps: spec.SchemaProps{Type: spec.StringOrArray{"number"}}},
+			}}}
+		} else if definition, found := definitions[name]; !found || expanding[name] {
+			return &spec.Schema{}
+		} else {
+			expanding[name] = true
+			defer delete(expanding, name)
+			return expandSchema(&definition, definitions, expanding)
+		}
+	}
+
+	expanded := *schema
+	if intOrString, _ := schema.Extensions.GetBool("x-kubernetes-int-or-string"); intOrString || schema.Format == "int-or-string" {
+		expanded.Type, expanded.Format = nil, ""
+		expanded.AnyOf = []spec.Schema{
+			{SchemaProps: spec.SchemaProps{Type: spec.StringOrArray{"integer"}}},
+			{SchemaProps: spec.SchemaProps{Type: spec.StringOrArray{"string"}}},
+		}
+		return &expanded
+	}
+	expandAll := func(schemas []spec.Schema) []spec.Schema {
+		if schemas == nil {
+			return nil
+		}
+		result := make([]spec.Schema, len(schemas))
+		for i := range schemas {
+			result[i] = *expandSchema(&schemas[i], definitions, expanding)
+		}
+		return result
+	}
+	expanded.AllOf = expandAll(schema.AllOf)
+	expanded.AnyOf = expandAll(schema.AnyOf)
+	expanded.OneOf = expandAll(schema.OneOf)
+	if schema.Not != nil {
+		expanded.Not = expandSchema(schema.Not, definitions, expanding)
+	}
+	if schema.Items != nil {
+		expanded.Items = &spec.SchemaOrArray{Schemas: expandAll(schema.Items.Schemas)}
+		if schema.Items.Schema != nil {
+			expanded.Items.Schema = expandSchema(schema.Items.Schema, definitions, expanding)
+		}
+	}
+	if schema.AdditionalProperties != nil {
+		// schemas decoded from the bundled schemas only specify the schema of additional properties, not that they're allowed
+		expanded.AdditionalProperties = &spec.SchemaOrBool{Allows: schema.AdditionalProperties.Allows}
+		if schema.AdditionalProperties.Schema != nil {
+			expanded.AdditionalProperties.Allows = true
+			expanded.AdditionalProperties.Schema = expandSchema(schema.AdditionalProperties.Schema, definitions, expanding)
+		}
+	}
+	if schema.Properties != nil {
+		expanded.Properties = make(map[string]spec.Schema, len(schema.Properties))
+		for name := range schema.Properties {
+			property := schema.Properties[name]
+			expanded.Properties[name] = *expandSchema(&property, definitions, expanding)
+		}
+		if preserve, _ := schema.Extensions.GetBool("x-kubernetes-preserve-unknown-fields"); !preserve && schema.AdditionalProperties == nil {
+			expanded.AdditionalProperties = &spec.SchemaOrBool{Allows: false}
+		}
+	}
+	return &expanded
+}
+
+// schemaValue converts the given YAML node to the value it represents, as expected by the validator. Null fields are
+// omitted, as they are by Kubernetes.
+func schemaValue(node *yaml.Node) interface{} {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) > 0 {
+			return schemaValue(node.Content[0])
+		}
+		return nil
+	case yaml.MappingNode:
+		value := make(map[string]interface{}, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if field := schemaValue(node.Content[i+1]); field != nil {
+				value[node.Content[i].Value] = field
+			}
+		}
+		return value
+	case yaml.SequenceNode:
+		value := make([]interface{}, len(node.Content))
+		for i, item := range node.Content {
+			value[i] = schemaValue(item)
+		}
+		return value
+	}
+	switch node.ShortTag() {
+	case "!!null":
+		return nil
+	case "!!bool":
+		var b bool
+		if err := node.Decode(&b); err == nil {
+			return b
+		}
+	case "!!int":
+		var i int64
+		if err := node.Decode(&i); err == nil {
+			return i
+		}
+	case "!!float":
+		var f float64
+		if err := node.Decode(&f); err == nil {
+			return f
+		}
+	}
+	return node.Value
+}
@@ -0,0 +1,279 @@
+package kude
+
+import (
+	"errors"
+	"github.com/arikkfir/kyaml/pkg"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func parseResources(t *testing.T, manifest string) []*kyaml.RNode {
+	t.Helper()
+	var resources []*kyaml.RNode
+	decoder := yaml.NewDecoder(strings.NewReader(manifest))
+	for {
+		node := &yaml.Node{}
+		if err := decoder.Decode(node); err != nil {
+			if errors.Is(err, io.EOF) {
+				return resources
+			}
+			t.Fatalf("failed parsing resources: %v", err)
+		}
+		resources = append(resources, &kyaml.RNode{N: node.Content[0]})
+	}
+}
+
+func TestValidatorValidResources(t *testing.T) {
+	v, err := NewValidator("v1.21.2", false)
+	if err != nil {
+		t.Fatalf("failed creating validator: %v", err)
+	}
+	resources := parseResources(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+  labels:
+    app: web
+spec:
+  replicas: 2
+  selector:
+    matchLabels:
+      app: web
+  template:
+    metadata:
+      labels:
+        app: web
+    spec:
+      containers:
+        - name: web
+          image: nginx
+          ports:
+            - containerPort: 80
+          resources:
+            limits:
+              cpu: 1
+              memory: 512Mi
+          livenessProbe:
+            httpGet:
+              port: http
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+    - name: v1
+      served: true
+      storage: true
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: [size]
+              properties:
+                size:
+                  type: integer
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: small
+spec:
+  size: 1
+`)
+	if err := v.Validate(resources); err != nil {
+		t.Fatalf("expected resources to be valid, got: %v", err)
+	}
+}
+
+func TestValidatorInvalidResources(t *testing.T) {
+	v, err := NewValidator("1.21", false)
+	if err != nil {
+		t.Fatalf("failed creating validator: %v", err)
+	}
+	resources := parseResources(t, `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: two
+  selector:
+    matchLabels:
+      app: web
+  template:
+    spec:
+      containers:
+        - name: web
+          env:
+            - name: PORT
+              value: 80
+          unknownField: true
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+spec:
+  group: example.com
+  names:
+    kind: Widget
+    plural: widgets
+  scope: Namespaced
+  versions:
+    - name: v1
+      served: true
+      storage: true
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              required: [size]
+              properties:
+                size:
+                  type: integer
+                shape:
+                  type: string
+                  enum: [round, square]
+---
+apiVersion: example.com/v1
+kind: Widget
+metadata:
+  name: small
+spec:
+  color: red
+  shape: oval
+---
+apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: unknown
+`)
+	err = v.Validate(resources)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a validation error, got: %v", err)
+	}
+	expected := []string{
+		`(apiVersion=apps/v1, kind=Deployment, name=web): spec.replicas must be of type integer: "string"`,
+		`(apiVersion=apps/v1, kind=Deployment, name=web): spec.template.spec.containers[0].env[0].value must be of type string: "integer"`,
+		"(apiVersion=apps/v1, kind=Deployment, name=web): spec.template.spec.containers[0].unknownField is a forbidden property",
+		"(apiVersion=example.com/v1, kind=Widget, name=small): spec.color is a forbidden property",
+		"(apiVersion=example.com/v1, kind=Widget, name=small): spec.shape should be one of [round square]",
+		"(apiVersion=example.com/v1, kind=Widget, name=small): spec.size is required",
+		"(apiVersion=example.com/v1, kind=Gadget, name=unknown): no schema found for example.com/v1/Gadget in Kubernetes 1.21 or in the custom resource definitions of the package",
+	}
+	var actual []string
+	for _, err := range validationErr.Errors {
+		actual = append(actual, err.Error())
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("incorrect validation errors:\nexpected:\n%s\nactual:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestValidatorUnsupportedVersion(t *testing.T) {
+	if _, err := NewValidator("1.2", false); err == nil {
+		t.Fatalf("expected error for unsupported Kubernetes version")
+	}
+	if err := CheckValidationVersion("1.25"); !errors.Is(err, ErrUnsupportedKubernetesVersion) {
+		t.Errorf("expected unsupported Kubernetes version error for 1.25, got: %v", err)
+	}
+	if err := CheckValidationVersion("v1.21.3"); err != nil {
+		t.Errorf("unexpected error for v1.21.3: %v", err)
+	}
+}
+
+func TestValidatorWithSchemas(t *testing.T) {
+	dir := t.TempDir()
+	schemas := `
+definitions:
+  com.example.v1.Gadget:
+    type: object
+    x-kubernetes-group-version-kind:
+      - group: example.com
+        version: v1
+        kind: Gadget
+    properties:
+      apiVersion:
+        type: string
+      kind:
+        type: string
+      metadata:
+        $ref: '#/definitions/com.example.v1.Metadata'
+      spec:
+        type: object
+        properties:
+          port:
+            type: string
+            format: int-or-string
+  com.example.v1.Metadata:
+    type: object
+    properties:
+      name:
+        type: string
+`
+	if err := os.WriteFile(filepath.Join(dir, "gadget.yaml"), []byte(schemas), 0644); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(dir, "README.md"), []byte("not a schema"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewValidatorWithSchemas([]string{dir}, false)
+	if err != nil {
+		t.Fatalf("failed creating validator: %v", err)
+	} else if expected := "the schemas in " + dir; v.GetSchemaSource() != expected {
+		t.Errorf("expected schema source '%s', got '%s'", expected, v.GetSchemaSource())
+	}
+
+	err = v.ValidateReader(strings.NewReader(`
+apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: valid
+spec:
+  port: 80
+---
+apiVersion: example.com/v1
+kind: Gadget
+metadata:
+  name: invalid
+  unknown: true
+spec:
+  port: true
+`), "manifest.yaml")
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a validation error, got: %v", err)
+	}
+	expected := []string{
+		`manifest.yaml:9:1: document #2 (apiVersion=example.com/v1, kind=Gadget, name=invalid): "spec.port" must validate at least one schema (anyOf)`,
+		`manifest.yaml:9:1: document #2 (apiVersion=example.com/v1, kind=Gadget, name=invalid): metadata.unknown is a forbidden property`,
+		`manifest.yaml:9:1: document #2 (apiVersion=example.com/v1, kind=Gadget, name=invalid): spec.port must be of type integer: "boolean"`,
+	}
+	var actual []string
+	for _, err := range validationErr.Errors {
+		actual = append(actual, err.Error())
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("incorrect validation errors:\nexpected:\n%s\nactual:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+
+	if _, err := NewValidatorWithSchemas([]string{filepath.Join(dir, "missing.json")}, false); err == nil {
+		t.Errorf("expected error for missing schemas file")
+	}
+}
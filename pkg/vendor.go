@@ -0,0 +1,358 @@
+package kude
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/client"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	VendorDirName          = "vendor"
+	VendorManifestFileName = "kude-vendor.yaml"
+	VendorAPIVersion       = "kude.kfirs.com/v1alpha1"
+	VendorKind             = "Vendor"
+)
+
+// vendorNameRE matches characters that are replaced when deriving vendored file names from URLs & image references.
+var vendorNameRE = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// VendoredResource describes a remote resource copied into the vendor directory.
+type VendoredResource struct {
+	URL      string `yaml:"url"`
+	Path     string `yaml:"path"`
+	Subdir   string `yaml:"subdir,omitempty"`
+	Revision string `yaml:"revision,omitempty"`
+}
+
+// VendoredImage describes a function image exported as a tarball into the vendor directory.
+type VendoredImage struct {
+	Image string `yaml:"image"`
+	Path  string `yaml:"path"`
+	ID    string `yaml:"id"`
+}
+
+// Vendor manages the vendor directory of a package tree, which holds copies of all remote resources (including those
+// of nested packages) and function images, allowing the package to be built without network access. When vendoring,
+// everything fetched during the build is copied into the vendor directory; when offline, remote resources & images
+// are only read from it. While vendoring, the vendor directory is populated in a temporary sibling directory, which
+// only replaces it once the build succeeds (see Save), so a failed build leaves the existing vendor directory intact.
+type Vendor struct {
+	APIVersion string             `yaml:"apiVersion"`
+	Kind       string             `yaml:"kind"`
+	Resources  []VendoredResource `yaml:"resources,omitempty"`
+	Images     []VendoredImage    `yaml:"images,omitempty"`
+	dir        string
+	staging    string
+	offline    bool
+	mutex      sync.Mutex
+	resources  map[string]VendoredResource
+	images     map[string]VendoredImage
+}
+
+// OpenVendor opens the vendor directory of the package in the given directory. In offline mode, the vendor directory
+// must exist (see "kude vendor"); otherwise, a new vendor directory is staged, to be populated during the build and
+// swapped into place by Save. Callers should call Discard once done, to clean up after failed builds.
+func OpenVendor(pwd string, offline bool) (*Vendor, error) {
+	v := &Vendor{
+		APIVersion: VendorAPIVersion,
+		Kind:       VendorKind,
+		dir:        filepath.Join(pwd, VendorDirName),
+		offline:    offline,
+		resources:  make(map[string]VendoredResource),
+		images:     make(map[string]VendoredImage),
+	}
+	manifestPath := filepath.Join(v.dir, VendorManifestFileName)
+
+	if !offline {
+		if _, err := os.Stat(v.dir); err == nil {
+			if _, err := os.Stat(manifestPath); err != nil {
+				return nil, fmt.Errorf("refusing to overwrite '%s', as it is not a Kude vendor directory", v.dir)
+			}
+		}
+		staging, err := os.MkdirTemp(pwd, "."+VendorDirName+".tmp-")
+		if err != nil {
+			return nil, fmt.Errorf("failed creating temporary vendor directory: %w", err)
+		}
+		v.staging = staging
+		return v, nil
+	}
+
+	b, err := os.ReadFile(manifestPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("vendor directory '%s' not found (run 'kude vendor' first)", v.dir)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed reading '%s': %w", manifestPath, err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decode '%s': %w", manifestPath, locateYAMLError(manifestPath, err))
+	} else if v.APIVersion != VendorAPIVersion {
+		return nil, fmt.Errorf("%s: unsupported apiVersion: '%s' (should be '%s')", manifestPath, v.APIVersion, VendorAPIVersion)
+	} else if v.Kind != VendorKind {
+		return nil, fmt.Errorf("%s: unsupported kind: '%s' (should be '%s')", manifestPath, v.Kind, VendorKind)
+	}
+	for _, r := range v.Resources {
+		v.resources[r.URL] = r
+	}
+	for _, i := range v.Images {
+		v.images[i.Image] = i
+	}
+	return v, nil
+}
+
+// Save writes the vendor manifest, listing everything vendored during the build, and replaces the vendor directory
+// with the one populated during the build.
+func (v *Vendor) Save() error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.staging == "" {
+		return fmt.Errorf("vendor directory '%s' was not opened for vendoring", v.dir)
+	}
+
+	v.Resources = make([]VendoredResource, 0, len(v.resources))
+	for _, r := range v.resources {
+		v.Resources = append(v.Resources, r)
+	}
+	sort.Slice(v.Resources, func(i, j int) bool { return v.Resources[i].URL < v.Resources[j].URL })
+
+	v.Images = make([]VendoredImage, 0, len(v.images))
+	for _, i := range v.images {
+		v.Images = append(v.Images, i)
+	}
+	sort.Slice(v.Images, func(i, j int) bool { return v.Images[i].Image < v.Images[j].Image })
+
+	b := bytes.Buffer{}
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(v); err != nil {
+		return fmt.Errorf("failed encoding vendor manifest: %w", err)
+	} else if err := encoder.Close(); err != nil {
+		return fmt.Errorf("failed encoding vendor manifest: %w", err)
+	}
+
+	manifestPath := filepath.Join(v.staging, VendorManifestFileName)
+	if err := os.WriteFile(manifestPath, b.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed writing '%s': %w", manifestPath, err)
+	}
+
+	// Move the previous vendor directory (if any) aside, rather than deleting it, until the new one is in place
+	previous := v.staging + ".old"
+	if err := os.Rename(v.dir, previous); errors.Is(err, os.ErrNotExist) {
+		previous = ""
+	} else if err != nil {
+		return fmt.Errorf("failed moving vendor directory '%s' aside: %w", v.dir, err)
+	}
+	if err := os.Rename(v.staging, v.dir); err != nil {
+		if previous != "" {
+			_ = os.Rename(previous, v.dir)
+		}
+		return fmt.Errorf("failed replacing vendor directory '%s': %w", v.dir, err)
+	}
+	v.staging = ""
+	if previous != "" {
+		if err := os.RemoveAll(previous); err != nil {
+			return fmt.Errorf("failed removing previous vendor directory '%s': %w", previous, err)
+		}
+	}
+	return nil
+}
+
+// Discard removes the vendor directory staged during the build, unless it was already saved. The existing vendor
+// directory (if any) is left as-is.
+func (v *Vendor) Discard() error {
+	if v == nil {
+		return nil
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.staging == "" {
+		return nil
+	} else if err := os.RemoveAll(v.staging); err != nil {
+		return fmt.Errorf("failed removing temporary vendor directory '%s': %w", v.staging, err)
+	}
+	v.staging = ""
+	return nil
+}
+
+// resolveResource returns the local path of the given vendored resource, the subdirectory selected within it (if
+// any), and the Git revision it was vendored at.
+func (v *Vendor) resolveResource(url string) (string, string, string, error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if vendored, found := v.resources[url]; !found {
+		return "", "", "", fmt.Errorf("resource '%s' is not vendored (run 'kude vendor' to update the vendor directory)", url)
+	} else {
+		return filepath.Join(v.dir, filepath.FromSlash(vendored.Path)), vendored.Subdir, vendored.Revision, nil
+	}
+}
+
+// storeResource copies the given downloaded resource into the vendor directory. The full fetched tree is copied (and
+// the selected subdirectory within it recorded), so that vendored kustomizations can still reference bases outside of
+// their own directory.
+func (v *Vendor) storeResource(url, root, path, revision string) error {
+	subdir, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(subdir, "..") {
+		return fmt.Errorf("failed vendoring '%s': '%s' is not inside '%s'", url, path, root)
+	} else if subdir == "." {
+		subdir = ""
+	}
+	rel := "resources/" + vendorName(url)
+	if err := copyPath(root, filepath.Join(v.staging, filepath.FromSlash(rel))); err != nil {
+		return fmt.Errorf("failed vendoring '%s': %w", url, err)
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.resources[url] = VendoredResource{URL: url, Path: rel, Subdir: filepath.ToSlash(subdir), Revision: revision}
+	return nil
+}
+
+// loadImage ensures the given image is available to the Docker daemon, loading it from its vendored tarball if
+// necessary, and verifies it is the same image that was vendored.
+func (v *Vendor) loadImage(ctx context.Context, dockerClient *client.Client, image string) error {
+	v.mutex.Lock()
+	vendored, found := v.images[image]
+	v.mutex.Unlock()
+	if !found {
+		return fmt.Errorf("image '%s' is not vendored (run 'kude vendor' to update the vendor directory)", image)
+	}
+
+	if _, _, err := dockerClient.ImageInspectWithRaw(ctx, image); client.IsErrNotFound(err) {
+		f, err := os.Open(filepath.Join(v.dir, filepath.FromSlash(vendored.Path)))
+		if err != nil {
+			return fmt.Errorf("failed opening vendored image '%s': %w", image, err)
+		}
+		defer f.Close()
+		response, err := dockerClient.ImageLoad(ctx, f, true)
+		if err != nil {
+			return fmt.Errorf("failed loading vendored image '%s': %w", image, err)
+		}
+		defer response.Body.Close()
+		if _, err := io.Copy(io.Discard, response.Body); err != nil {
+			return fmt.Errorf("failed loading vendored image '%s': %w", image, err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed inspecting image '%s': %w", image, err)
+	}
+
+	if inspect, _, err := dockerClient.ImageInspectWithRaw(ctx, image); err != nil {
+		return fmt.Errorf("failed inspecting image '%s': %w", image, err)
+	} else if inspect.ID != vendored.ID {
+		return fmt.Errorf("image '%s' differs from the vendored image: expected ID '%s', found '%s'", image, vendored.ID, inspect.ID)
+	}
+	return nil
+}
+
+// storeImage exports the given image into a tarball in the vendor directory. The image is tagged with its original
+// reference first (it might have been pulled by digest), so that it can be found by that reference once loaded.
+func (v *Vendor) storeImage(ctx context.Context, dockerClient *client.Client, image, pulled string) error {
+	if pulled != image {
+		if err := dockerClient.ImageTag(ctx, pulled, image); err != nil {
+			return fmt.Errorf("failed tagging image '%s' as '%s': %w", pulled, image, err)
+		}
+	}
+	inspect, _, err := dockerClient.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return fmt.Errorf("failed inspecting image '%s': %w", image, err)
+	}
+
+	rel := "images/" + vendorName(image) + ".tar"
+	path := filepath.Join(v.staging, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed creating directory '%s': %w", filepath.Dir(path), err)
+	}
+	r, err := dockerClient.ImageSave(ctx, []string{image})
+	if err != nil {
+		return fmt.Errorf("failed exporting image '%s': %w", image, err)
+	}
+	defer r.Close()
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed creating '%s': %w", path, err)
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("failed exporting image '%s' to '%s': %w", image, path, err)
+	}
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.images[image] = VendoredImage{Image: image, Path: rel, ID: inspect.ID}
+	return nil
+}
+
+// vendorName derives a readable, unique file name for the given URL or image reference.
+func vendorName(s string) string {
+	name := vendorNameRE.ReplaceAllString(s, "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	hash := sha256.Sum256([]byte(s))
+	return name + "-" + hex.EncodeToString(hash[:])[:12]
+}
+
+// copyPath copies the given file or directory tree to the given destination, ignoring Git metadata. File modes are
+// preserved, and so are symbolic links, as long as they are relative and point within the copied tree (others fail the
+// copy, since they would dangle once copied).
+func copyPath(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return fmt.Errorf("failed computing relative path of '%s': %w", path, err)
+		}
+		target := filepath.Join(dst, rel)
+		info, err := e.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat '%s': %w", path, err)
+		}
+		if e.IsDir() {
+			if e.Name() == ".git" {
+				return fs.SkipDir
+			}
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		} else if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return fmt.Errorf("failed creating directory '%s': %w", filepath.Dir(target), err)
+		}
+
+		if e.Type()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("failed reading symbolic link '%s': %w", path, err)
+			}
+			if filepath.IsAbs(link) {
+				return fmt.Errorf("symbolic link '%s' has an absolute target ('%s'), which cannot be vendored", path, link)
+			} else if within, err := filepath.Rel(src, filepath.Join(filepath.Dir(path), link)); err != nil || within == ".." || strings.HasPrefix(within, ".."+string(filepath.Separator)) {
+				return fmt.Errorf("symbolic link '%s' points outside of '%s' (to '%s'), and cannot be vendored", path, src, link)
+			} else if err := os.Symlink(link, target); err != nil {
+				return fmt.Errorf("failed creating symbolic link '%s': %w", target, err)
+			}
+			return nil
+		} else if !e.Type().IsRegular() {
+			return fmt.Errorf("unsupported file type of '%s': %s", path, e.Type())
+		}
+
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed reading '%s': %w", path, err)
+		} else if err := os.WriteFile(target, b, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed writing '%s': %w", target, err)
+		}
+		return nil
+	})
+}
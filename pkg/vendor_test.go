@@ -0,0 +1,238 @@
+package kude
+
+import (
+	"bytes"
+	"context"
+	"github.com/arikkfir/kude/internal"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVendorOfflineBuild(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	repo := t.TempDir()
+	yml := "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: vendored\n"
+	if err := os.WriteFile(filepath.Join(repo, "service-account.yaml"), []byte(yml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "-A"}, {"commit", "-q", "-m", "initial"}} {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+	}
+
+	pkg := t.TempDir()
+	kudeYAML := "apiVersion: kude.kfirs.com/v1alpha2\nkind: Pipeline\nresources:\n  - git::file://" + filepath.ToSlash(repo) + "\n"
+	if err := os.WriteFile(filepath.Join(pkg, "kude.yaml"), []byte(kudeYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	build := func(offline bool) (string, error) {
+		vendor, err := OpenVendor(pkg, offline)
+		if err != nil {
+			return "", err
+		}
+		defer vendor.Discard()
+		p, err := NewPipeline(pkg)
+		if err != nil {
+			return "", err
+		}
+		e, err := NewExecution(p, log.New(&internal.TestWriter{T: t}, "", 0), WithVendor(vendor))
+		if err != nil {
+			return "", err
+		}
+		out := &bytes.Buffer{}
+		if err := e.ExecuteToWriter(context.Background(), out); err != nil {
+			return "", err
+		} else if !offline {
+			if err := vendor.Save(); err != nil {
+				return "", err
+			}
+		}
+		return out.String(), nil
+	}
+
+	if _, err := build(true); err == nil {
+		t.Errorf("expected offline build to fail before vendoring, got nil")
+	} else if !strings.Contains(err.Error(), "run 'kude vendor' first") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if _, err := build(false); err != nil {
+		t.Fatalf("failed vendoring package: %v", err)
+	} else if err := os.RemoveAll(repo); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := build(true); err != nil {
+		t.Fatalf("failed building offline: %v", err)
+	} else if !strings.Contains(out, "name: vendored") {
+		t.Errorf("expected vendored resource in output, got:\n%s", out)
+	}
+
+	kudeYAML += "  - git::file:///non-existent/repository\n"
+	if err := os.WriteFile(filepath.Join(pkg, "kude.yaml"), []byte(kudeYAML), 0644); err != nil {
+		t.Fatal(err)
+	} else if _, err := build(false); err == nil {
+		t.Errorf("expected vendoring to fail for a resource that does not exist, got nil")
+	} else if staged, err := filepath.Glob(filepath.Join(pkg, ".vendor.tmp-*")); err != nil {
+		t.Fatal(err)
+	} else if len(staged) > 0 {
+		t.Errorf("expected failed vendoring to leave no temporary directories behind, found: %v", staged)
+	} else if _, err := os.Stat(filepath.Join(pkg, VendorDirName, VendorManifestFileName)); err != nil {
+		t.Errorf("expected failed vendoring to leave the vendor directory intact: %v", err)
+	}
+	if _, err := build(true); err == nil {
+		t.Errorf("expected offline build to fail for a resource that is not vendored, got nil")
+	} else if !strings.Contains(err.Error(), "resource 'git::file:///non-existent/repository' is not vendored") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestVendorOfflineBuildOfKustomizationSubdirectory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	repo := t.TempDir()
+	files := map[string]string{
+		"base/kustomization.yaml":          "resources:\n  - service-account.yaml\n",
+		"base/service-account.yaml":        "apiVersion: v1\nkind: ServiceAccount\nmetadata:\n  name: test\n",
+		"overlays/prod/kustomization.yaml": "namePrefix: prod-\nresources:\n  - ../../base\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(repo, name)), 0755); err != nil {
+			t.Fatal(err)
+		} else if err := os.WriteFile(filepath.Join(repo, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "-A"}, {"commit", "-q", "-m", "initial"}} {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = repo
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, output)
+		}
+	}
+
+	pkg := t.TempDir()
+	kudeYAML := "apiVersion: kude.kfirs.com/v1alpha2\nkind: Pipeline\nresources:\n  - git::file://" + filepath.ToSlash(repo) + "//overlays/prod\n"
+	if err := os.WriteFile(filepath.Join(pkg, "kude.yaml"), []byte(kudeYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+	build := func(offline bool) (string, error) {
+		vendor, err := OpenVendor(pkg, offline)
+		if err != nil {
+			return "", err
+		}
+		defer vendor.Discard()
+		p, err := NewPipeline(pkg)
+		if err != nil {
+			return "", err
+		}
+		e, err := NewExecution(p, log.New(&internal.TestWriter{T: t}, "", 0), WithVendor(vendor))
+		if err != nil {
+			return "", err
+		}
+		out := &bytes.Buffer{}
+		if err := e.ExecuteToWriter(context.Background(), out); err != nil {
+			return "", err
+		} else if !offline {
+			if err := vendor.Save(); err != nil {
+				return "", err
+			}
+		}
+		return out.String(), nil
+	}
+
+	if out, err := build(false); err != nil {
+		t.Fatalf("failed vendoring package: %v", err)
+	} else if !strings.Contains(out, "name: prod-test") {
+		t.Errorf("expected kustomized resource in output, got:\n%s", out)
+	} else if err := os.RemoveAll(repo); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := build(true); err != nil {
+		t.Fatalf("failed building offline: %v", err)
+	} else if !strings.Contains(out, "name: prod-test") {
+		t.Errorf("expected vendored kustomized resource in output, got:\n%s", out)
+	}
+}
+
+func TestVendorOfflineBuildInlinesOfflineFunctions(t *testing.T) {
+	pkg := t.TempDir()
+	kudeYAML := `apiVersion: kude.kfirs.com/v1alpha2
+kind: Pipeline
+steps:
+  - image: ghcr.io/arikkfir/kude/functions/helm-template
+    config:
+      chart: oci://ghcr.io/arikkfir/charts/missing
+      version: 1.0.0
+`
+	if err := os.WriteFile(filepath.Join(pkg, "kude.yaml"), []byte(kudeYAML), 0644); err != nil {
+		t.Fatal(err)
+	} else if vendor, err := OpenVendor(pkg, false); err != nil {
+		t.Fatal(err)
+	} else if err := vendor.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	vendor, err := OpenVendor(pkg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := newInliningPipeline(pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewExecution(p, log.New(&internal.TestWriter{T: t}, "", 0), WithVendor(vendor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.ExecuteToWriter(context.Background(), &bytes.Buffer{}); err == nil {
+		t.Errorf("expected offline build to fail for a chart that is not cached, got nil")
+	} else if !strings.Contains(err.Error(), "chart is not cached, and cannot be downloaded in offline mode") {
+		t.Errorf("expected chart not to be downloaded in an offline build, got: %v", err)
+	}
+}
+
+func TestCopyPath(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	} else if err := os.WriteFile(filepath.Join(src, "bin", "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	} else if err := os.Symlink(filepath.Join("bin", "run.sh"), filepath.Join(src, "run.sh")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "copy")
+	if err := copyPath(src, dst); err != nil {
+		t.Fatalf("failed copying: %v", err)
+	}
+	if stat, err := os.Stat(filepath.Join(dst, "bin", "run.sh")); err != nil {
+		t.Fatal(err)
+	} else if stat.Mode().Perm() != 0755 {
+		t.Errorf("expected file mode to be preserved, got: %v", stat.Mode())
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "run.sh")); err != nil {
+		t.Errorf("expected symbolic link to be preserved: %v", err)
+	} else if link != filepath.Join("bin", "run.sh") {
+		t.Errorf("unexpected symbolic link target: %s", link)
+	}
+
+	if err := os.Symlink(filepath.Join("..", "outside"), filepath.Join(src, "outside")); err != nil {
+		t.Fatal(err)
+	} else if err := copyPath(src, filepath.Join(t.TempDir(), "copy")); err == nil {
+		t.Errorf("expected copying a symbolic link pointing outside the tree to fail, got nil")
+	} else if !strings.Contains(err.Error(), "points outside of") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}